@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The ImageService of proto/imageresize.proto. Its three messages are small
+// enough to be encoded by hand with protowire, which spares the build a
+// protoc step. Keep the field numbers in sync with the .proto file.
+
+type GRPCFormatRequest struct {
+	Name        string
+	Image       []byte
+	OptionsJSON string
+}
+
+type GRPCImage struct {
+	Name        string
+	ContentType string
+	Data        []byte
+	Width       int
+	Height      int
+}
+
+type GRPCFormatResponse struct {
+	Formatted  *GRPCImage
+	Thumbnails []*GRPCImage
+}
+
+func (m *GRPCFormatRequest) unmarshalWire(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Name, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			m.Image = append([]byte{}, v...)
+		case num == 3 && typ == protowire.BytesType:
+			m.OptionsJSON, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (m *GRPCImage) marshalWire() []byte {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.ContentType != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.ContentType)
+	}
+	if len(m.Data) > 0 {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Data)
+	}
+	if m.Width != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Width))
+	}
+	if m.Height != 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Height))
+	}
+	return b
+}
+
+func (m *GRPCFormatResponse) marshalWire() []byte {
+	var b []byte
+	if m.Formatted != nil {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Formatted.marshalWire())
+	}
+	for _, t := range m.Thumbnails {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, t.marshalWire())
+	}
+	return b
+}
+
+// wireCodec replaces the protobuf codec of the gRPC server with the hand
+// written encoding of the messages.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(interface{ marshalWire() []byte })
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(interface{ unmarshalWire([]byte) error })
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+type imageServer interface {
+	Format(ctx context.Context, request *GRPCFormatRequest) (*GRPCFormatResponse, error)
+}
+
+var imageServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imageresize.ImageService",
+	HandlerType: (*imageServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Format", Handler: handleFormatRPC},
+	},
+	Metadata: "proto/imageresize.proto",
+}
+
+func handleFormatRPC(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	request := &GRPCFormatRequest{}
+	if err := dec(request); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(imageServer).Format(ctx, request)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/imageresize.ImageService/Format"}
+	return interceptor(ctx, request, info, func(ctx context.Context, request interface{}) (interface{}, error) {
+		return srv.(imageServer).Format(ctx, request.(*GRPCFormatRequest))
+	})
+}
+
+// imageService processes the images like the /format endpoint with the
+// inline response, returning the outputs instead of saving them.
+type imageService struct{}
+
+func (s *imageService) Format(ctx context.Context, request *GRPCFormatRequest) (*GRPCFormatResponse, error) {
+	options := imageproc.Options{}
+	if request.OptionsJSON != "" {
+		if err := json.Unmarshal([]byte(request.OptionsJSON), &options); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid options: %v", err)
+		}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid options: %v", err)
+	}
+	if len(request.Image) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "image is required")
+	}
+	if request.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required, its extension picks the output format")
+	}
+
+	src, _, fail := loadSource(request.Name, bytes.NewReader(request.Image), &options, false)
+	if fail != nil {
+		return nil, fail.grpcStatus()
+	}
+	result, fail := processSource(request.Name, src, &options)
+	if fail != nil {
+		return nil, fail.grpcStatus()
+	}
+
+	response := &GRPCFormatResponse{}
+	for i, r := range result {
+		var buf bytes.Buffer
+		contentType, err := imageproc.Encode(&buf, &r, &options)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode image %s: %v", r.Name, err)
+		}
+		size := r.Image.Bounds().Size()
+		img := &GRPCImage{Name: filepath.Base(r.Name), ContentType: contentType, Data: buf.Bytes(), Width: size.X, Height: size.Y}
+		if i == 0 && !options.SkipPrimary {
+			response.Formatted = img
+		} else {
+			response.Thumbnails = append(response.Thumbnails, img)
+		}
+	}
+	return response, nil
+}
+
+// grpcStatus maps the HTTP status of the failure to a gRPC status.
+func (f *failure) grpcStatus() error {
+	code := codes.Internal
+	switch f.Status {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		code = codes.InvalidArgument
+	case http.StatusRequestEntityTooLarge:
+		code = codes.ResourceExhausted
+	}
+	return status.Errorf(code, "%s: %s", f.Err.Code, f.Err.Message)
+}
+
+// requireTokenRPC is the gRPC counterpart of requireToken, checking the
+// authorization metadata.
+func requireTokenRPC(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var auth string
+		if values := md.Get("authorization"); len(values) > 0 {
+			auth = values[0]
+		}
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
+		}
+		return handler(ctx, request)
+	}
+}
+
+// startGRPC serves the ImageService on config.GRPCPort in the background.
+func startGRPC(config *APIConfig) *grpc.Server {
+	port := config.GRPCPort
+	if !strings.HasPrefix(port, ":") {
+		port = ":" + port
+	}
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(wireCodec{}),
+		// the upload limit applies to the image, leave room for the other fields
+		grpc.MaxRecvMsgSize(int(config.MaxUpload) + 64*1024),
+	}
+	if config.Token != "" {
+		opts = append(opts, grpc.UnaryInterceptor(requireTokenRPC(config.Token)))
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&imageServiceDesc, &imageService{})
+
+	go func() {
+		logging.Infof("gRPC listening on %s\n", port)
+		if err := srv.Serve(lis); err != nil {
+			logging.Errorf("%s", err)
+		}
+	}()
+	return srv
+}
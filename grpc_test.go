@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The client side of the messages, which the server doesn't need.
+
+func (m *GRPCFormatRequest) marshalWire() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.Name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, m.Image)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendString(b, m.OptionsJSON)
+}
+
+func (m *GRPCImage) unmarshalWire(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, value []byte, varint uint64) {
+		switch num {
+		case 1:
+			m.Name = string(value)
+		case 2:
+			m.ContentType = string(value)
+		case 3:
+			m.Data = append([]byte{}, value...)
+		case 4:
+			m.Width = int(varint)
+		case 5:
+			m.Height = int(varint)
+		}
+	})
+}
+
+func (m *GRPCFormatResponse) unmarshalWire(b []byte) error {
+	var err error
+	consumeErr := consumeFields(b, func(num protowire.Number, value []byte, varint uint64) {
+		img := &GRPCImage{}
+		if e := img.unmarshalWire(value); e != nil {
+			err = e
+		}
+		switch num {
+		case 1:
+			m.Formatted = img
+		case 2:
+			m.Thumbnails = append(m.Thumbnails, img)
+		}
+	})
+	if consumeErr != nil {
+		return consumeErr
+	}
+	return err
+}
+
+// consumeFields calls field with the value of every bytes or varint field of b.
+func consumeFields(b []byte, field func(num protowire.Number, value []byte, varint uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			field(num, v, 0)
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			field(num, nil, v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func TestGRPCFormat(t *testing.T) {
+	port := freePort(t)
+	srv := startGRPC(&APIConfig{GRPCPort: port, MaxUpload: 1 << 20, Token: "secret"})
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("127.0.0.1:"+port,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	format := func(ctx context.Context, request *GRPCFormatRequest) (*GRPCFormatResponse, error) {
+		response := &GRPCFormatResponse{}
+		err := conn.Invoke(ctx, "/imageresize.ImageService/Format", request, response)
+		return response, err
+	}
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+
+	response, err := format(authorized, &GRPCFormatRequest{
+		Name:        "uploads/photo.png",
+		Image:       testPNG(t, 40, 20),
+		OptionsJSON: `{"resize": {"width": 20}, "thumbnails": [{"suffix": "-small", "width": 10}]}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted := response.Formatted
+	if formatted == nil || formatted.Name != "photo.png" || formatted.ContentType != "image/png" || formatted.Width != 20 || formatted.Height != 10 {
+		t.Fatalf("got the formatted image %+v, want a 20x10 photo.png", formatted)
+	}
+	img, err := png.Decode(bytes.NewReader(formatted.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(20, 10) {
+		t.Errorf("decoded %v, want 20x10", size)
+	}
+	if len(response.Thumbnails) != 1 || response.Thumbnails[0].Name != "photo-small.png" || response.Thumbnails[0].Width != 10 {
+		t.Errorf("got the thumbnails %+v, want a 10 pixels wide photo-small.png", response.Thumbnails)
+	}
+
+	for _, tt := range []struct {
+		ctx     context.Context
+		request *GRPCFormatRequest
+		want    codes.Code
+	}{
+		{ctx, &GRPCFormatRequest{Name: "photo.png", Image: testPNG(t, 4, 4)}, codes.Unauthenticated},
+		{authorized, &GRPCFormatRequest{Name: "photo.png", Image: testPNG(t, 4, 4), OptionsJSON: `{"quality": 500}`}, codes.InvalidArgument},
+		{authorized, &GRPCFormatRequest{Name: "photo.png", Image: []byte("not an image")}, codes.InvalidArgument},
+		{authorized, &GRPCFormatRequest{Name: "photo.png"}, codes.InvalidArgument},
+	} {
+		if _, err := format(tt.ctx, tt.request); status.Code(err) != tt.want {
+			t.Errorf("%s with the options %q: got %v, want %s", tt.request.Name, tt.request.OptionsJSON, err, tt.want)
+		}
+	}
+}
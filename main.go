@@ -4,344 +4,2489 @@ package main
 This programme is created as a util tool / API service for image resizing, rotation and cropping
 with the possibility of creating additional sizes / thumbnails of the formatted image.
 
-Order of actions: rotation, cropping, resizing
+The processing itself is implemented by the pkg/imageproc package, this is the CLI / Web API around it.
 */
 
 import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"image"
-	"image/color"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
 	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 func main() {
 	var (
-		help    = flag.Bool("help", false, "Displays help text.")
-		api     = flag.Bool("api", false, "Runs the script as a Web API. Requires a port to be specified.")
-		root    = flag.String("root", ".", "Root folder to store the processed images by the Web API. Default: .")
-		port    = flag.String("port", "", "The port to be used if the script would be run as a Web API.")
-		src     = flag.String("src", "", "Source image.")
-		dst     = flag.String("dst", "", "Destination of new image.")
-		cropx   = flag.Int("cropx", 0, "X coordinate to start crop.")
-		cropy   = flag.Int("cropy", 0, "Y coordinate to start crop.")
-		cropw   = flag.Int("cropw", 0, "Width of crop.")
-		croph   = flag.Int("croph", 0, "Height of crop.")
-		rotate  = flag.Float64("rotate", 0, "Degrees rotation.")
-		fill    = flag.String("fill", "black", "Color to fill: black / b, white / w. Default: transparent.")
-		resizew = flag.Int("resizew", 0, "Resize width. If 0, ratio will be preserved.")
-		resizeh = flag.Int("resizeh", 0, "Resize height. If 0, ratio will be preserved.")
+		help     = flag.Bool("help", false, "Displays help text.")
+		workers  = flag.Int("workers", runtime.GOMAXPROCS(0), "Number of thumbnails to generate concurrently. Default: GOMAXPROCS.")
+		loglevel = flag.String("loglevel", "info", "Log level: debug, info, warn or error. Default: info.")
+		verbose  = flag.Bool("verbose", false, "Logs every processing step. Same as -loglevel debug.")
+		quiet    = flag.Bool("quiet", false, "Only logs errors. Same as -loglevel error.")
+		maxdim   = flag.Int("maxdim", imageproc.MaxDimension, "Maximum width and height of resized images and thumbnails. 0 disables the cap. Default: 10000.")
+		api      = flag.Bool("api", false, "Runs the script as a Web API. Requires a port to be specified.")
+		maxup    = flag.String("maxupload", "2MB", "Maximum upload size accepted by the Web API, e.g. 512KB, 10MB. Default: 2MB.")
+		config   = flag.String("config", "", "JSON file with the options, in the same shape the Web API accepts. Explicit flags override its values.")
+		src      = flag.String("src", "", "Source image. May be a glob pattern, e.g. *.jpg.")
+		dst      = flag.String("dst", "", "Destination of new image. With a glob src, {name} and {ext} are replaced per file, e.g. out/{name}.jpg. - writes to stdout, encoded as -format.")
+		srcdir   = flag.String("srcdir", "", "Source directory. Processes every supported image in it, and in its subdirectories with -recursive.")
+		dstdir   = flag.String("dstdir", "", "Destination directory for the images processed from srcdir.")
+		sheetdir = flag.String("contactsheet", "", "Directory of images to compose into a single grid montage saved to dst.")
+		store    = flag.String("storage", "local", "Where the processed images are saved: local, or s3 for -bucket with the AWS credentials and region of the environment. Default: local.")
+		bucket   = flag.String("bucket", "", "Bucket of the s3 storage. The Web API keys are the image names, the CLI ones the destination paths.")
 	)
 
+	options := imageproc.Options{}
+	autoOrient := true
+	apiConfig := APIConfig{}
+	scriptConfig := ScriptConfig{}
+	sheet := imageproc.ContactSheet{}
+
+	flag.StringVar(&apiConfig.Root, "root", ".", "Root folder to store the processed images by the Web API. Default: .")
+	flag.StringVar(&apiConfig.Port, "port", "", "The port to be used if the script would be run as a Web API.")
+	flag.StringVar(&apiConfig.GRPCPort, "grpcport", "", "Serves the gRPC ImageService of proto/imageresize.proto on this port next to the Web API. Default: disabled.")
+	flag.StringVar(&apiConfig.Token, "token", "", "Bearer token required by the Web API. Default: $IMAGE_API_TOKEN, open when empty.")
+	flag.BoolVar(&apiConfig.Metrics, "metrics", false, "Exposes Prometheus metrics on /metrics in the Web API.")
+	flag.Float64Var(&apiConfig.RateLimit, "ratelimit", 0, "Requests per second the Web API accepts per client IP. Default: 0, unlimited.")
+	flag.IntVar(&apiConfig.RateBurst, "rateburst", 10, "Requests a client may send at once above the rate limit. Default: 10.")
+	flag.BoolVar(&apiConfig.TrustProxy, "trustproxy", false, "Reads the client IP of the rate limit and the access log from the last X-Forwarded-For entry, set by the proxy in front of the Web API.")
+	flag.BoolVar(&apiConfig.AccessLog, "accesslog", false, "Writes a JSON access record per Web API request to stdout.")
+	flag.IntVar(&apiConfig.CacheSize, "cachesize", 0, "Number of format results the Web API keeps in an in-memory LRU cache, keyed by the upload and options. Default: 0, disabled.")
+	flag.DurationVar(&apiConfig.ShutdownTimeout, "shutdowntimeout", 30*time.Second, "How long the Web API drains in-flight requests on shutdown. Default: 30s.")
+	flag.DurationVar(&apiConfig.ReadTimeout, "readtimeout", time.Minute, "Maximum duration for reading a request, upload included. Raise it for large uploads. Default: 1m.")
+	flag.DurationVar(&apiConfig.WriteTimeout, "writetimeout", 2*time.Minute, "Maximum duration for processing and writing a response. Default: 2m.")
+	flag.DurationVar(&apiConfig.IdleTimeout, "idletimeout", 2*time.Minute, "Maximum duration to keep idle connections open. Default: 2m.")
+
+	flag.IntVar(&saveRetry.Attempts, "saveattempts", 3, "Attempts to save each image before failing, for transient filesystem errors. Default: 3.")
+	flag.DurationVar(&saveRetry.Backoff, "savebackoff", 100*time.Millisecond, "Delay before the first save retry, doubled on every further retry. Default: 100ms.")
+	flag.DurationVar(&saveRetry.Timeout, "savetimeout", 10*time.Second, "Total time after which a failing save isn't retried anymore. 0 disables the limit. Default: 10s.")
+	flag.Func("dirmode", "Permission bits of the created output directories, in octal. Default: 0755.", func(value string) error {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > uint64(os.ModePerm) {
+			return fmt.Errorf("invalid directory mode %q", value)
+		}
+		dirMode = os.FileMode(mode)
+		return nil
+	})
+	flag.IntVar(&sheet.Columns, "sheetcolumns", 4, "Columns of the contact sheet. Default: 4.")
+	flag.IntVar(&sheet.CellWidth, "sheetcellw", 200, "Width of the contact sheet cells, each image is fitted into its cell. Default: 200.")
+	flag.IntVar(&sheet.CellHeight, "sheetcellh", 200, "Height of the contact sheet cells. Default: 200.")
+	flag.IntVar(&sheet.Padding, "sheetpadding", 10, "Space around and between the contact sheet cells, in pixels. Default: 10.")
+	flag.StringVar(&sheet.Background, "sheetbg", "white", "Background of the contact sheet, in the format of fill. Default: white.")
+	flag.BoolVar(&scriptConfig.Dedupe, "dedupe", false, "Hardlinks outputs identical to one written before in the same run instead of keeping a copy.")
+	flag.BoolVar(&scriptConfig.Overwrite, "overwrite", false, "Reprocesses the srcdir images whose outputs all exist in dstdir, skipped by default. Outputs of the s3 storage are always written.")
+	flag.BoolVar(&scriptConfig.Recursive, "recursive", false, "Descends into the subdirectories of srcdir, mirroring them under dstdir.")
+	flag.Func("ext", "Comma separated extensions processed from srcdir, e.g. jpg,png. Default: every supported one.", func(value string) error {
+		scriptConfig.Extensions = nil
+		for _, ext := range strings.Split(value, ",") {
+			if ext = strings.TrimPrefix(strings.TrimSpace(ext), "."); ext != "" {
+				scriptConfig.Extensions = append(scriptConfig.Extensions, strings.ToLower(ext))
+			}
+		}
+		return nil
+	})
+	flag.StringVar(&scriptConfig.Manifest, "manifest", "", "Path of a JSON manifest listing the source, outputs and options hash of every processed image. Default: none.")
+	flag.BoolVar(&scriptConfig.DryRun, "dryrun", false, "Processes the images and logs what would be written without saving anything.")
+	flag.BoolVar(&autoOrient, "autoorient", true, "Applies the EXIF orientation of the source image.")
+	flag.BoolVar(&allowPrivateURLs, "allowprivateurls", false, "Lets the Web API fetch image urls resolving to loopback, private and link-local addresses, e.g. for an internal image host.")
+	flag.IntVar(&options.Page, "page", 0, "Page of a multi-page TIFF source to process, starting at 0.")
+	flag.BoolVar(&options.Trim.Enabled, "trim", false, "Trims the uniform borders of the image before cropping.")
+	flag.IntVar(&options.Trim.Tolerance, "trimtolerance", 0, "Maximum difference of every channel (0-255) of a border pixel to the border color.")
+	flag.StringVar(&options.Trim.Color, "trimcolor", "", "Border color to trim, in the format of fill. Default: the top left pixel.")
+	flag.IntVar(&options.Crop.X, "cropx", 0, "X coordinate to start crop.")
+	flag.IntVar(&options.Crop.Y, "cropy", 0, "Y coordinate to start crop.")
+	flag.StringVar(&options.Crop.Unit, "cropunit", "px", "Unit of the crop values: px or percent.")
+	flag.StringVar(&options.Crop.Anchor, "cropanchor", "", "Crop cropw x croph from an anchor: center, top, topleft, bottomright... Ignores cropx and cropy.")
+	flag.IntVar(&options.Crop.Width, "cropw", 0, "Width of crop.")
+	flag.IntVar(&options.Crop.Height, "croph", 0, "Height of crop.")
+	flag.StringVar(&options.Crop.AspectRatio, "cropratio", "", "Crops the largest rectangle of an aspect ratio, e.g. 16:9, positioned by cropanchor. Ignores the other crop flags.")
+	flag.BoolVar(&options.FlipH, "fliph", false, "Flips the image horizontally.")
+	flag.BoolVar(&options.FlipV, "flipv", false, "Flips the image vertically.")
+	flag.BoolVar(&options.Transpose, "transpose", false, "Flips the image horizontally and rotates 90 degrees counter-clockwise.")
+	flag.BoolVar(&options.Transverse, "transverse", false, "Flips the image vertically and rotates 90 degrees counter-clockwise.")
+	flag.Float64Var(&options.Rotate, "rotate", 0, "Degrees rotation.")
+	flag.BoolVar(&options.RotateKeepSize, "rotatekeepsize", false, "Crops the rotated image back to its original size instead of expanding the canvas.")
+	flag.Float64Var(&options.Brightness, "brightness", 0, "Brightness adjustment (-100 to 100).")
+	flag.Float64Var(&options.Contrast, "contrast", 0, "Contrast adjustment (-100 to 100).")
+	flag.Float64Var(&options.Saturation, "saturation", 0, "Saturation adjustment (-100 to 100).")
+	flag.Float64Var(&options.Gamma, "gamma", 1, "Gamma correction. 1 is a no-op.")
+	flag.Float64Var(&options.Blur, "blur", 0, "Blur sigma applied after resizing. Default: no blur.")
+	flag.Float64Var(&options.Sharpen, "sharpen", 0, "Sharpen sigma applied after resizing. Default: no sharpening.")
+	flag.StringVar(&options.Caption.Text, "caption", "", "Text drawn onto the image after the adjustments, with the embedded Go font. Default: none.")
+	flag.Float64Var(&options.Caption.Size, "captionsize", 0, "Font size of the caption in pixels. Default: 5% of the image height.")
+	flag.StringVar(&options.Caption.Color, "captioncolor", "", "Caption text color, in the format of -fill. Default: white.")
+	flag.StringVar(&options.Caption.Position, "captionposition", "", "Caption position: top, bottomright, center... Default: bottom.")
+	flag.StringVar(&options.Caption.Background, "captionbg", "", "Color of a band behind the caption, e.g. #00000080. Default: none.")
+	flag.IntVar(&options.RoundCorners, "roundcorners", 0, "Radius of transparent rounded corners, in pixels. Saves as PNG unless -format supports transparency.")
+	flag.BoolVar(&options.Circle, "circle", false, "Masks the image to its inscribed circle / ellipse, e.g. for avatars. Saves as PNG unless -format supports transparency.")
+	flag.BoolVar(&options.Grayscale, "grayscale", false, "Converts the image to grayscale.")
+	flag.StringVar(&options.ColorModel, "colormodel", "", "Color model of the source and the outputs: rgba, rgb or gray, e.g. for CMYK JPEGs. Default: unchanged.")
+	flag.StringVar(&options.FlattenColor, "flatten", "", "Background of transparent areas when saving to JPEG, in the format of fill. Default: white.")
+	flag.StringVar(&options.Fill, "fill", "black", "Color to fill: a CSS color name such as cornflowerblue, b / w / t for black, white and transparent, or a hex color (#rrggbb, #rrggbbaa). Default: black.")
+	flag.IntVar(&options.Resize.Width, "resizew", 0, "Resize width. If 0, ratio will be preserved.")
+	flag.IntVar(&options.Resize.Height, "resizeh", 0, "Resize height. If 0, ratio will be preserved.")
+	flag.Func("thumbs", "Comma separated thumbnails as name:{width}x{height}, saved with the -name suffix, e.g. small:150x150,medium:400x400. A 0 or empty dimension keeps the ratio. Default: none.", func(value string) error {
+		thumbs, err := parseThumbs(value)
+		options.Thumbnails = thumbs
+		return err
+	})
+	flag.Func("widths", "Comma separated widths of aspect preserving thumbnails suffixed -{width}w, e.g. 320,640,1024.", func(value string) error {
+		widths, err := parseWidths(value)
+		options.Widths = widths
+		return err
+	})
+	flag.BoolVar(&options.SkipPrimary, "skipprimary", false, "Only saves the thumbnails, not the formatted image.")
+	flag.StringVar(&options.NameTemplate, "nametemplate", "", "Thumbnail name template with {base}, {ext}, {suffix}, {width}, {height} and {date:layout}, e.g. {date:2006-01-02}. Default: {base}{suffix}{ext}.")
+	flag.IntVar(&options.Quality, "quality", 0, "JPEG and WebP quality (1-100). Default: library default.")
+	flag.StringVar(&options.Format, "format", "", "Output format: jpeg, png, gif, tiff, bmp, webp. Default: inferred from dst.")
+	flag.Func("formats", "Comma separated output formats, each output is saved in all of them, e.g. jpeg,webp. Overrides format.", func(value string) error {
+		options.Formats = parseFormats(value)
+		return nil
+	})
+	flag.IntVar(&options.DPI, "dpi", 0, "Resolution written to JPEG and PNG outputs, for printing. Default: unset.")
+	flag.BoolVar(&options.Progressive, "progressive", false, "Encodes JPEGs as progressive JPEGs. Requires building with -tags libjpeg.")
+	flag.Func("maxbytes", "Byte budget of JPEG and WebP outputs, e.g. 100KB, met by lowering the quality down to 10. Default: none.", func(value string) error {
+		size, err := parseByteSize(value)
+		options.MaxBytes = int(size)
+		return err
+	})
+	flag.IntVar(&options.ExtractColors, "extractcolors", 0, "Adds that many dominant colors of the image to the manifest. Default: 0, none.")
+	flag.BoolVar(&options.Blurhash, "blurhash", false, "Adds a BlurHash placeholder of the image to the manifest.")
+	flag.BoolVar(&options.PHash, "phash", false, "Adds the perceptual hash of the image to the manifest, for near-duplicate detection.")
+	flag.IntVar(&options.Palette, "palette", 0, "Number of colors (2-256) of an indexed PNG output, or of a GIF output. Default: 0, full colors.")
+	flag.StringVar(&options.PNGCompression, "pngcompression", "", "PNG compression: none, fast, default, best. Default: default.")
+	flag.IntVar(&options.Resize.MaxWidth, "resizemaxw", 0, "Maximum width, larger images are scaled down keeping the ratio. Default: unbounded.")
+	flag.IntVar(&options.Resize.MaxHeight, "resizemaxh", 0, "Maximum height, larger images are scaled down keeping the ratio. Default: unbounded.")
+	flag.Float64Var(&options.Resize.Scale, "resizescale", 0, "Resizes to a fraction of the source size, e.g. 0.5. Overrides resizew and resizeh.")
+	flag.StringVar(&options.Resize.Mode, "resizemode", "", "Resize mode: exact, fit, fill, pad. Default: exact.")
+	flag.StringVar(&options.Resize.Background, "resizebg", "", "Canvas color of the pad resize mode, in the format of fill. Default: transparent.")
+	flag.BoolVar(&options.Resize.AllowUpscale, "upscale", false, "Allows resizing beyond the source size.")
+	flag.StringVar(&options.Resize.Filter, "resizefilter", "", "Resample filter: lanczos, catmullrom, linear, box, nearest... Default: lanczos.")
+	flag.BoolVar(&options.Resize.Smart, "smart", false, "Makes the fill resize mode keep the most detailed part of the image instead of the resizeanchor.")
+	flag.StringVar(&options.Resize.Anchor, "resizeanchor", "", "Anchor for the fill resize mode: center, top, topleft, bottomright... Default: center.")
+
 	flag.Parse()
 
-	if *help {
-		flag.Usage()
-		return
+	if *help {
+		flag.Usage()
+		return
+	}
+
+	level, err := logging.ParseLevel(*loglevel)
+	if err != nil {
+		log.Fatalf("Invalid loglevel: %v", err)
+	}
+	if *verbose {
+		level = logging.Debug
+	} else if *quiet {
+		level = logging.Error
+	}
+	logging.SetLevel(level)
+
+	if *workers > 0 {
+		imageproc.ThumbnailWorkers = *workers
+	}
+	imageproc.MaxDimension = *maxdim
+
+	root := ""
+	if *api {
+		root = apiConfig.Root
+	}
+	if storage, err = newStorage(*store, *bucket, root); err != nil {
+		log.Fatalf("Invalid storage: %v", err)
+	}
+	if _, local := storage.(*localStorage); scriptConfig.Dedupe && !local {
+		log.Fatalf("-dedupe requires the local storage")
+	}
+
+	if *api {
+		maxUpload, err := parseByteSize(*maxup)
+		if err != nil {
+			log.Fatalf("Invalid maxupload: %v", err)
+		}
+		apiConfig.MaxUpload = maxUpload
+		if apiConfig.Token == "" {
+			apiConfig.Token = os.Getenv("IMAGE_API_TOKEN")
+		}
+		startAPI(&apiConfig)
+		return
+	}
+
+	if *config != "" {
+		if err := loadConfig(*config, &options); err != nil {
+			log.Fatalf("Failed to load config %s: %v", *config, err)
+		}
+		if options.AutoOrient != nil {
+			autoOrient = *options.AutoOrient
+		}
+		// parse again so the explicitly passed flags override the config values
+		flag.Parse()
+	}
+	options.AutoOrient = &autoOrient
+
+	if *sheetdir != "" {
+		startContactSheet(*sheetdir, *dst, &sheet, &options, &scriptConfig)
+		return
+	}
+
+	if *srcdir != "" {
+		startBatch(*srcdir, *dstdir, &options, &scriptConfig)
+		return
+	}
+
+	startScript(*src, *dst, &options, &scriptConfig)
+}
+
+// parseThumbs parses a thumbnail list such as small:150x150,medium:400x.
+func parseThumbs(spec string) ([]imageproc.Thumb, error) {
+	var thumbs []imageproc.Thumb
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(entry, ":")
+		w, h, okSize := strings.Cut(size, "x")
+		if !ok || !okSize || name == "" {
+			return nil, fmt.Errorf("invalid thumbnail %q, expected name:{width}x{height}", entry)
+		}
+		thumb := imageproc.Thumb{Suffix: "-" + name}
+		for _, dim := range []struct {
+			value string
+			field *int
+		}{{w, &thumb.Width}, {h, &thumb.Height}} {
+			if dim.value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(dim.value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid thumbnail %q, dimensions must be non-negative integers", entry)
+			}
+			*dim.field = n
+		}
+		if thumb.Width == 0 && thumb.Height == 0 {
+			return nil, fmt.Errorf("invalid thumbnail %q, width or height is required", entry)
+		}
+		thumbs = append(thumbs, thumb)
+	}
+	return thumbs, nil
+}
+
+// parseWidths parses a comma separated list of widths such as 320,640.
+func parseWidths(spec string) ([]int, error) {
+	var widths []int
+	for _, v := range strings.Split(spec, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid width %q", v)
+		}
+		widths = append(widths, w)
+	}
+	return widths, nil
+}
+
+// parseFormats parses a comma separated list of formats such as jpeg,webp.
+func parseFormats(spec string) []string {
+	var formats []string
+	for _, f := range strings.Split(spec, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// loadConfig reads the JSON options file over the flag defaults in options.
+func loadConfig(path string, options *imageproc.Options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// json would decode into the default thumbnails in place, mixing their fields
+	thumbnails := options.Thumbnails
+	options.Thumbnails = nil
+	if err = json.Unmarshal(data, options); err != nil {
+		return err
+	}
+	if options.Thumbnails == nil {
+		options.Thumbnails = thumbnails
+	}
+	return nil
+}
+
+// APIConfig holds the settings of the Web API.
+type APIConfig struct {
+	Port      string
+	Root      string
+	MaxUpload int64
+	// GRPCPort, when set, serves the same processing over gRPC
+	GRPCPort string
+	// Token, when set, is required as a bearer token on every request except the health checks
+	Token string
+	// Metrics exposes Prometheus metrics on /metrics
+	Metrics bool
+	// CacheSize is the number of format results kept in memory. 0 disables the cache
+	CacheSize int
+	// RateLimit is the number of requests per second accepted per client IP,
+	// with bursts of up to RateBurst. 0 disables the limit
+	RateLimit float64
+	RateBurst int
+	// TrustProxy takes the client IP from X-Forwarded-For instead of the connection
+	TrustProxy bool
+	// AccessLog writes a JSON line per request to stdout
+	AccessLog bool
+	// ShutdownTimeout bounds how long in-flight requests are drained on SIGINT / SIGTERM
+	ShutdownTimeout time.Duration
+	// ReadTimeout covers reading the whole request, including the upload, so it
+	// has to be generous enough for large images on slow connections.
+	// WriteTimeout runs from the end of the request headers and includes processing.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+func startAPI(config *APIConfig) {
+	if config.CacheSize > 0 {
+		cache = newResultCache(config.CacheSize)
+	}
+	if config.Metrics {
+		metrics = newAPIMetrics()
+	}
+	if _, local := storage.(*localStorage); local {
+		prepareRoot(config.Root)
+	}
+	r := newRouter(config)
+
+	var handler http.Handler = r
+	if config.Token != "" {
+		handler = requireToken(config.Token, handler)
+	}
+	if config.RateLimit > 0 {
+		handler = limitRate(config, handler)
+	}
+	if config.AccessLog {
+		// outermost, so that rejected requests are logged as well
+		handler = logAccess(os.Stdout, config.TrustProxy, handler)
+	}
+	port := config.Port
+	if !strings.HasPrefix(port, ":") {
+		port = ":" + port
+	}
+
+	srv := &http.Server{
+		Addr:         port,
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
+	}
+	var grpcServer *grpc.Server
+	if config.GRPCPort != "" {
+		grpcServer = startGRPC(config)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		logging.Infof("Received %s, draining requests for up to %s...\n", sig, config.ShutdownTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if grpcServer != nil {
+			drained := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(drained)
+			}()
+			defer func() {
+				select {
+				case <-drained:
+				case <-ctx.Done():
+					grpcServer.Stop()
+				}
+			}()
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			logging.Errorf("Shutdown failed: %s", err)
+		}
+		close(stopped)
+	}()
+
+	logging.Infof("Listening on %s\n", port)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logging.Errorf("%s", err)
+		return
+	}
+	<-stopped
+	logging.Infof("Server stopped")
+}
+
+// newRouter routes the endpoints of the Web API, without the middlewares.
+func newRouter(config *APIConfig) *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r.HandleFunc("/healthz", handleHealth).Methods("GET")
+	r.HandleFunc("/readyz", handleReady).Methods("GET")
+	if metrics != nil {
+		r.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})).Methods("GET")
+	}
+
+	r.Handle("/format", metrics.instrument(handleFormatRequest(config.MaxUpload))).Methods("POST")
+	r.Handle("/format/preview", metrics.instrument(handlePreviewRequest(config.MaxUpload))).Methods("POST")
+	r.Handle("/batch", metrics.instrument(handleBatchRequest(config.MaxUpload))).Methods("POST")
+	r.HandleFunc("/image/{name}", handleServeImage).Methods("GET", "HEAD")
+	r.HandleFunc("/image/{name}", handleDeleteImage).Methods("DELETE")
+	r.HandleFunc("/images", handleListImages).Methods("GET")
+	return r
+}
+
+// metrics is nil unless the API was started with metrics enabled.
+var metrics *apiMetrics
+
+type apiMetrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	images    prometheus.Counter
+	duration  prometheus.Histogram
+	cacheHits prometheus.Counter
+}
+
+func newAPIMetrics() *apiMetrics {
+	m := &apiMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "image_format_requests_total",
+			Help: "Format requests by outcome: success, client_error or server_error.",
+		}, []string{"outcome"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "image_api_errors_total",
+			Help: "Errors returned by the API by error code.",
+		}, []string{"code"}),
+		images: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "image_processed_images_total",
+			Help: "Images produced, including thumbnails.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "image_processing_duration_seconds",
+			Help:    "Duration of the image processing.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "image_cache_hits_total",
+			Help: "Format requests served from the result cache.",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.errors, m.images, m.duration, m.cacheHits)
+	return m
+}
+
+// instrument counts the requests served by next by outcome.
+func (m *apiMetrics) instrument(next http.HandlerFunc) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		outcome := "success"
+		if rec.status >= 500 {
+			outcome = "server_error"
+		} else if rec.status >= 400 {
+			outcome = "client_error"
+		}
+		m.requests.WithLabelValues(outcome).Inc()
+	})
+}
+
+func (m *apiMetrics) observeError(code string) {
+	if m != nil {
+		m.errors.WithLabelValues(code).Inc()
+	}
+}
+
+func (m *apiMetrics) observeProcessing(start time.Time, images int) {
+	if m != nil {
+		m.duration.Observe(time.Since(start).Seconds())
+		m.images.Add(float64(images))
+	}
+}
+
+func (m *apiMetrics) observeCacheHit() {
+	if m != nil {
+		m.cacheHits.Inc()
+	}
+}
+
+// cache is nil unless the API was started with a cache size.
+var cache *resultCache
+
+// resultCache is an LRU cache of the responses of formatted uploads, keyed by
+// the hash of the name, the upload and its options, so repeated requests reuse
+// the saved files.
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key      string
+	response *APIResponse
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{size: size, entries: list.New(), index: map[string]*list.Element{}}
+}
+
+// cacheKey hashes the name along with the upload and its options, since the
+// saved files are named after it.
+func cacheKey(name string, data []byte, options *imageproc.Options) string {
+	optionsJSON, _ := json.Marshal(options)
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(data)
+	h.Write(optionsJSON)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *resultCache) get(key string) (*APIResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	c.entries.MoveToFront(e)
+	return e.Value.(*cacheEntry).response, true
+}
+
+func (c *resultCache) put(key string, response *APIResponse) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.index[key]; ok {
+		e.Value.(*cacheEntry).response = response
+		c.entries.MoveToFront(e)
+		return
+	}
+	c.index[key] = c.entries.PushFront(&cacheEntry{key: key, response: response})
+	if c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.index, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops the entries listing the file at path, which was deleted.
+func (c *resultCache) invalidate(path string) {
+	if c == nil {
+		return
+	}
+	path = filepath.ToSlash(path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.entries.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*cacheEntry)
+		response := entry.response
+		references := response.Formatted == path || response.Original == path
+		for _, thumb := range response.Thumbnails {
+			references = references || thumb == path
+		}
+		if references {
+			c.entries.Remove(e)
+			delete(c.index, entry.key)
+		}
+		e = next
+	}
+}
+
+// statusRecorder captures the status code and the size of the body written
+// to the ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// AccessRecord is the JSON line logged for every request with -accesslog.
+type AccessRecord struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"durationMs"`
+	ClientIP string    `json:"clientIp"`
+}
+
+// logAccess writes an AccessRecord per request to out, as a JSON line.
+func logAccess(out io.Writer, trustProxy bool, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(out)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		record := AccessRecord{
+			Time:     start.UTC(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   rec.status,
+			Bytes:    rec.bytes,
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+			ClientIP: clientIP(r, trustProxy),
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := encoder.Encode(record); err != nil {
+			logging.Errorf("Failed to write the access log: %s", err)
+		}
+	})
+}
+
+// requireToken rejects requests without an "Authorization: Bearer <token>"
+// header. The health checks stay open for orchestrators.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientLimiter is the token bucket of a client IP.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limitRate rejects the requests of clients exceeding config.RateLimit with
+// 429 Too Many Requests. The health checks are not limited.
+func limitRate(config *APIConfig, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	clients := map[string]*clientLimiter{}
+	lastCleanup := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r, config.TrustProxy)
+		now := time.Now()
+
+		mu.Lock()
+		// forget idle clients, their buckets are full again anyway
+		if now.Sub(lastCleanup) > time.Minute {
+			for k, c := range clients {
+				if now.Sub(c.lastSeen) > 3*time.Minute {
+					delete(clients, k)
+				}
+			}
+			lastCleanup = now
+		}
+		client, ok := clients[ip]
+		if !ok {
+			client = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(config.RateLimit), config.RateBurst)}
+			clients[ip] = client
+		}
+		client.lastSeen = now
+		reservation := client.limiter.ReserveN(now, 1)
+		mu.Unlock()
+
+		if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+			retryAfter := time.Second
+			if reservation.OK() {
+				retryAfter = reservation.DelayFrom(now)
+				reservation.CancelAt(now)
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("rate limit of %v requests per second exceeded", config.RateLimit))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP of the client. Behind a trusted proxy it is the last
+// X-Forwarded-For entry, the one appended by the proxy, as the others may be spoofed.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwarded != "" {
+			entries := strings.Split(forwarded, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type StatusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StatusResponse{Status: "ok"})
+}
+
+// handleReady reports ready when the storage can be written to, e.g. a file
+// can be created and removed in the root dir.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := storage.Check(); err != nil {
+		logging.Warnf("Readiness check failed: %s", err)
+		writeJSON(w, http.StatusServiceUnavailable, StatusResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, StatusResponse{Status: "ok"})
+}
+
+// parseByteSize parses sizes like 1024, 512KB, 10MB or 1GB.
+func parseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	var unit int64 = 1
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * unit, nil
+}
+
+// prepareRoot creates the root dir of the local storage, exiting when it is not a directory.
+func prepareRoot(root string) {
+	logging.Infof("Root dir: %s\n", root)
+
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalln(err)
+		}
+		if info != nil && !info.IsDir() {
+			log.Fatalf("%s is not a directory!", root)
+		}
+	}
+
+	if err := os.MkdirAll(root, dirMode); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func handleFormatRequest(maxUpload int64) func(http.ResponseWriter, *http.Request) {
+	return formatHandler(maxUpload, false)
+}
+
+// previewSize is the longest side of the /format/preview images.
+const previewSize = 512
+
+// handlePreviewRequest accepts the same requests as /format, but responds with
+// a small JPEG of the primary image instead of saving anything to the storage.
+func handlePreviewRequest(maxUpload int64) func(http.ResponseWriter, *http.Request) {
+	return formatHandler(maxUpload, true)
+}
+
+func formatHandler(maxUpload int64, preview bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			handleJSONFormatRequest(w, r, preview)
+			return
+		}
+
+		if err := r.ParseMultipartForm(maxUpload); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, "upload_too_large", err.Error())
+			} else {
+				writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			}
+			return
+		}
+
+		name := r.FormValue("name")
+		optionsJSON := r.FormValue("options")
+		imageURL := r.FormValue("url")
+		files := r.MultipartForm.File["image"]
+
+		logging.Debugf("Options: %s", optionsJSON)
+
+		logging.Debugf("Reading options...")
+		options := imageproc.Options{}
+		var err error
+		if _, ok := r.Form["options"]; ok {
+			err = json.Unmarshal([]byte(optionsJSON), &options)
+		} else {
+			err = optionsFromQuery(r.URL.Query(), &options)
+		}
+		if err == nil {
+			err = options.Validate()
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_options", Message: err.Error(), Field: "options"})
+			return
+		}
+
+		inline := preview || wantsInline(r)
+
+		if len(files) > 1 {
+			if inline {
+				writeError(w, http.StatusBadRequest, "invalid_request", "inline responses support a single image")
+				return
+			}
+			writeJSON(w, http.StatusOK, formatBatch(files, &options))
+			return
+		}
+
+		// imageData is only used here, the processing ignores it
+		var source struct {
+			ImageData string `json:"imageData"`
+		}
+		json.Unmarshal([]byte(optionsJSON), &source)
+
+		var img io.Reader
+		if len(files) == 0 && source.ImageData != "" {
+			mediaType, data, err := parseDataURI(source.ImageData)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_image", Message: err.Error(), Field: "imageData"})
+				return
+			}
+			img = bytes.NewReader(data)
+			if name == "" {
+				name = "image." + strings.TrimPrefix(mediaType, "image/")
+			}
+		} else if len(files) == 0 {
+			if imageURL == "" {
+				writeAPIError(w, http.StatusBadRequest, APIError{Code: "missing_image", Message: http.ErrMissingFile.Error(), Field: "image"})
+				return
+			}
+			logging.Infof("Fetching %s\n", imageURL)
+			data, fail := fetchImage(imageURL, maxUpload)
+			if fail != nil {
+				writeAPIError(w, fail.Status, fail.Err)
+				return
+			}
+			img = bytes.NewReader(data)
+			if name == "" {
+				name = path.Base(strings.SplitN(imageURL, "?", 2)[0])
+			}
+		} else {
+			file, err := files[0].Open()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+				return
+			}
+			defer file.Close()
+			img = file
+			if name == "" {
+				name = filepath.Base(files[0].Filename)
+			}
+		}
+
+		if preview {
+			respondPreview(w, name, img, &options)
+			return
+		}
+		respondFormat(w, name, img, &options, inline)
+	}
+}
+
+// optionsFromQuery sets the options from query parameters named like the CLI
+// flags, e.g. ?resizew=800&rotate=90&fill=white, for requests without an
+// options field. The options without a flag are named after their lowercased
+// JSON field, e.g. saveoriginal, except for crops, which only the options field
+// holds and which is rejected. Other parameters, such as inline, are ignored.
+func optionsFromQuery(query url.Values, options *imageproc.Options) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Func("autoorient", "", func(value string) error {
+		autoOrient, err := strconv.ParseBool(value)
+		options.AutoOrient = &autoOrient
+		return err
+	})
+	fs.BoolVar(&options.SaveOriginal, "saveoriginal", false, "")
+	fs.BoolVar(&options.OrientOriginal, "orientoriginal", false, "")
+	fs.BoolVar(&options.StripMetadata, "stripmetadata", false, "")
+	fs.BoolVar(&options.PreserveICC, "preserveicc", false, "")
+	fs.IntVar(&options.Page, "page", 0, "")
+	fs.BoolVar(&options.Trim.Enabled, "trim", false, "")
+	fs.IntVar(&options.Trim.Tolerance, "trimtolerance", 0, "")
+	fs.StringVar(&options.Trim.Color, "trimcolor", "", "")
+	fs.IntVar(&options.Crop.X, "cropx", 0, "")
+	fs.IntVar(&options.Crop.Y, "cropy", 0, "")
+	fs.StringVar(&options.Crop.Unit, "cropunit", "", "")
+	fs.StringVar(&options.Crop.Anchor, "cropanchor", "", "")
+	fs.IntVar(&options.Crop.Width, "cropw", 0, "")
+	fs.IntVar(&options.Crop.Height, "croph", 0, "")
+	fs.StringVar(&options.Crop.AspectRatio, "cropratio", "", "")
+	fs.BoolVar(&options.FlipH, "fliph", false, "")
+	fs.BoolVar(&options.FlipV, "flipv", false, "")
+	fs.BoolVar(&options.Transpose, "transpose", false, "")
+	fs.BoolVar(&options.Transverse, "transverse", false, "")
+	fs.Float64Var(&options.Rotate, "rotate", 0, "")
+	fs.BoolVar(&options.RotateKeepSize, "rotatekeepsize", false, "")
+	fs.StringVar(&options.Fill, "fill", "", "")
+	fs.StringVar(&options.FlattenColor, "flatten", "", "")
+	fs.BoolVar(&options.Grayscale, "grayscale", false, "")
+	fs.StringVar(&options.ColorModel, "colormodel", "", "")
+	fs.IntVar(&options.Resize.Width, "resizew", 0, "")
+	fs.IntVar(&options.Resize.Height, "resizeh", 0, "")
+	fs.Float64Var(&options.Resize.Scale, "resizescale", 0, "")
+	fs.IntVar(&options.Resize.MaxWidth, "resizemaxw", 0, "")
+	fs.IntVar(&options.Resize.MaxHeight, "resizemaxh", 0, "")
+	fs.StringVar(&options.Resize.Mode, "resizemode", "", "")
+	fs.StringVar(&options.Resize.Background, "resizebg", "", "")
+	fs.StringVar(&options.Resize.Anchor, "resizeanchor", "", "")
+	fs.StringVar(&options.Resize.Filter, "resizefilter", "", "")
+	fs.BoolVar(&options.Resize.AllowUpscale, "upscale", false, "")
+	fs.BoolVar(&options.Resize.Smart, "smart", false, "")
+	fs.Float64Var(&options.Brightness, "brightness", 0, "")
+	fs.Float64Var(&options.Contrast, "contrast", 0, "")
+	fs.Float64Var(&options.Saturation, "saturation", 0, "")
+	fs.Float64Var(&options.Gamma, "gamma", 0, "")
+	fs.Float64Var(&options.Blur, "blur", 0, "")
+	fs.Float64Var(&options.Sharpen, "sharpen", 0, "")
+	fs.StringVar(&options.Caption.Text, "caption", "", "")
+	fs.Float64Var(&options.Caption.Size, "captionsize", 0, "")
+	fs.StringVar(&options.Caption.Color, "captioncolor", "", "")
+	fs.StringVar(&options.Caption.Position, "captionposition", "", "")
+	fs.StringVar(&options.Caption.Background, "captionbg", "", "")
+	fs.IntVar(&options.RoundCorners, "roundcorners", 0, "")
+	fs.BoolVar(&options.Circle, "circle", false, "")
+	fs.Func("thumbs", "", func(value string) error {
+		thumbs, err := parseThumbs(value)
+		options.Thumbnails = thumbs
+		return err
+	})
+	fs.Func("widths", "", func(value string) error {
+		widths, err := parseWidths(value)
+		options.Widths = widths
+		return err
+	})
+	fs.Func("crops", "", func(string) error {
+		return errors.New("crops are only supported in the options field")
+	})
+	fs.BoolVar(&options.SkipPrimary, "skipprimary", false, "")
+	fs.StringVar(&options.NameTemplate, "nametemplate", "", "")
+	fs.IntVar(&options.Quality, "quality", 0, "")
+	fs.StringVar(&options.Format, "format", "", "")
+	fs.Func("formats", "", func(value string) error {
+		options.Formats = parseFormats(value)
+		return nil
+	})
+	fs.IntVar(&options.DPI, "dpi", 0, "")
+	fs.BoolVar(&options.Progressive, "progressive", false, "")
+	fs.Func("maxbytes", "", func(value string) error {
+		size, err := parseByteSize(value)
+		options.MaxBytes = int(size)
+		return err
+	})
+	fs.IntVar(&options.ExtractColors, "extractcolors", 0, "")
+	fs.BoolVar(&options.Blurhash, "blurhash", false, "")
+	fs.BoolVar(&options.PHash, "phash", false, "")
+	fs.StringVar(&options.PNGCompression, "pngcompression", "", "")
+	fs.IntVar(&options.Palette, "palette", 0, "")
+
+	for name, values := range query {
+		if fs.Lookup(name) == nil || len(values) == 0 {
+			continue
+		}
+		if err := fs.Set(name, values[len(values)-1]); err != nil {
+			return fmt.Errorf("invalid query parameter %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// JSONFormatRequest is the body of a /format request sent as application/json.
+type JSONFormatRequest struct {
+	Name string `json:"name"`
+	// Image is the base64 encoded image
+	Image   string            `json:"image"`
+	Options imageproc.Options `json:"options"`
+}
+
+func handleJSONFormatRequest(w http.ResponseWriter, r *http.Request, preview bool) {
+	request := JSONFormatRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, "upload_too_large", err.Error())
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		return
+	}
+
+	if err := request.Options.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_options", Message: err.Error(), Field: "options"})
+		return
+	}
+
+	if request.Image == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: "missing_image", Message: "image is required", Field: "image"})
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(request.Image)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_image", Message: err.Error(), Field: "image"})
+		return
+	}
+
+	if preview {
+		respondPreview(w, request.Name, bytes.NewReader(data), &request.Options)
+		return
+	}
+	respondFormat(w, request.Name, bytes.NewReader(data), &request.Options, wantsInline(r))
+}
+
+// respondPreview writes the primary image as a JPEG fitting previewSize. The
+// thumbnails, crops and extra formats are skipped and nothing is saved.
+func respondPreview(w http.ResponseWriter, name string, img io.Reader, options *imageproc.Options) {
+	preview := *options
+	preview.Thumbnails = nil
+	preview.Widths = nil
+	preview.Crops = nil
+	preview.Formats = nil
+	preview.SkipPrimary = false
+	preview.Format = "jpeg"
+
+	srcImg, _, fail := loadSource(name, img, &preview, false)
+	if fail != nil {
+		writeAPIError(w, fail.Status, fail.Err)
+		return
+	}
+	result, fail := processSource(name, srcImg, &preview)
+	if fail != nil {
+		writeAPIError(w, fail.Status, fail.Err)
+		return
+	}
+
+	result[0].Image = imaging.Fit(result[0].Image, previewSize, previewSize, imaging.Linear)
+	writeInline(w, result[:1], &preview)
+}
+
+// respondFormat formats a single image and writes either the JSON response
+// or, when inline, the images themselves.
+func respondFormat(w http.ResponseWriter, name string, img io.Reader, options *imageproc.Options, inline bool) {
+	if !inline {
+		response, fail := formatImage(name, img, options)
+		if fail != nil {
+			writeAPIError(w, fail.Status, fail.Err)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	srcImg, _, fail := loadSource(name, img, options, false)
+	if fail != nil {
+		writeAPIError(w, fail.Status, fail.Err)
+		return
+	}
+
+	result, fail := processSource(name, srcImg, options)
+	if fail != nil {
+		writeAPIError(w, fail.Status, fail.Err)
+		return
+	}
+
+	writeInline(w, result, options)
+}
+
+// checkImageName rejects the names of /image/{name} that are not a plain
+// file name at the root of the storage.
+func checkImageName(name string) error {
+	if name == "" || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	return nil
+}
+
+func handleServeImage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := checkImageName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_name", Message: err.Error(), Field: "name"})
+		return
+	}
+
+	f, info, err := storage.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("image %q not found", name))
+		} else {
+			writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		}
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	// ServeContent answers If-None-Match with the ETag and If-Modified-Since
+	// with the modification time, responding 304 Not Modified on a match
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Modified.UnixNano(), info.Bytes))
+	http.ServeContent(w, r, name, info.Modified, f)
+}
+
+// handleDeleteImage removes the named image. With ?thumbnails=true its
+// derived files ({base}-{suffix}{ext} and the {base}-original upload) are
+// removed as well.
+func handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := checkImageName(name); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_name", Message: err.Error(), Field: "name"})
+		return
+	}
+
+	if err := storage.Remove(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("image %q not found", name))
+		} else {
+			writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		}
+		return
+	}
+	logging.Infof("Deleted %s\n", storage.Location(name))
+	cache.invalidate(storage.Location(name))
+
+	if thumbs, _ := strconv.ParseBool(r.URL.Query().Get("thumbnails")); thumbs {
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		images, err := storage.List(base + "-")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+			return
+		}
+		for _, img := range images {
+			n := img.Name
+			if filepath.Ext(n) != ext && strings.TrimSuffix(n, filepath.Ext(n)) != base+"-original" {
+				continue
+			}
+			if err = storage.Remove(n); err != nil {
+				writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+				return
+			}
+			logging.Infof("Deleted %s\n", storage.Location(n))
+			cache.invalidate(storage.Location(n))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImageList is the response of GET /images.
+type ImageList struct {
+	Images []StoredImage `json:"images"`
+	// Total is the number of matching images, ignoring limit and offset
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+type StoredImage struct {
+	Name     string    `json:"name"`
+	Bytes    int64     `json:"bytes"`
+	Modified time.Time `json:"modified"`
+}
+
+// defaultListLimit is the page size of GET /images without a limit parameter.
+const defaultListLimit = 100
+
+// handleListImages lists the images in the storage sorted by name, optionally
+// filtered by the prefix query parameter and paginated with limit and offset.
+func handleListImages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	list := ImageList{Images: []StoredImage{}, Limit: defaultListLimit}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"limit", &list.Limit}, {"offset", &list.Offset}} {
+		v := query.Get(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_request", Message: fmt.Sprintf("%s must be a non-negative integer, got %q", param.name, v), Field: param.name})
+			return
+		}
+		*param.value = n
+	}
+
+	images, err := storage.List(query.Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+
+	list.Total = len(images)
+	if list.Offset < len(images) {
+		images = images[list.Offset:]
+		list.Images = append(list.Images, images[:min(len(images), list.Limit)]...)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// failure is an APIError along with the HTTP status to report it with.
+type failure struct {
+	Status int
+	Err    APIError
+}
+
+// formatImage processes the image and saves the results, along with the
+// original when requested, to the storage. The files are prefixed with a
+// random id, so that concurrent requests for the same name don't overwrite
+// each other. Nothing is left in the storage when it fails. A name that isn't
+// a plain file name is rejected.
+func formatImage(name string, img io.Reader, options *imageproc.Options) (*APIResponse, *failure) {
+	// the name is joined to the root, it must not reach outside of it
+	if err := checkImageName(name); err != nil {
+		return nil, &failure{http.StatusBadRequest, APIError{Code: "invalid_name", Message: err.Error(), Field: "name"}}
+	}
+	var key string
+	if cache != nil {
+		data, err := io.ReadAll(img)
+		if err != nil {
+			return nil, &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
+		}
+		key = cacheKey(name, data, options)
+		if response, ok := cache.get(key); ok {
+			logging.Infof("Serving cached result of %s\n", name)
+			metrics.observeCacheHit()
+			return response, nil
+		}
+		img = bytes.NewReader(data)
+	}
+
+	name = uniqueName(name)
+	srcImg, original, fail := loadSource(name, img, options, options.SaveOriginal)
+	if fail != nil {
+		return nil, fail
+	}
+
+	result, fail := processSource(name, srcImg, options)
+	if fail == nil {
+		var response *APIResponse
+		if response, fail = saveResults(result, options); fail == nil {
+			response.Original = filepath.ToSlash(original)
+			cache.put(key, response)
+			return response, nil
+		}
+	}
+	if original != "" {
+		storage.Remove(imageproc.ThumbName(name, "-original"))
+	}
+	return nil, fail
+}
+
+// uniqueName prefixes name with a random id.
+func uniqueName(name string) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id) + "-" + name
+}
+
+// formatBatch formats every uploaded file with the same options. A failing
+// file is reported in its result and does not fail the others.
+func formatBatch(files []*multipart.FileHeader, options *imageproc.Options) *BatchResponse {
+	batch := &BatchResponse{}
+	for _, fh := range files {
+		name := filepath.Base(fh.Filename)
+		result := BatchResult{Name: name, Status: http.StatusOK}
+
+		file, err := fh.Open()
+		if err != nil {
+			result.Status = http.StatusInternalServerError
+			result.Error = &APIError{Code: "storage_error", Message: err.Error()}
+		} else {
+			response, fail := formatImage(name, file, options)
+			file.Close()
+			if fail != nil {
+				logging.Warnf("Failed to format %s: %s", name, fail.Err.Message)
+				result.Status = fail.Status
+				result.Error = &fail.Err
+			}
+			result.APIResponse = response
+		}
+		batch.Results = append(batch.Results, result)
+	}
+	return batch
+}
+
+// handleBatchRequest formats every image of the uploaded zip "archive" with
+// the same "options". The results are saved to the storage and listed like a
+// multi-file /format upload, or, when inline or accepting application/zip,
+// streamed back as a zip mirroring the archive's directories, ending with a
+// batch.json of the skipped and failed entries. Entries are read one at a
+// time, each one bounded by maxUpload once decompressed.
+func handleBatchRequest(maxUpload int64) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+		// the archive spills to a temporary file instead of staying in memory
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, "upload_too_large", err.Error())
+			} else {
+				writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			}
+			return
+		}
+
+		options := imageproc.Options{}
+		err := json.Unmarshal([]byte(r.FormValue("options")), &options)
+		if err == nil {
+			err = options.Validate()
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_options", Message: err.Error(), Field: "options"})
+			return
+		}
+
+		file, header, err := r.FormFile("archive")
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: "missing_image", Message: err.Error(), Field: "archive"})
+			return
+		}
+		defer file.Close()
+		archive, err := zip.NewReader(file, header.Size)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: "invalid_archive", Message: err.Error(), Field: "archive"})
+			return
+		}
+
+		if !wantsInline(r) && !strings.Contains(r.Header.Get("Accept"), "application/zip") {
+			writeJSON(w, http.StatusOK, formatArchive(archive, maxUpload, func(name string, data []byte) (*APIResponse, *failure) {
+				return formatImage(path.Base(name), bytes.NewReader(data), &options)
+			}))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="batch.zip"`)
+		w.WriteHeader(http.StatusOK)
+		zw := zip.NewWriter(w)
+		batch := formatArchive(archive, maxUpload, func(name string, data []byte) (*APIResponse, *failure) {
+			return zipImage(zw, name, bytes.NewReader(data), &options)
+		})
+		// the status is already sent, the problems are reported in the zip
+		var problems BatchResponse
+		for _, result := range batch.Results {
+			if result.Error != nil {
+				problems.Results = append(problems.Results, result)
+			}
+		}
+		if report, err := zw.Create("batch.json"); err == nil {
+			json.NewEncoder(report).Encode(problems)
+		}
+		if err := zw.Close(); err != nil {
+			logging.Errorf("Failed to stream the batch zip: %s", err)
+		}
+	}
+}
+
+// formatArchive passes every file of the archive to format and collects the
+// results. Entries that aren't supported images are skipped with a 415 result.
+func formatArchive(archive *zip.Reader, maxUpload int64, format func(name string, data []byte) (*APIResponse, *failure)) *BatchResponse {
+	batch := &BatchResponse{}
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		// cleaned as an absolute path, so that ".." can't escape the archive
+		name := strings.TrimPrefix(path.Clean("/"+entry.Name), "/")
+		result := BatchResult{Name: name, Status: http.StatusOK}
+		if !imageproc.IsSupportedInput(name) {
+			logging.Infof("Skipping unsupported archive entry %s\n", name)
+			result.Status = http.StatusUnsupportedMediaType
+			result.Error = &APIError{Code: "unsupported_media_type", Message: "not a supported image"}
+			batch.Results = append(batch.Results, result)
+			continue
+		}
+
+		data, err := readEntry(entry, maxUpload)
+		var fail *failure
+		if err != nil {
+			fail = &failure{http.StatusBadRequest, APIError{Code: "invalid_archive", Message: err.Error()}}
+		} else {
+			result.APIResponse, fail = format(name, data)
+		}
+		if fail != nil {
+			logging.Warnf("Failed to format %s: %s", name, fail.Err.Message)
+			result.Status = fail.Status
+			result.Error = &fail.Err
+		}
+		batch.Results = append(batch.Results, result)
+	}
+	return batch
+}
+
+// readEntry decompresses the archive entry, failing beyond maxUpload bytes.
+func readEntry(entry *zip.File, maxUpload int64) ([]byte, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxUpload+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxUpload {
+		return nil, fmt.Errorf("%s is larger than %d bytes once decompressed", entry.Name, maxUpload)
+	}
+	return data, nil
+}
+
+// zipImage processes the image and writes the outputs to zw, in the directory
+// of name. The returned response lists the entries written.
+func zipImage(zw *zip.Writer, name string, img io.Reader, options *imageproc.Options) (*APIResponse, *failure) {
+	srcImg, _, fail := loadSource(path.Base(name), img, options, false)
+	if fail != nil {
+		return nil, fail
+	}
+	result, fail := processSource(path.Base(name), srcImg, options)
+	if fail != nil {
+		return nil, fail
+	}
+
+	response := &APIResponse{}
+	for i, r := range result {
+		entryName := path.Join(path.Dir(name), filepath.Base(r.Name))
+		out, err := zw.CreateHeader(&zip.FileHeader{Name: entryName, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return nil, &failure{http.StatusInternalServerError, APIError{Code: "encoding_failed", Message: err.Error()}}
+		}
+		var written byteCounter
+		if _, err := imageproc.Encode(io.MultiWriter(out, &written), &r, options); err != nil {
+			return nil, &failure{http.StatusInternalServerError, APIError{Code: "encoding_failed", Message: err.Error()}}
+		}
+		size := r.Image.Bounds().Size()
+		response.add(ImageInfo{Path: entryName, Width: size.X, Height: size.Y, Bytes: int64(written)}, i == 0 && !options.SkipPrimary)
+	}
+	return response, nil
+}
+
+// loadSource decodes the uploaded image. When save is true the upload is
+// also written to the storage as the original, whose location is returned.
+func loadSource(name string, img io.Reader, options *imageproc.Options, save bool) (*imageproc.Source, string, *failure) {
+	img, err := sniffImage(img)
+	if errors.Is(err, errUnsupportedType) {
+		return nil, "", &failure{http.StatusUnsupportedMediaType, APIError{Code: "unsupported_media_type", Message: err.Error(), Field: "image"}}
+	} else if err != nil {
+		return nil, "", &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
+	}
+
+	if !save {
+		logging.Debugf("Decoding upload...")
+		src, err := imageproc.Decode(img, options)
+		if err != nil {
+			return nil, "", decodeFailure(err)
+		}
+		return src, "", nil
+	}
+
+	// kept in memory, the upload is bounded by maxupload
+	data, err := io.ReadAll(img)
+	if err != nil {
+		return nil, "", &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
+	}
+	logging.Debugf("Decoding original...")
+	src, err := imageproc.Decode(bytes.NewReader(data), options)
+	if err != nil {
+		return nil, "", decodeFailure(err)
+	}
+
+	originalName := imageproc.ThumbName(name, "-original")
+	// GIFs carry no EXIF data, animations are kept as uploaded
+	if src.Animation == nil && ((options.ShouldAutoOrient() && options.OrientOriginal) || options.StripMetadata) {
+		logging.Debugf("Re-encoding original: %s\n", originalName)
+		var buf bytes.Buffer
+		format, err := imaging.FormatFromFilename(originalName)
+		if err == nil {
+			err = imaging.Encode(&buf, src.Image, format, options.EncodeOptions()...)
+		}
+		if err != nil {
+			logging.Errorf("Failed to save image: %s", err)
+			return nil, "", &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
+		}
+		data = buf.Bytes()
+	}
+
+	logging.Infof("Saving original: %s\n", storage.Location(originalName))
+	location, err := storage.Put(originalName, data)
+	if err != nil {
+		logging.Errorf("Failed to save image: %s", err)
+		return nil, "", &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
 	}
+	return src, location, nil
+}
 
-	if *api {
-		startAPI(*port, *root)
-		return
+var allowedContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/bmp":  true,
+	"image/tiff": true,
+	"image/webp": true,
+	"image/heic": true,
+}
+
+// decodeFailure reports a failed decode as an invalid image, unless reading
+// the upload failed.
+func decodeFailure(err error) *failure {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		logging.Errorf("Failed to read image: %s", err)
+		return &failure{http.StatusInternalServerError, APIError{Code: "storage_error", Message: err.Error()}}
 	}
+	logging.Warnf("Failed to decode image: %s", err)
+	return &failure{http.StatusBadRequest, APIError{Code: "invalid_image", Message: err.Error(), Field: "image"}}
+}
 
-	options := Options{
-		Crop: Crop{
-			X:      *cropx,
-			Y:      *cropy,
-			Width:  *cropw,
-			Height: *croph,
-		},
-		Rotate: *rotate,
-		Fill:   *fill,
-		Resize: Resize{
-			Width:  *resizew,
-			Height: *resizeh,
-		},
-		Thumbnails: []Thumb{
-			Thumb{
-				Suffix: "-small",
-				Width:  150,
-				Height: 150,
-			},
-		},
-	}
-
-	startScript(*src, *dst, &options)
-}
-
-func startAPI(port string, root string) {
-	r := mux.NewRouter()
+var errUnsupportedType = errors.New("unsupported content type")
 
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+// sniffImage checks the first 512 bytes of r against the allowed content types
+// and returns a reader yielding the full content.
+func sniffImage(r io.Reader) (io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
 
-	r.HandleFunc("/format", handleFormatRequest(root)).Methods("POST")
+	contentType := detectContentType(head)
+	if !allowedContentTypes[contentType] {
+		return nil, fmt.Errorf("%w %s", errUnsupportedType, contentType)
+	}
+	return io.MultiReader(bytes.NewReader(head), r), nil
+}
 
-	http.Handle("/", r)
+func detectContentType(data []byte) string {
+	// http.DetectContentType doesn't recognize TIFF
+	if bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")) {
+		return "image/tiff"
+	}
+	// nor HEIC
+	if imageproc.IsHEIF(data) {
+		return "image/heic"
+	}
+	return http.DetectContentType(data)
+}
 
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
+// parseDataURI decodes a base64 data URI such as data:image/png;base64,...
+// and checks that the declared media type matches the content.
+func parseDataURI(uri string) (string, []byte, error) {
+	meta, encoded, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasPrefix(uri, "data:") {
+		return "", nil, errors.New("invalid data uri, expected data:<media type>;base64,<data>")
+	}
+	mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+	if !isBase64 {
+		return "", nil, errors.New("only base64 encoded data uris are supported")
+	}
+	mediaType = strings.ToLower(mediaType)
+	if !allowedContentTypes[mediaType] {
+		return "", nil, fmt.Errorf("unsupported content type %q", mediaType)
 	}
 
-	log.Printf("Listening on %s\n", port)
-	log.Println(http.ListenAndServe(port, nil))
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	if detected := detectContentType(data); detected != mediaType {
+		return "", nil, fmt.Errorf("data uri declares %s but contains %s", mediaType, detected)
+	}
+	return mediaType, data, nil
 }
 
-func handleFormatRequest(root string) func(http.ResponseWriter, *http.Request) {
-	log.Printf("Root dir: %s\n", root)
-	var maxMem int64 = 2 * 1024 * 1024 // 2MB
+func processSource(name string, src *imageproc.Source, options *imageproc.Options) ([]imageproc.ProcessedImage, *failure) {
+	logging.Debugf("Processing...")
+	start := time.Now()
+	result, err := src.Process(name, options)
+	if err != nil {
+		logging.Warnf("Failed to process image: %s", err)
+		return nil, &failure{http.StatusBadRequest, APIError{Code: "invalid_options", Message: err.Error(), Field: "options"}}
+	}
+	metrics.observeProcessing(start, len(result))
+	return result, nil
+}
 
-	if info, err := os.Stat(root); err != nil || !info.IsDir() {
-		if err != nil && !os.IsNotExist(err) {
-			log.Fatalln(err)
+// saveResults saves the processed images to the storage. When one fails, the
+// images saved before it are removed.
+func saveResults(result []imageproc.ProcessedImage, options *imageproc.Options) (*APIResponse, *failure) {
+	response := &APIResponse{}
+	var saved []string
+	fail := func(err error) (*APIResponse, *failure) {
+		for _, name := range saved {
+			storage.Remove(name)
 		}
-		if info != nil && !info.IsDir() {
-			log.Fatalf("%s is not a directory!", root)
+		code := "encoding_failed"
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			code = "storage_error"
 		}
+		return nil, &failure{http.StatusInternalServerError, APIError{Code: code, Message: err.Error()}}
 	}
 
-	if err := os.Mkdir(root, os.ModeDir); err != nil && !os.IsExist(err) {
-		log.Fatalln(err)
+	for i, r := range result {
+		logging.Infof("Saving image %s\n", r.Name)
+		location, written, err := storage.Save(r.Name, &r, options)
+
+		if err != nil {
+			logging.Errorf("Failed to save image: %s", err)
+			return fail(err)
+		}
+		saved = append(saved, r.Name)
+
+		size := r.Image.Bounds().Size()
+		info := ImageInfo{Path: filepath.ToSlash(location), Width: size.X, Height: size.Y, Bytes: written}
+		response.add(info, i == 0 && !options.SkipPrimary)
 	}
+	if err := response.describe(result, options); err != nil {
+		return fail(err)
+	}
+	return response, nil
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseMultipartForm(maxMem)
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
 
-		_, h, err := r.FormFile("image")
-		name := r.FormValue("name")
-		optionsJSON := r.FormValue("options")
+// retryPolicy bounds the attempts of an operation failing with transient errors.
+type retryPolicy struct {
+	Attempts int
+	// Backoff is the delay before the first retry, doubled on every further one
+	Backoff time.Duration
+	// Timeout bounds the time from the first attempt after which no retry is
+	// started anymore. 0 is unbounded
+	Timeout time.Duration
+}
 
-		log.Println(optionsJSON)
+var saveRetry = retryPolicy{Attempts: 3, Backoff: 100 * time.Millisecond, Timeout: 10 * time.Second}
 
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
-		}
+// saveImage writes the image to path. It is a variable so that tests can fail it.
+var saveImage = imageproc.Save
 
-		img, err := h.Open()
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
-		}
+// transientErrors are the errnos of the failed saves that are retried, the
+// ones a busy or flaky filesystem recovers from.
+var transientErrors = []error{syscall.EAGAIN, syscall.EINTR, syscall.EIO, syscall.EBUSY, syscall.ETIMEDOUT}
 
-		log.Println("Reading options...")
-		options := Options{}
-		err = json.Unmarshal([]byte(optionsJSON), &options)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+func isTransient(err error) bool {
+	for _, transient := range transientErrors {
+		if errors.Is(err, transient) {
+			return true
 		}
+	}
+	return false
+}
 
-		_filepath := filepath.Join(root, getThumbName(name, "-original"))
-		log.Println("Saving original: %s", _filepath)
-		outfile, err := os.Create(_filepath)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+// dirMode is the permission of the directories created for the outputs.
+var dirMode os.FileMode = 0o755
+
+// saveWithRetry saves the image, retrying transient filesystem errors as
+// configured by saveRetry. Other errors, such as a denied permission or a
+// failed encoding, fail right away.
+func saveWithRetry(path string, img *imageproc.ProcessedImage, options *imageproc.Options) error {
+	backoff := saveRetry.Backoff
+	deadline := time.Now().Add(saveRetry.Timeout)
+	for attempt := 1; ; attempt++ {
+		err := saveImage(path, img, options)
+		if err == nil || attempt >= saveRetry.Attempts || !isTransient(err) {
+			return err
 		}
+		if saveRetry.Timeout > 0 && time.Now().Add(backoff).After(deadline) {
+			logging.Warnf("Failed to save %s (attempt %d of %d), giving up after %s: %s", path, attempt, saveRetry.Attempts, saveRetry.Timeout, err)
+			return err
+		}
+		logging.Warnf("Failed to save %s (attempt %d of %d), retrying in %s: %s", path, attempt, saveRetry.Attempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
 
-		if _, err = io.Copy(outfile, img); nil != err {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+// maxFetchRedirects bounds the redirects followed when fetching an image url.
+const maxFetchRedirects = 5
+
+// allowPrivateURLs is set from -allowprivateurls.
+var allowPrivateURLs bool
+
+var errForbiddenAddress = errors.New("the url resolves to a non-public address")
+
+// reservedNetworks are the IPv4 ranges besides the ones of the net.IP
+// predicates that never hold a public image host.
+var reservedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// isPublicIP reports whether ip may be fetched from: not loopback, private,
+// link-local (the cloud metadata endpoint 169.254.169.254 included),
+// multicast, unspecified or reserved.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, network := range reservedNetworks {
+		if network.Contains(addr) {
+			return false
 		}
+	}
+	return true
+}
 
-		log.Println("Opening original...")
-		srcImg, err := imaging.Open(_filepath)
-		if err != nil {
-			log.Printf("Failed to open image: %s", err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
+// checkFetchAddress is the Control of the fetchClient dialer, called with the
+// resolved address of every connection, so that a host name can't point the
+// api at an internal service.
+func checkFetchAddress(network string, address string, _ syscall.RawConn) error {
+	if allowPrivateURLs {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errForbiddenAddress, host)
+	}
+	return nil
+}
+
+// checkFetchURL checks the scheme and host of an image url or a redirect.
+// Literal addresses are checked right away, host names once resolved.
+func checkFetchURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("%q is not an http(s) url", u.String())
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowPrivateURLs && !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errForbiddenAddress, ip)
+	}
+	return nil
+}
+
+var fetchClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		// no proxy, the dialer must see the addresses of the image hosts
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkFetchAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxFetchRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
 		}
+		return checkFetchURL(req.URL)
+	},
+}
+
+// fetchImage downloads an image of at most maxBytes from imageURL. An
+// unreachable or failing upstream is reported as 502, a bad url or response as 400.
+func fetchImage(imageURL string, maxBytes int64) ([]byte, *failure) {
+	invalid := func(msg string) *failure {
+		return &failure{http.StatusBadRequest, APIError{Code: "invalid_url", Message: msg, Field: "url"}}
+	}
+	upstream := func(msg string) *failure {
+		return &failure{http.StatusBadGateway, APIError{Code: "fetch_failed", Message: msg, Field: "url"}}
+	}
+
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return nil, invalid(fmt.Sprintf("%q is not an http(s) url", imageURL))
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, invalid(err.Error())
+	}
+
+	resp, err := fetchClient.Get(imageURL)
+	if errors.Is(err, errForbiddenAddress) {
+		return nil, invalid(err.Error())
+	} else if err != nil {
+		return nil, upstream(err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, upstream(fmt.Sprintf("fetching %s returned %s", imageURL, resp.Status))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, upstream(err.Error())
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, invalid(fmt.Sprintf("%s exceeds the maximum size of %d bytes", imageURL, maxBytes))
+	}
 
-		log.Println("Processing...")
-		result := processImage(name, &srcImg, &options)
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(ct, "image/") {
+		return nil, invalid(fmt.Sprintf("%s is not an image: %s", imageURL, ct))
+	}
+	return data, nil
+}
 
-		response := APIResponse{
-			Original: filepath.ToSlash(_filepath),
+// wantsInline reports whether the processed images should be returned in the
+// response body instead of being saved to the storage.
+func wantsInline(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("inline")); err == nil {
+		return v
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.HasPrefix(strings.TrimSpace(accept), "image/") {
+			return true
 		}
+	}
+	return false
+}
 
-		for i, r := range *result {
-			thumbPath := filepath.Join(root, r.Name)
-			log.Printf("Saving image %s\n", thumbPath)
-			err = imaging.Save(*r.Image, thumbPath)
+// writeInline writes the primary image as the response body or, when there
+// are thumbnails, all images as a multipart/mixed response.
+func writeInline(w http.ResponseWriter, images []imageproc.ProcessedImage, options *imageproc.Options) {
+	var body bytes.Buffer
+	var contentType string
 
+	if len(images) == 1 {
+		ct, err := imageproc.Encode(&body, &images[0], options)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "encoding_failed", err.Error())
+			return
+		}
+		contentType = ct
+	} else {
+		mw := multipart.NewWriter(&body)
+		for _, img := range images {
+			var part bytes.Buffer
+			ct, err := imageproc.Encode(&part, &img, options)
 			if err != nil {
-				log.Printf("Failed to save image: %s", err)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(err.Error()))
+				writeError(w, http.StatusInternalServerError, "encoding_failed", err.Error())
 				return
 			}
-
-			thumbPath = filepath.ToSlash(thumbPath)
-			if i == 0 {
-				response.Formatted = thumbPath
-			} else {
-				response.Thumbnails = append(response.Thumbnails, thumbPath)
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", ct)
+			header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(img.Name)))
+			pw, err := mw.CreatePart(header)
+			if err == nil {
+				_, err = part.WriteTo(pw)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "encoding_failed", err.Error())
+				return
 			}
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
+		if err := mw.Close(); err != nil {
+			writeError(w, http.StatusInternalServerError, "encoding_failed", err.Error())
+			return
+		}
+		contentType = "multipart/mixed; boundary=" + mw.Boundary()
 	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	body.WriteTo(w)
 }
 
-func startScript(src string, dest string, options *Options) {
+// byteCounter is a writer counting the bytes written to it.
+type byteCounter int64
 
-	srcImg, err := imaging.Open(src)
-	if err != nil {
-		log.Fatalf("Failed to open image: %v", err)
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, msg string) {
+	writeAPIError(w, status, APIError{Code: code, Message: msg})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	logf := logging.Warnf
+	if status >= http.StatusInternalServerError {
+		logf = logging.Errorf
 	}
+	logf("Request failed with %d %s: %s", status, apiErr.Code, apiErr.Message)
+	metrics.observeError(apiErr.Code)
+	writeJSON(w, status, apiErr)
+}
 
-	result := processImage(dest, &srcImg, options)
+// ScriptConfig holds the settings of the CLI.
+type ScriptConfig struct {
+	// DryRun processes the images and logs the outputs without saving them
+	DryRun bool
+	// Manifest is the path of the JSON manifest of the outputs. Default: none
+	Manifest string
+	// Recursive descends into the subdirectories of the batch source directory
+	Recursive bool
+	// Extensions, without the dot, limit the files processed from the batch
+	// source directory. Default: every supported one
+	Extensions []string
+	// Overwrite reprocesses the batch sources whose outputs all exist already,
+	// which are skipped by default
+	Overwrite bool
+	// Dedupe replaces outputs with the same content as an earlier output of the
+	// run by a hardlink to it
+	Dedupe bool
+	// outputs maps the content hash of the saved outputs to their path, with Dedupe
+	outputs map[string]string
+	// skipExisting makes processFile skip the sources whose outputs all exist
+	skipExisting bool
+}
 
-	for _, r := range *result {
-		log.Printf("Saving image %s\n", r.Name)
-		err = imaging.Save(*r.Image, r.Name)
+// errOutputsExist is returned by processFile for a skipped source.
+var errOutputsExist = errors.New("every output already exists")
 
-		if err != nil {
-			log.Fatalf("Failed to save image: %v", err)
-		}
+// dedupeOutput hardlinks the saved output at path to an earlier one with the
+// same content. When the filesystem can't link, the written copy is kept.
+func (c *ScriptConfig) dedupeOutput(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	if c.outputs == nil {
+		c.outputs = map[string]string{}
+	}
+	existing, ok := c.outputs[key]
+	if !ok || existing == path {
+		c.outputs[key] = path
+		return nil
 	}
+
+	// linked next to the copy first, so it is only replaced once the link exists
+	tmp := path + ".dedupe"
+	if err := os.Link(existing, tmp); err != nil {
+		logging.Debugf("Keeping a copy of %s, cannot link it to %s: %s\n", path, existing, err)
+		return nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	logging.Infof("Linked %s to the identical %s\n", path, existing)
+	return nil
 }
 
-type Options struct {
-	Crop       Crop    `json:"crop,omitempty"`
-	Rotate     float64 `json:"rotate,omitempty"`
-	Fill       string  `json:"fill,omitempty"`
-	Resize     Resize  `json:"resize,omitempty"`
-	Thumbnails []Thumb `json:"thumbnails,omitempty"`
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
-type Crop struct {
-	X      int `json:"x,omitempty"`
-	Y      int `json:"y,omitempty"`
-	Width  int `json:"width,omitempty"`
-	Height int `json:"height,omitempty"`
+// allExist reports whether every one of the paths exists.
+func allExist(paths []string) bool {
+	for _, p := range paths {
+		if !fileExists(p) {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *Crop) shouldCrop(img *image.Image) bool {
-	size := (*img).Bounds().Size()
-	return c.X != 0 || c.Y != 0 ||
-		(c.Width > 0 && c.Height > 0 && (c.Width != size.X || c.Height != size.Y))
+// matchesExtension reports whether path has one of the Extensions, if set.
+func (c *ScriptConfig) matchesExtension(path string) bool {
+	if len(c.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	for _, e := range c.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
 }
 
-type Resize struct {
-	Width  int `json:"width,omitempty"`
-	Height int `json:"height,omitempty"`
+// Manifest summarizes the outputs of a CLI run for downstream indexing.
+type Manifest struct {
+	Images []ManifestEntry `json:"images"`
 }
 
-type Thumb struct {
-	Suffix string `json:"suffix,omitempty"`
-	Width  int    `json:"width,omitempty"`
-	Height int    `json:"height,omitempty"`
+type ManifestEntry struct {
+	Source string `json:"source"`
+	// OptionsHash is the SHA-256 of the JSON encoded options the outputs were produced with
+	OptionsHash string `json:"optionsHash"`
+	*APIResponse
 }
 
-type ProcessedImage struct {
-	Name  string
-	Image *image.Image
+func (m *Manifest) add(src string, options *imageproc.Options, response *APIResponse) {
+	data, _ := json.Marshal(options)
+	hash := sha256.Sum256(data)
+	m.Images = append(m.Images, ManifestEntry{Source: filepath.ToSlash(src), OptionsHash: hex.EncodeToString(hash[:]), APIResponse: response})
 }
 
-type APIResponse struct {
-	Formatted  string   `json:"formatted,omitempty"`
-	Original   string   `json:"original,omitempty"`
-	Thumbnails []string `json:"thumbnails,omitempty"`
+// writeManifest writes the manifest to the path of config, if set.
+func writeManifest(m *Manifest, config *ScriptConfig) {
+	if config.Manifest == "" {
+		return
+	}
+	if config.DryRun {
+		logging.Infof("Would write manifest %s: %d image(s)\n", config.Manifest, len(m.Images))
+		return
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		logging.Infof("Writing manifest %s\n", config.Manifest)
+		err = os.WriteFile(config.Manifest, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write manifest %s: %v", config.Manifest, err)
+	}
 }
 
-func processImage(name string, src *image.Image, options *Options) *[]ProcessedImage {
+// stdoutDest as dst writes the image to stdout instead of a file.
+const stdoutDest = "-"
 
-	images := make([]ProcessedImage, 1)
+func startScript(src string, dest string, options *imageproc.Options, config *ScriptConfig) {
+	if err := options.Validate(); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+	if dest == stdoutDest {
+		// stdout is a single stream, there is neither a file extension nor room for thumbnails
+		if options.Format == "" {
+			log.Fatalf("format is required when writing to stdout")
+		}
+		if len(options.Thumbnails) > 0 || len(options.Widths) > 0 {
+			log.Fatalf("thumbnails cannot be written to stdout")
+		}
+		if len(options.Formats) > 0 {
+			log.Fatalf("formats cannot be written to stdout, use format")
+		}
+	}
 
-	src = rotate(src, options.Rotate, options.Fill)
-	src = crop(src, &options.Crop)
-	src = resize(src, options.Resize.Width, options.Resize.Height)
+	var manifest Manifest
+	if !strings.ContainsAny(src, "*?[") {
+		response, err := processFile(src, dest, options, config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		manifest.add(src, options, response)
+		writeManifest(&manifest, config)
+		return
+	}
 
-	images[0] = ProcessedImage{
-		Name:  name,
-		Image: src,
+	matches, err := filepath.Glob(src)
+	if err != nil {
+		log.Fatalf("Invalid src pattern %s: %v", src, err)
+	}
+	if len(matches) == 0 {
+		log.Fatalf("No files match %s", src)
+	}
+	if len(matches) > 1 && !strings.Contains(dest, "{name}") {
+		log.Fatalf("dst must contain {name} when src matches multiple files, e.g. out/{name}.jpg")
 	}
 
-	if options.Thumbnails != nil {
-		for _, t := range options.Thumbnails {
-			thumbName := getThumbName(name, t.Suffix)
-			thumbImg := resize(src, t.Width, t.Height)
-			images = append(images, ProcessedImage{
-				Name:  thumbName,
-				Image: thumbImg,
-			})
+	for _, match := range matches {
+		matchDest := destFromTemplate(dest, match)
+		if !config.DryRun && matchDest != stdoutDest {
+			if err := os.MkdirAll(filepath.Dir(matchDest), dirMode); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		response, err := processFile(match, matchDest, options, config)
+		if err != nil {
+			log.Fatalln(err)
 		}
+		manifest.add(match, options, response)
 	}
+	writeManifest(&manifest, config)
+}
 
-	return &images
+// destFromTemplate replaces {name} and {ext} in the dst template with the
+// base name and extension of src.
+func destFromTemplate(template string, src string) string {
+	ext := filepath.Ext(src)
+	name := strings.TrimSuffix(filepath.Base(src), ext)
+	return strings.NewReplacer("{name}", name, "{ext}", ext).Replace(template)
 }
 
-func getThumbName(name string, suffix string) string {
-	ext := filepath.Ext(name)
-	base := string(name[0 : len(name)-len(ext)])
-	return base + suffix + ext
+// startBatch processes every supported image in srcDir with the same options,
+// writing the results to dstDir under the same relative paths.
+func startBatch(srcDir string, dstDir string, options *imageproc.Options, config *ScriptConfig) {
+	if err := options.Validate(); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+
+	_, local := storage.(*localStorage)
+	config.skipExisting = local && !config.Overwrite
+
+	var processed, skipped int
+	var failed []string
+	var manifest Manifest
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != srcDir && !config.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !imageproc.IsSupportedInput(path) {
+			logging.Infof("Skipping unsupported file %s\n", path)
+			skipped++
+			return nil
+		}
+		if !config.matchesExtension(path) {
+			logging.Debugf("Skipping %s, its extension isn't selected\n", path)
+			skipped++
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dstDir, rel)
+		if config.skipExisting {
+			// names depending on the image are only known, and checked, once processed
+			if outputs, ok := imageproc.OutputNames(dest, options); ok && allExist(outputs) {
+				logging.Infof("Skipping %s, its outputs already exist\n", path)
+				skipped++
+				return nil
+			}
+		}
+		if !config.DryRun {
+			if err := os.MkdirAll(filepath.Dir(dest), dirMode); err != nil {
+				return err
+			}
+		}
+
+		response, err := processFile(path, dest, options, config)
+		if errors.Is(err, errOutputsExist) {
+			logging.Infof("Skipping %s, its outputs already exist\n", path)
+			skipped++
+			return nil
+		} else if err != nil {
+			logging.Errorf("%s", err)
+			failed = append(failed, path)
+			return nil
+		}
+		processed++
+		manifest.add(path, options, response)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to walk %s: %v", srcDir, err)
+	}
+	// the succeeded images are listed even when others failed
+	writeManifest(&manifest, config)
+	logging.Infof("Processed %d file(s), skipped %d, failed %d\n", processed, skipped, len(failed))
+	if len(failed) > 0 {
+		log.Fatalf("Failed to process %d file(s): %s", len(failed), strings.Join(failed, ", "))
+	}
 }
 
-func rotate(img *image.Image, deg float64, fill string) *image.Image {
-	if deg == 0 {
-		return img
+// startContactSheet composes the supported images of srcDir, in name order,
+// into one contact sheet saved to dest.
+func startContactSheet(srcDir string, dest string, sheet *imageproc.ContactSheet, options *imageproc.Options, config *ScriptConfig) {
+	if err := options.Validate(); err != nil {
+		log.Fatalf("Invalid options: %v", err)
+	}
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", srcDir, err)
+	}
+
+	var images []image.Image
+	for _, e := range entries {
+		path := filepath.Join(srcDir, e.Name())
+		if e.IsDir() || !imageproc.IsSupportedInput(path) {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			logging.Errorf("Skipping %s: %v", path, err)
+			continue
+		}
+		source, err := imageproc.Decode(f, options)
+		f.Close()
+		if err != nil {
+			logging.Errorf("Skipping %s: %v", path, err)
+			continue
+		}
+		images = append(images, source.Image)
+	}
+
+	result, err := sheet.Compose(images)
+	if err != nil {
+		log.Fatalf("Failed to compose the contact sheet: %v", err)
+	}
+	img := imageproc.ProcessedImage{Name: dest, Image: result}
+	size := result.Bounds().Size()
+	if config.DryRun {
+		logging.Infof("Would save contact sheet %s: %dx%d of %d images\n", dest, size.X, size.Y, len(images))
+		return
 	}
-	fill = strings.ToLower(fill)
-	var c color.Color = color.Transparent
-	if strings.Compare(fill, "black") == 0 || strings.Compare(fill, "b") == 0 {
-		c = color.Black
-	} else if strings.Compare(fill, "white") == 0 || strings.Compare(fill, "w") == 0 {
-		c = color.White
+	logging.Infof("Saving contact sheet %s: %dx%d of %d images\n", dest, size.X, size.Y, len(images))
+	if _, _, err := storage.Save(dest, &img, options); err != nil {
+		log.Fatalf("Failed to save contact sheet %s: %v", dest, err)
 	}
-	log.Printf("Rotating %f degrees. Fill color: %s\n", deg, c)
-	var result image.Image = imaging.Rotate(*img, deg, c)
-	return &result
 }
 
-func crop(img *image.Image, crop *Crop) *image.Image {
-	if !crop.shouldCrop(img) {
-		return img
+// processFile processes and saves the image at src, returning its outputs.
+func processFile(src string, dest string, options *imageproc.Options, config *ScriptConfig) (*APIResponse, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", src, err)
+	}
+	source, err := imageproc.Decode(f, options)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", src, err)
+	}
+	if source.Date.IsZero() {
+		// without EXIF the {date:layout} fallback is the modification time
+		if info, err := os.Stat(src); err == nil {
+			source.Date = info.ModTime()
+		}
 	}
 
-	var (
-		w = crop.X + crop.Width
-		h = crop.Y + crop.Height
-	)
+	result, err := source.Process(dest, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process image %s: %v", src, err)
+	}
+	if config.skipExisting {
+		names := make([]string, len(result))
+		for i, r := range result {
+			names[i] = r.Name
+		}
+		if allExist(names) {
+			return nil, errOutputsExist
+		}
+	}
+
+	response := &APIResponse{}
+	for i, r := range result {
+		size := r.Image.Bounds().Size()
+		info := ImageInfo{Path: filepath.ToSlash(r.Name), Width: size.X, Height: size.Y}
+		primary := i == 0 && !options.SkipPrimary
+
+		if config.DryRun {
+			var counter byteCounter
+			if _, err = imageproc.Encode(&counter, &r, options); err != nil {
+				return nil, fmt.Errorf("failed to encode image %s: %v", r.Name, err)
+			}
+			logging.Infof("Would save image %s: %dx%d, %d bytes\n", r.Name, size.X, size.Y, counter)
+			info.Bytes = int64(counter)
+			response.add(info, primary)
+			continue
+		}
+
+		if dest == stdoutDest {
+			if _, err = imageproc.Encode(os.Stdout, &r, options); err != nil {
+				return nil, fmt.Errorf("failed to write image to stdout: %v", err)
+			}
+			continue
+		}
+
+		saveAs := r.Name
+		if config.Dedupe {
+			// saving truncates the file in place, which would also change the
+			// outputs linked to it by an earlier run, so the image is saved next
+			// to it and renamed over it once written
+			saveAs = r.Name + ".tmp"
+		}
+		logging.Infof("Saving image %s\n", r.Name)
+		location, written, err := storage.Save(saveAs, &r, options)
+		if err == nil && saveAs != r.Name {
+			if err = os.Rename(saveAs, r.Name); err != nil {
+				os.Remove(saveAs)
+			}
+			location = storage.Location(r.Name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to save image %s: %v", r.Name, err)
+		}
+		if config.Dedupe {
+			if err := config.dedupeOutput(r.Name); err != nil {
+				return nil, fmt.Errorf("failed to dedupe image %s: %v", r.Name, err)
+			}
+		}
+		info.Path = filepath.ToSlash(location)
+		info.Bytes = written
+		response.add(info, primary)
+	}
+	if err := response.describe(result, options); err != nil {
+		return nil, fmt.Errorf("failed to describe image %s: %v", src, err)
+	}
+	return response, nil
+}
 
-	log.Printf("Cropping: x = %d, y = %d, w = %d, h = %d.\n", crop.X, crop.Y, w, h)
-	var result image.Image = imaging.Crop(*img, image.Rect(crop.X, crop.Y, w, h))
-	return &result
+type APIResponse struct {
+	Formatted  string   `json:"formatted,omitempty"`
+	Original   string   `json:"original,omitempty"`
+	Thumbnails []string `json:"thumbnails,omitempty"`
+	// FormattedImage and ThumbnailImages describe the same files as Formatted
+	// and Thumbnails, which are kept for backward compatibility
+	FormattedImage  *ImageInfo  `json:"formattedImage,omitempty"`
+	ThumbnailImages []ImageInfo `json:"thumbnailImages,omitempty"`
+	// Blurhash is the placeholder of the first image, with Options.Blurhash
+	Blurhash string `json:"blurhash,omitempty"`
+	// PHash is the perceptual hash of the first image as 16 hex digits, with
+	// Options.PHash. Near-duplicates differ in few bits
+	PHash string `json:"phash,omitempty"`
+	// Colors are the dominant colors of the first image as #rrggbb, the most
+	// frequent first, with Options.ExtractColors
+	Colors []string `json:"colors,omitempty"`
 }
 
-func resize(img *image.Image, w int, h int) *image.Image {
-	if w <= 0 && h <= 0 {
-		return img
+// describe adds what the options request about the images, computed from the
+// first one, to the response.
+func (r *APIResponse) describe(result []imageproc.ProcessedImage, options *imageproc.Options) error {
+	if len(result) == 0 {
+		return nil
+	}
+	if options.Blurhash {
+		hash, err := imageproc.Blurhash(result[0].Image)
+		if err != nil {
+			return err
+		}
+		r.Blurhash = hash
+	}
+	if options.PHash {
+		r.PHash = fmt.Sprintf("%016x", imageproc.PHash(result[0].Image))
 	}
-	if w == 0 {
-		w = h
-	} else if h == 0 {
-		h = w
+	for _, c := range imageproc.DominantColors(result[0].Image, options.ExtractColors) {
+		r.Colors = append(r.Colors, fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))
 	}
-	size := (*img).Bounds().Size()
-	if size.X == w && size.Y == h {
-		return img
+	return nil
+}
+
+// add lists a saved image as the formatted image or as a thumbnail.
+func (r *APIResponse) add(info ImageInfo, primary bool) {
+	if primary {
+		r.Formatted = info.Path
+		r.FormattedImage = &info
+	} else {
+		r.Thumbnails = append(r.Thumbnails, info.Path)
+		r.ThumbnailImages = append(r.ThumbnailImages, info)
 	}
-	log.Printf("Resizing: w = %d, h = %d.\n", w, h)
-	var result image.Image = imaging.Resize(*img, w, h, imaging.Lanczos)
-	return &result
+}
+
+type ImageInfo struct {
+	Path   string `json:"path"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// BatchResponse is returned when several files are uploaded at once.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+type BatchResult struct {
+	Name   string    `json:"name"`
+	Status int       `json:"status"`
+	Error  *APIError `json:"error,omitempty"`
+	*APIResponse
 }
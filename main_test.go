@@ -0,0 +1,2244 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+	"github.com/disintegration/imaging"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// testJPEG returns a w x h JPEG carrying the EXIF orientation.
+func testJPEG(t *testing.T, w, h int, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.New(w, h, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	// a big endian TIFF header followed by an IFD of the orientation only
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(exif[24:], orientation)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(segment, exif...)...), data[2:]...)
+}
+
+func TestScriptAppliesTheOrientation(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.jpg")
+	if err := os.WriteFile(src, testJPEG(t, 40, 20, 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+	autoOrient := false
+	for _, tt := range []struct {
+		options imageproc.Options
+		want    image.Point
+	}{
+		{imageproc.Options{}, image.Pt(20, 40)},
+		{imageproc.Options{AutoOrient: &autoOrient}, image.Pt(40, 20)},
+	} {
+		dst := filepath.Join(dir, "out.jpg")
+		startScript(src, dst, &tt.options, &ScriptConfig{})
+		img, err := imaging.Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != tt.want {
+			t.Errorf("auto-orient %v: got %v, want %v", tt.options.ShouldAutoOrient(), got, tt.want)
+		}
+	}
+}
+
+// testImage returns a w x h image, opaque blue.
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{0, 0, 255, 255})
+	}
+	return img
+}
+
+// testPNG returns a w x h image encoded as PNG.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// upload is a file of a multipart request.
+type upload struct {
+	name string
+	data []byte
+}
+
+// postMultipart sends a multipart /format style request with the fields and
+// the files, as image parts, to handler.
+func postMultipart(t *testing.T, handler http.HandlerFunc, target string, fields map[string]string, files ...upload) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for _, f := range files {
+		fw, err := mw.CreateFormFile("image", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestInlineResponse(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 40, 20)
+
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format?inline=true",
+		map[string]string{"name": "photo.png", "options": `{"resize": {"width": 20}}`}, upload{"photo.png", data})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("content type %q, want image/png", ct)
+	}
+	if cfg, err := png.DecodeConfig(w.Body); err != nil || cfg.Width != 20 || cfg.Height != 10 {
+		t.Errorf("got %+v (%v), want a 20x10 png", cfg, err)
+	}
+
+	// the thumbnails are parts of a multipart response
+	w = postMultipart(t, handleFormatRequest(1<<20), "/format?inline=true",
+		map[string]string{"name": "photo.png", "options": `{"thumbnails": [{"suffix": "-small", "width": 10}]}`}, upload{"photo.png", data})
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q, want multipart/mixed", w.Header().Get("Content-Type"))
+	}
+	var files []string
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		files = append(files, part.FileName())
+	}
+	if strings.Join(files, " ") != "photo.png photo-small.png" {
+		t.Errorf("got the parts %v, want photo.png and photo-small.png", files)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("inline responses saved %d files", len(entries))
+	}
+}
+
+func TestFormatRejectsCropsOutOfBounds(t *testing.T) {
+	useLocalStorage(t)
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format",
+		map[string]string{"name": "photo.png", "options": `{"crop": {"x": 150, "width": 100, "height": 50}}`}, upload{"photo.png", testPNG(t, 200, 100)})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "crop.x + crop.width") {
+		t.Errorf("got %q, want an error naming the crop width", w.Body)
+	}
+}
+
+func TestFormatRejectsTemplatesLeavingTheRoot(t *testing.T) {
+	root := useLocalStorage(t)
+	for _, options := range []string{
+		`{"nameTemplate": "../../{base}{suffix}{ext}", "thumbnails": [{"width": 10}]}`,
+		`{"thumbnails": [{"width": 10, "nameTemplate": "/tmp/{base}{ext}"}]}`,
+		`{"thumbnails": [{"width": 10, "suffix": "/../../x"}]}`,
+	} {
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format",
+			map[string]string{"name": "photo.png", "options": options}, upload{"photo.png", testPNG(t, 20, 20)})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", options, w.Code, w.Body)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("wrote %d files, want none", len(entries))
+	}
+}
+
+// writeFiles writes the files, by name, to dir.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBatchProcessesTheDirectory(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string][]byte{
+		"a.png":     testPNG(t, 40, 20),
+		"b.png":     testPNG(t, 20, 40),
+		"notes.txt": []byte("not an image"),
+	})
+	startBatch(srcDir, dstDir, &imageproc.Options{Resize: imageproc.Resize{Width: 10}}, &ScriptConfig{})
+
+	for name, height := range map[string]int{"a.png": 5, "b.png": 20} {
+		f, err := os.Open(filepath.Join(dstDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := png.DecodeConfig(f)
+		f.Close()
+		if err != nil || cfg.Width != 10 || cfg.Height != height {
+			t.Errorf("%s is %dx%d (%v), want 10x%d", name, cfg.Width, cfg.Height, err, height)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "notes.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the unsupported notes.txt was written: %v", err)
+	}
+}
+
+func TestScriptExpandsGlobs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"a.png":     testPNG(t, 8, 8),
+		"b.png":     testPNG(t, 8, 8),
+		"notes.txt": []byte("not an image"),
+	})
+	startScript(filepath.Join(dir, "*.png"), filepath.Join(dir, "out", "{name}.jpg"), &imageproc.Options{}, &ScriptConfig{})
+
+	entries, err := os.ReadDir(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	for _, e := range entries {
+		written = append(written, e.Name())
+	}
+	if strings.Join(written, " ") != "a.jpg b.jpg" {
+		t.Errorf("wrote %v, want a.jpg and b.jpg", written)
+	}
+}
+
+func TestDestFromTemplate(t *testing.T) {
+	for template, want := range map[string]string{
+		"out/{name}.jpg":        "out/photo.jpg",
+		"out/{name}-small{ext}": "out/photo-small.png",
+		"out/fixed.jpg":         "out/fixed.jpg",
+	} {
+		if got := destFromTemplate(template, "in/photo.png"); got != want {
+			t.Errorf("destFromTemplate(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+// allowPrivate lets fetchImage reach the loopback test servers.
+func allowPrivate(t *testing.T) {
+	allowPrivateURLs = true
+	t.Cleanup(func() { allowPrivateURLs = false })
+}
+
+func TestFormatFetchesTheURL(t *testing.T) {
+	allowPrivate(t)
+	data := testPNG(t, 40, 20)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/photo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	})
+	mux.HandleFunc("/notes.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("not an image"))
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 3<<20))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	useLocalStorage(t)
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format",
+		map[string]string{"url": server.URL + "/photo.png?v=1", "options": `{"resize": {"width": 20}}`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// named after the url without a name field
+	response := decodeResponse(t, w)
+	if !strings.HasSuffix(response.Formatted, "-photo.png") {
+		t.Errorf("saved %s, want a photo.png", response.Formatted)
+	}
+	img, err := imaging.Open(response.Formatted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(20, 10) {
+		t.Errorf("saved %v, want 20x10", size)
+	}
+
+	// a failing upstream is a bad gateway, an unusable response a bad request
+	for target, want := range map[string]int{
+		"/missing.png": http.StatusBadGateway,
+		"/notes.txt":   http.StatusBadRequest,
+		"/large.png":   http.StatusBadRequest,
+	} {
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"url": server.URL + target, "options": "{}"})
+		if w.Code != want {
+			t.Errorf("fetching %s: status %d, want %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := isPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestFetchImageRejectsPrivateAddresses(t *testing.T) {
+	data := testPNG(t, 4, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// a literal address and a host name resolving to loopback
+	for _, imageURL := range []string{server.URL, "http://localhost:" + port + "/"} {
+		_, fail := fetchImage(imageURL, 1<<20)
+		if fail == nil || fail.Status != http.StatusBadRequest || fail.Err.Code != "invalid_url" {
+			t.Errorf("fetching %s: got %+v, want an invalid_url failure", imageURL, fail)
+		}
+	}
+	if _, fail := fetchImage("file:///etc/passwd", 1<<20); fail == nil {
+		t.Error("fetching a file url succeeded")
+	}
+
+	allowPrivate(t)
+	if got, fail := fetchImage(server.URL, 1<<20); fail != nil || !bytes.Equal(got, data) {
+		t.Errorf("fetching %s with private urls allowed: %+v", server.URL, fail)
+	}
+}
+
+func TestFetchImageChecksRedirects(t *testing.T) {
+	allowPrivate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scheme", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, target := range []string{"/scheme", "/loop"} {
+		if _, fail := fetchImage(server.URL+target, 1<<20); fail == nil {
+			t.Errorf("fetching %s succeeded, want a failure", target)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for size, want := range map[string]int64{
+		"1024":  1024,
+		"512KB": 512 << 10,
+		"10mb":  10 << 20,
+		"1 GB":  1 << 30,
+		"20B":   20,
+	} {
+		if got, err := parseByteSize(size); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", size, got, err, want)
+		}
+	}
+	for _, size := range []string{"", "0", "-1MB", "10TB", "MB"} {
+		if _, err := parseByteSize(size); err == nil {
+			t.Errorf("parseByteSize(%q) didn't fail", size)
+		}
+	}
+}
+
+func TestFormatRejectsLargeUploads(t *testing.T) {
+	useLocalStorage(t)
+	large := upload{"large.png", bytes.Repeat([]byte{1}, 4096)}
+	w := postMultipart(t, handleFormatRequest(1024), "/format", nil, large)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413: %s", w.Code, w.Body)
+	}
+}
+
+// decodeStatus decodes the JSON body of the health endpoints.
+func decodeStatus(t *testing.T, w *httptest.ResponseRecorder) StatusResponse {
+	t.Helper()
+	var status StatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decoding the status %q: %s", w.Body.String(), err)
+	}
+	return status
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	root := useLocalStorage(t)
+	for _, target := range []string{"/healthz", "/readyz"} {
+		w := serve(t, http.MethodGet, target)
+		if status := decodeStatus(t, w); w.Code != http.StatusOK || status.Status != "ok" {
+			t.Errorf("%s: status %d, %+v", target, w.Code, status)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("the readiness check left %d files in the root", len(entries))
+	}
+
+	storage = &localStorage{root: filepath.Join(root, "missing")}
+	w := serve(t, http.MethodGet, "/readyz")
+	if status := decodeStatus(t, w); w.Code != http.StatusServiceUnavailable || status.Status != "unavailable" || status.Error == "" {
+		t.Errorf("without a root dir: status %d, %+v", w.Code, status)
+	}
+}
+
+// exifMarker starts the EXIF APP1 segment of a JPEG.
+var exifMarker = []byte("Exif\x00\x00")
+
+// testEXIFJPEG returns a w x h JPEG with an, empty, EXIF segment.
+func testEXIFJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	// a big endian TIFF header followed by an empty IFD
+	exif := append(append([]byte{}, exifMarker...), "MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00"...)
+	segment := []byte{0xff, 0xe1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(segment, exif...)...), data[2:]...)
+}
+
+// decodeResponse decodes the JSON body of a successful /format response.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) APIResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestStripMetadata(t *testing.T) {
+	useLocalStorage(t)
+	data := testEXIFJPEG(t, 20, 10)
+	for _, strip := range []bool{false, true} {
+		options := fmt.Sprintf(`{"saveOriginal": true, "stripMetadata": %v}`, strip)
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format",
+			map[string]string{"name": "photo.jpg", "options": options}, upload{"photo.jpg", data})
+		response := decodeResponse(t, w)
+		original, err := os.ReadFile(response.Original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(original, exifMarker); got == strip {
+			t.Errorf("stripMetadata %v: the original carries EXIF: %v", strip, got)
+		}
+		formatted, err := os.ReadFile(response.Formatted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(formatted, exifMarker) {
+			t.Errorf("stripMetadata %v: the formatted image carries EXIF", strip)
+		}
+	}
+}
+
+func TestFormatRejectsNegativeSigmas(t *testing.T) {
+	useLocalStorage(t)
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format",
+		map[string]string{"name": "photo.png", "options": `{"blur": -1}`}, upload{"photo.png", testPNG(t, 8, 8)})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "blur") {
+		t.Errorf("got %q, want an error naming blur", w.Body)
+	}
+}
+
+// decodeAPIError decodes the JSON error body of a failed request.
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	var apiErr APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+		t.Fatalf("decoding the error %q: %s", w.Body.String(), err)
+	}
+	return apiErr
+}
+
+func TestFormatErrors(t *testing.T) {
+	root := useLocalStorage(t)
+	data := upload{"photo.png", testPNG(t, 8, 8)}
+	for _, tt := range []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+		want   APIError
+	}{
+		{"invalid options", postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"options": "{"}, data), http.StatusBadRequest, APIError{Code: "invalid_options", Field: "options"}},
+		{"no image", postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"options": "{}"}), http.StatusBadRequest, APIError{Code: "missing_image", Field: "image"}},
+		{"not an image", postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"options": "{}"}, upload{"notes.png", []byte("plain text")}), http.StatusUnsupportedMediaType, APIError{Code: "unsupported_media_type", Field: "image"}},
+		{"unwritable root", func() *httptest.ResponseRecorder {
+			storage = &localStorage{root: filepath.Join(root, "missing")}
+			return postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"name": "photo.png", "options": "{}"}, data)
+		}(), http.StatusInternalServerError, APIError{Code: "storage_error"}},
+	} {
+		if tt.w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, tt.w.Code, tt.status)
+		}
+		if ct := tt.w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q, want application/json", tt.name, ct)
+		}
+		got := decodeAPIError(t, tt.w)
+		if got.Code != tt.want.Code || got.Field != tt.want.Field || got.Message == "" {
+			t.Errorf("%s: got %+v, want the code %s and field %q", tt.name, got, tt.want.Code, tt.want.Field)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web-thumbnail.json")
+	writeFiles(t, dir, map[string][]byte{
+		"web-thumbnail.json": []byte(`{"quality": 80, "resize": {"width": 320}, "thumbnails": [{"suffix": "-s", "width": 50}]}`),
+		"broken.json":        []byte(`{"quality": `),
+	})
+
+	// flag defaults, as main sets them before loading the config
+	options := imageproc.Options{Fill: "black", Thumbnails: []imageproc.Thumb{{Suffix: "-default", Width: 100, Height: 100}}}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&options.Quality, "quality", 0, "")
+	if err := loadConfig(path, &options); err != nil {
+		t.Fatal(err)
+	}
+	// explicit flags are parsed again over the config
+	if err := fs.Parse([]string{"-quality", "60"}); err != nil {
+		t.Fatal(err)
+	}
+	if options.Quality != 60 || options.Resize.Width != 320 || options.Fill != "black" {
+		t.Errorf("got quality %d, width %d, fill %q, want 60, 320 and black", options.Quality, options.Resize.Width, options.Fill)
+	}
+	if len(options.Thumbnails) != 1 || options.Thumbnails[0] != (imageproc.Thumb{Suffix: "-s", Width: 50}) {
+		t.Errorf("got the thumbnails %+v, want only the configured one", options.Thumbnails)
+	}
+
+	for _, name := range []string{"broken.json", "missing.json"} {
+		if err := loadConfig(filepath.Join(dir, name), &imageproc.Options{}); err == nil {
+			t.Errorf("loading %s didn't fail", name)
+		}
+	}
+}
+
+func TestFormatMultipleUploads(t *testing.T) {
+	useLocalStorage(t)
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"options": "{}"},
+		upload{"a.png", testPNG(t, 8, 8)},
+		upload{"broken.png", []byte("\x89PNG\r\n\x1a\nbroken")},
+		upload{"b.png", testPNG(t, 8, 8)},
+	)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var batch BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Results) != 3 {
+		t.Fatalf("got %d results, want 3: %s", len(batch.Results), w.Body)
+	}
+	for i, want := range []struct {
+		name   string
+		status int
+	}{{"a.png", http.StatusOK}, {"broken.png", http.StatusBadRequest}, {"b.png", http.StatusOK}} {
+		result := batch.Results[i]
+		if result.Name != want.name || result.Status != want.status {
+			t.Errorf("result %d is %s with status %d, want %s with %d", i, result.Name, result.Status, want.name, want.status)
+		}
+		if ok := result.Status == http.StatusOK; ok != (result.APIResponse != nil) || ok == (result.Error != nil) {
+			t.Errorf("%s: got the response %+v and the error %+v", result.Name, result.APIResponse, result.Error)
+		}
+	}
+}
+
+// callWithName calls the handler of an /image/{name} route for name.
+func callWithName(handler http.HandlerFunc, method string, name string) *httptest.ResponseRecorder {
+	r := mux.SetURLVars(httptest.NewRequest(method, "/image/x", nil), map[string]string{"name": name})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestServeImage(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 8, 8)
+	writeFiles(t, root, map[string][]byte{"photo.png": data})
+	writeFiles(t, filepath.Dir(root), map[string][]byte{"secret.png": data})
+
+	w := callWithName(handleServeImage, http.MethodGet, "photo.png")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("status %d, %d bytes, want the %d bytes of photo.png", w.Code, w.Body.Len(), len(data))
+	}
+	if ct, cc := w.Header().Get("Content-Type"), w.Header().Get("Cache-Control"); ct != "image/png" || cc == "" {
+		t.Errorf("content type %q, cache control %q", ct, cc)
+	}
+
+	for _, name := range []string{"../secret.png", `..\secret.png`, "sub/photo.png", "/etc/passwd", ""} {
+		if w := callWithName(handleServeImage, http.MethodGet, name); w.Code != http.StatusBadRequest {
+			t.Errorf("serving %q: status %d, want 400", name, w.Code)
+		}
+	}
+	if w := callWithName(handleServeImage, http.MethodGet, "missing.png"); w.Code != http.StatusNotFound {
+		t.Errorf("serving missing.png: status %d, want 404", w.Code)
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	root := useLocalStorage(t)
+	handler := handleDeleteImage
+	data := testPNG(t, 8, 8)
+	writeFiles(t, root, map[string][]byte{
+		"photo.png":          data,
+		"photo-small.png":    data,
+		"photo-original.jpg": data,
+		"photo-small.jpg":    data,
+		"other.png":          data,
+	})
+
+	if w := callWithName(handler, http.MethodDelete, "other.png"); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting other.png: status %d: %s", w.Code, w.Body)
+	}
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/image/photo.png?thumbnails=true", nil), map[string]string{"name": "photo.png"})
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting photo.png: status %d: %s", w.Code, w.Body)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 || entries[0].Name() != "photo-small.jpg" {
+		t.Errorf("left %v, want only photo-small.jpg, of another format", entries)
+	}
+
+	if w := callWithName(handler, http.MethodDelete, "photo.png"); w.Code != http.StatusNotFound {
+		t.Errorf("deleting the deleted photo.png: status %d, want 404", w.Code)
+	}
+	if w := callWithName(handler, http.MethodDelete, "../photo-small.jpg"); w.Code != http.StatusBadRequest {
+		t.Errorf("deleting ../photo-small.jpg: status %d, want 400", w.Code)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tt := range []struct {
+		target, auth string
+		status       int
+	}{
+		{"/format", "", http.StatusUnauthorized},
+		{"/format", "Bearer wrong", http.StatusUnauthorized},
+		{"/format", "s3cret", http.StatusUnauthorized},
+		{"/format", "Bearer s3cret", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s with %q: status %d, want %d", tt.target, tt.auth, w.Code, tt.status)
+		}
+		if w.Code == http.StatusUnauthorized && (w.Header().Get("WWW-Authenticate") != "Bearer" || decodeAPIError(t, w).Code != "unauthorized") {
+			t.Errorf("%s with %q: got the headers %v and %s", tt.target, tt.auth, w.Header(), w.Body)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	useLocalStorage(t)
+	metrics = newAPIMetrics()
+	t.Cleanup(func() { metrics = nil })
+	handler := metrics.instrument(handleFormatRequest(1 << 20)).ServeHTTP
+
+	fields := map[string]string{"name": "photo.png", "options": `{"thumbnails": [{"suffix": "-small", "width": 4}]}`}
+	for i := 0; i < 2; i++ {
+		if w := postMultipart(t, handler, "/format", fields, upload{"photo.png", testPNG(t, 8, 8)}); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	postMultipart(t, handler, "/format", fields)
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`image_format_requests_total{outcome="success"} 2`,
+		`image_format_requests_total{outcome="client_error"} 1`,
+		`image_api_errors_total{code="missing_image"} 1`,
+		"image_processed_images_total 4",
+		"image_processing_duration_seconds_count 2",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the metrics lack %s:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestResponseDescribesTheImages(t *testing.T) {
+	useLocalStorage(t)
+	fields := map[string]string{"name": "photo.png", "options": `{"resize": {"width": 30}, "thumbnails": [{"suffix": "-small", "width": 10}]}`}
+	response := decodeResponse(t, postMultipart(t, handleFormatRequest(1<<20), "/format", fields, upload{"photo.png", testPNG(t, 60, 40)}))
+	if response.FormattedImage == nil || len(response.ThumbnailImages) != 1 {
+		t.Fatalf("got %+v, want the formatted image and a thumbnail", response)
+	}
+	if response.FormattedImage.Path != response.Formatted || response.ThumbnailImages[0].Path != response.Thumbnails[0] {
+		t.Errorf("the paths %+v don't match the formatted %s and thumbnails %v", response, response.Formatted, response.Thumbnails)
+	}
+	for _, info := range []ImageInfo{*response.FormattedImage, response.ThumbnailImages[0]} {
+		data, err := os.ReadFile(info.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Width != cfg.Width || info.Height != cfg.Height || info.Bytes != int64(len(data)) {
+			t.Errorf("%s is described as %dx%d of %d bytes, want %dx%d of %d", info.Path, info.Width, info.Height, info.Bytes, cfg.Width, cfg.Height, len(data))
+		}
+	}
+}
+
+func TestFormatRejectsNonImages(t *testing.T) {
+	root := useLocalStorage(t)
+	for _, data := range [][]byte{[]byte("just some text"), []byte("<html><body>hi</body></html>"), []byte("%PDF-1.4")} {
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"options": "{}"}, upload{"photo.jpg", data})
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: status %d, want 415", data, w.Code)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("the rejected uploads left %d files in the root", len(entries))
+	}
+}
+
+func TestFormatSavesTheOriginalOnRequest(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 8, 8)
+	for _, save := range []bool{false, true} {
+		fields := map[string]string{"name": "photo.png", "options": fmt.Sprintf(`{"saveOriginal": %v}`, save)}
+		response := decodeResponse(t, postMultipart(t, handleFormatRequest(1<<20), "/format", fields, upload{"photo.png", data}))
+		originals, _ := filepath.Glob(filepath.Join(root, "*-original.png"))
+		if want := map[bool]int{false: 0, true: 1}[save]; len(originals) != want || (response.Original != "") != save {
+			t.Errorf("saveOriginal %v: got the originals %v and %q in the response", save, originals, response.Original)
+		}
+	}
+}
+
+// freePort returns a port nothing listens on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// waitHealthy polls the health check of the Web API at base until it answers.
+func waitHealthy(t *testing.T, base string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(base + "/healthz"); err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the Web API at %s didn't start", base)
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	port := freePort(t)
+	stopped := make(chan struct{})
+	go func() {
+		startAPI(&APIConfig{Root: t.TempDir(), Port: port, MaxUpload: 1 << 20, ShutdownTimeout: 5 * time.Second})
+		close(stopped)
+	}()
+	base := "http://127.0.0.1:" + port
+	waitHealthy(t, base)
+
+	// the upload is still being sent when the server is told to stop
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("options", "{}")
+	fw, err := mw.CreateFormFile("image", "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(testPNG(t, 8, 8))
+	mw.Close()
+	body := buf.Bytes()
+	pr, pw := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(base+"/format", mw.FormDataContentType(), pr)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	pw.Write(body[:10])
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	time.Sleep(50 * time.Millisecond)
+	pw.Write(body[10:])
+	pw.Close()
+
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("the in-flight request got %+v, want 200", resp)
+	} else {
+		resp.Body.Close()
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Web API didn't stop")
+	}
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Error("the Web API still accepts requests after the shutdown")
+	}
+}
+
+func TestReadTimeoutClosesSlowConnections(t *testing.T) {
+	port := freePort(t)
+	stopped := make(chan struct{})
+	go func() {
+		startAPI(&APIConfig{Root: t.TempDir(), Port: port, MaxUpload: 1 << 20, ReadTimeout: 200 * time.Millisecond, WriteTimeout: time.Second, IdleTimeout: time.Second, ShutdownTimeout: time.Second})
+		close(stopped)
+	}()
+	defer func() {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		<-stopped
+	}()
+	waitHealthy(t, "http://127.0.0.1:"+port)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a client stalling in the middle of its upload
+	fmt.Fprintf(conn, "POST /format HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=x\r\nContent-Length: 1000\r\n\r\n--x\r\n")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the connection was kept open for %s, want it closed after the read timeout", elapsed)
+	}
+}
+
+func TestDryRunWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"in/photo.png": testPNG(t, 40, 20), "in/other.png": testPNG(t, 20, 20)})
+	options := imageproc.Options{Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}}}
+	config := ScriptConfig{DryRun: true}
+
+	startScript(filepath.Join(dir, "in", "photo.png"), filepath.Join(dir, "out", "photo.jpg"), &options, &config)
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "batch"), &options, &config)
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "in" {
+		t.Errorf("the dry run wrote %v, want only the sources", entries)
+	}
+}
+
+// postJSON sends a JSON /format style request for the image to handler.
+func postJSON(t *testing.T, handler http.HandlerFunc, target string, name string, data []byte, options imageproc.Options) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(JSONFormatRequest{Name: name, Image: base64.StdEncoding.EncodeToString(data), Options: options})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// postBody sends body with the content type to handler.
+func postBody(handler http.HandlerFunc, target string, contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestFormatJSONRequests(t *testing.T) {
+	useLocalStorage(t)
+	response := decodeResponse(t, postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{Resize: imageproc.Resize{Width: 20}}))
+	if response.FormattedImage == nil || response.FormattedImage.Width != 20 || !strings.HasSuffix(response.Formatted, "-photo.png") {
+		t.Errorf("got %+v, want a 20 pixels wide photo.png", response.FormattedImage)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want APIError
+	}{
+		{`{"name": "photo.png", "image": "not base64!"}`, APIError{Code: "invalid_image", Field: "image"}},
+		{`{"name": "photo.png"}`, APIError{Code: "missing_image", Field: "image"}},
+		{`{"name": "photo.png", "image": "iVBORw0K", "options": {"quality": 500}}`, APIError{Code: "invalid_options", Field: "options"}},
+		{`{"name": `, APIError{Code: "invalid_request"}},
+	} {
+		w := postBody(handleFormatRequest(1<<20), "/format", "application/json; charset=utf-8", tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.body, w.Code)
+		}
+		if got := decodeAPIError(t, w); got.Code != tt.want.Code || got.Field != tt.want.Field {
+			t.Errorf("%s: got %+v, want the code %s and field %q", tt.body, got, tt.want.Code, tt.want.Field)
+		}
+	}
+}
+
+// listImages decodes the listing of GET target served by handler.
+func listImages(t *testing.T, handler http.HandlerFunc, target string) ImageList {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, w.Code, w.Body)
+	}
+	var list ImageList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestListImages(t *testing.T) {
+	root := useLocalStorage(t)
+	handler := handleListImages
+	writeFiles(t, root, map[string][]byte{
+		"a.png":           []byte("a"),
+		"b.png":           []byte("bb"),
+		"b-small.png":     []byte("b"),
+		"c.jpg":           []byte("ccc"),
+		"sub/ignored.png": []byte("sub"),
+	})
+
+	for _, tt := range []struct {
+		target string
+		want   string
+		total  int
+	}{
+		{"/images", "a.png b-small.png b.png c.jpg", 4},
+		{"/images?prefix=b", "b-small.png b.png", 2},
+		{"/images?limit=2", "a.png b-small.png", 4},
+		{"/images?limit=2&offset=3", "c.jpg", 4},
+		{"/images?offset=10", "", 4},
+	} {
+		list := listImages(t, handler, tt.target)
+		var got []string
+		for _, img := range list.Images {
+			got = append(got, img.Name)
+		}
+		if strings.Join(got, " ") != tt.want || list.Total != tt.total {
+			t.Errorf("%s: listed %v of %d, want %s of %d", tt.target, got, list.Total, tt.want, tt.total)
+		}
+	}
+	if list := listImages(t, handler, "/images?prefix=c"); list.Images[0].Bytes != 3 || list.Images[0].Modified.IsZero() {
+		t.Errorf("c.jpg is described as %+v", list.Images[0])
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/images?limit=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a negative limit: status %d, want 400", w.Code)
+	}
+}
+
+// failSaves makes the first failures saves fail with err, counting every attempt.
+func failSaves(t *testing.T, failures int, err error) *int {
+	t.Helper()
+	attempts := 0
+	previous, previousRetry := saveImage, saveRetry
+	saveImage = func(path string, img *imageproc.ProcessedImage, options *imageproc.Options) error {
+		attempts++
+		if attempts <= failures {
+			return &fs.PathError{Op: "write", Path: path, Err: err}
+		}
+		return previous(path, img, options)
+	}
+	saveRetry = retryPolicy{Attempts: 3, Backoff: time.Millisecond, Timeout: time.Second}
+	t.Cleanup(func() { saveImage, saveRetry = previous, previousRetry })
+	return &attempts
+}
+
+// countSaves counts the images saved during the test.
+func countSaves(t *testing.T) *int {
+	t.Helper()
+	saves := 0
+	previous := saveImage
+	saveImage = func(path string, img *imageproc.ProcessedImage, options *imageproc.Options) error {
+		saves++
+		return previous(path, img, options)
+	}
+	t.Cleanup(func() { saveImage = previous })
+	return &saves
+}
+
+func TestSaveRetriesTransientErrors(t *testing.T) {
+	attempts := failSaves(t, 2, syscall.EIO)
+	path := filepath.Join(t.TempDir(), "out.png")
+	img := &imageproc.ProcessedImage{Name: "out.png", Image: testImage(4, 4)}
+	if err := saveWithRetry(path, img, &imageproc.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if *attempts != 3 {
+		t.Errorf("saved after %d attempts, want 3", *attempts)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveFailsPermanentErrors(t *testing.T) {
+	attempts := failSaves(t, 1, syscall.EACCES)
+	path := filepath.Join(t.TempDir(), "out.png")
+	img := &imageproc.ProcessedImage{Name: "out.png", Image: testImage(4, 4)}
+	if err := saveWithRetry(path, img, &imageproc.Options{}); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("got %v, want EACCES", err)
+	}
+	if *attempts != 1 {
+		t.Errorf("%d attempts, want 1", *attempts)
+	}
+}
+
+func TestSaveGivesUpAfterTimeout(t *testing.T) {
+	attempts := failSaves(t, 3, syscall.EAGAIN)
+	saveRetry = retryPolicy{Attempts: 5, Backoff: 50 * time.Millisecond, Timeout: 60 * time.Millisecond}
+	path := filepath.Join(t.TempDir(), "out.png")
+	img := &imageproc.ProcessedImage{Name: "out.png", Image: testImage(4, 4)}
+	if err := saveWithRetry(path, img, &imageproc.Options{}); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("got %v, want EAGAIN", err)
+	}
+	// 50ms fit into the timeout, the next 100ms don't
+	if *attempts != 2 {
+		t.Errorf("%d attempts, want 2", *attempts)
+	}
+}
+
+func TestSaveFailsEncodingErrors(t *testing.T) {
+	previous := saveRetry
+	saveRetry = retryPolicy{Attempts: 3, Backoff: time.Second}
+	t.Cleanup(func() { saveRetry = previous })
+	path := filepath.Join(t.TempDir(), "out.xyz")
+	img := &imageproc.ProcessedImage{Name: "out.xyz", Image: testImage(4, 4)}
+	start := time.Now()
+	if err := saveWithRetry(path, img, &imageproc.Options{}); err == nil {
+		t.Fatal("saving an unknown format didn't fail")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("the encoding error was retried for %s", elapsed)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the partial file was left behind: %v", err)
+	}
+}
+
+func TestFormatDataURIs(t *testing.T) {
+	useLocalStorage(t)
+	encoded := base64.StdEncoding.EncodeToString(testPNG(t, 20, 10))
+	options := func(uri string) map[string]string {
+		return map[string]string{"options": fmt.Sprintf(`{"imageData": %q, "resize": {"width": 10}}`, uri)}
+	}
+
+	response := decodeResponse(t, postMultipart(t, handleFormatRequest(1<<20), "/format", options("data:image/png;base64,"+encoded)))
+	if !strings.HasSuffix(response.Formatted, "-image.png") || response.FormattedImage.Width != 10 {
+		t.Errorf("got %+v, want a 10 pixels wide image.png", response.FormattedImage)
+	}
+
+	for _, uri := range []string{
+		"data:image/jpeg;base64," + encoded,
+		"data:image/png," + encoded,
+		"data:image/png;base64,not base64!",
+		"data:text/plain;base64,aGk=",
+		"image/png;base64," + encoded,
+	} {
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format", options(uri))
+		if apiErr := decodeAPIError(t, w); w.Code != http.StatusBadRequest || apiErr.Code != "invalid_image" || apiErr.Field != "imageData" {
+			t.Errorf("%.30s: status %d, %+v, want a 400 invalid_image of imageData", uri, w.Code, apiErr)
+		}
+	}
+}
+
+func TestConcurrentRequestsForTheSameName(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 40, 20)
+	const requests = 4
+	responses := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", data, imageproc.Options{SaveOriginal: true})
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, w := range responses {
+		response := decodeResponse(t, w)
+		for _, p := range []string{response.Formatted, response.Original} {
+			if seen[p] {
+				t.Errorf("%s was returned twice", p)
+			}
+			seen[p] = true
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 2*requests {
+		t.Errorf("the root holds %d files, want %d", len(entries), 2*requests)
+	}
+
+	// a failing request leaves nothing behind
+	root = useLocalStorage(t)
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", data, imageproc.Options{SaveOriginal: true, Crop: imageproc.Crop{X: 100, Width: 10, Height: 10}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", w.Code)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("the failed request left %v", entries)
+	}
+}
+
+func TestFormatRejectsNamesLeavingTheRoot(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 20, 10)
+	for _, w := range []*httptest.ResponseRecorder{
+		postMultipart(t, handleFormatRequest(1<<20), "/format", map[string]string{"name": "x/../../../nm.png"}, upload{"photo.png", data}),
+		postJSON(t, handleFormatRequest(1<<20), "/format", "../nm.png", data, imageproc.Options{}),
+	} {
+		if apiErr := decodeAPIError(t, w); w.Code != http.StatusBadRequest || apiErr.Code != "invalid_name" {
+			t.Errorf("status %d, %+v, want a 400 invalid_name", w.Code, apiErr)
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("the rejected requests left %v", entries)
+	}
+
+	// the file name of an upload is reduced to its base
+	w := postMultipart(t, handleFormatRequest(1<<20), "/format", nil, upload{"../../nm.png", data})
+	response := decodeResponse(t, w)
+	if filepath.Dir(response.Formatted) != root || !strings.HasSuffix(response.Formatted, "-nm.png") {
+		t.Errorf("formatted %s, want a file in %s", response.Formatted, root)
+	}
+}
+
+func TestFormatStatusOfDecodeAndSaveFailures(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 8, 8)
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", data[:len(data)/2], imageproc.Options{})
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusBadRequest || apiErr.Code != "invalid_image" {
+		t.Errorf("a truncated upload: status %d, %+v, want a 400 invalid_image", w.Code, apiErr)
+	}
+
+	// a root that isn't a directory fails every save
+	writeFiles(t, root, map[string][]byte{"file": nil})
+	storage = &localStorage{root: filepath.Join(root, "file")}
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", data, imageproc.Options{Thumbnails: []imageproc.Thumb{{Width: 4}}})
+	if apiErr := decodeAPIError(t, w); w.Code != http.StatusInternalServerError || apiErr.Code != "storage_error" {
+		t.Errorf("an unwritable root: status %d, %+v, want a 500 storage_error", w.Code, apiErr)
+	}
+}
+
+func TestFormatSkipPrimary(t *testing.T) {
+	root := useLocalStorage(t)
+	options := imageproc.Options{SkipPrimary: true, Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}}}
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), options)
+	if strings.Contains(w.Body.String(), `"formatted"`) {
+		t.Errorf("the response lists a formatted image: %s", w.Body)
+	}
+	response := decodeResponse(t, w)
+	if len(response.Thumbnails) != 1 || !strings.HasSuffix(response.Thumbnails[0], "-photo-small.png") {
+		t.Errorf("got the thumbnails %v, want photo-small.png", response.Thumbnails)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("wrote %v, want only the thumbnail", entries)
+	}
+
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{SkipPrimary: true})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("skipping the primary without thumbnails: status %d, want 400", w.Code)
+	}
+}
+
+func TestParseThumbs(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want []imageproc.Thumb
+	}{
+		{"", nil},
+		{"small:150x150", []imageproc.Thumb{{Suffix: "-small", Width: 150, Height: 150}}},
+		{"small:150x150, medium:400x,tall:x300", []imageproc.Thumb{
+			{Suffix: "-small", Width: 150, Height: 150},
+			{Suffix: "-medium", Width: 400},
+			{Suffix: "-tall", Height: 300},
+		}},
+	} {
+		thumbs, err := parseThumbs(tt.spec)
+		if err != nil {
+			t.Errorf("parseThumbs(%q): %s", tt.spec, err)
+			continue
+		}
+		if fmt.Sprint(thumbs) != fmt.Sprint(tt.want) {
+			t.Errorf("parseThumbs(%q) = %v, want %v", tt.spec, thumbs, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"small", "small:150", ":150x150", "small:ax150", "small:-1x150", "small:x", "small:150x150,medium"} {
+		if _, err := parseThumbs(spec); err == nil {
+			t.Errorf("parseThumbs(%q) accepted a malformed thumbnail", spec)
+		}
+	}
+}
+
+func TestScriptWritesToStdout(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.png")
+	writeFiles(t, dir, map[string][]byte{"photo.png": testPNG(t, 40, 20)})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	t.Cleanup(func() { os.Stdout = stdout })
+	written := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		written <- data
+	}()
+	startScript(src, stdoutDest, &imageproc.Options{Format: "jpeg", Resize: imageproc.Resize{Width: 20}}, &ScriptConfig{})
+	w.Close()
+	os.Stdout = stdout
+
+	img, err := jpeg.Decode(bytes.NewReader(<-written))
+	if err != nil {
+		t.Fatalf("decoding stdout: %s", err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(20, 10) {
+		t.Errorf("got %v, want 20x10", size)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("wrote %v next to the source", entries)
+	}
+}
+
+func TestFormatPreview(t *testing.T) {
+	options := imageproc.Options{
+		SkipPrimary: true,
+		Widths:      []int{320},
+		Thumbnails:  []imageproc.Thumb{{Width: 50, Height: 50}},
+	}
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"json":      postJSON(t, handlePreviewRequest(1<<20), "/format/preview", "wide.png", testPNG(t, 1000, 500), options),
+		"multipart": postMultipart(t, handlePreviewRequest(1<<20), "/format/preview", map[string]string{"options": `{"thumbnails": [{"width": 50}]}`}, upload{"wide.png", testPNG(t, 1000, 500)}),
+	} {
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", name, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Fatalf("%s: content type %q, want image/jpeg", name, ct)
+		}
+		cfg, format, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != "jpeg" || cfg.Width != previewSize || cfg.Height != previewSize/2 {
+			t.Errorf("%s: got a %dx%d %s, want the whole image as a %dx%d jpeg", name, cfg.Width, cfg.Height, format, previewSize, previewSize/2)
+		}
+	}
+}
+
+func TestScriptDateFallsBackToTheModificationTime(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "photo.png")
+	writeFiles(t, dir, map[string][]byte{"photo.png": testPNG(t, 40, 20)})
+	modified := time.Date(2020, 5, 6, 12, 0, 0, 0, time.Local)
+	if err := os.Chtimes(src, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	options := &imageproc.Options{Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10, NameTemplate: "{date:2006-01-02}_{base}{suffix}{ext}"}}}
+	startScript(src, filepath.Join(dir, "out.png"), options, &ScriptConfig{})
+	if _, err := os.Stat(filepath.Join(dir, "2020-05-06_out-small.png")); err != nil {
+		t.Errorf("the thumbnail isn't named after the modification time: %s", err)
+	}
+}
+
+func TestPrepareNestedRoot(t *testing.T) {
+	previous := dirMode
+	dirMode = 0o750
+	t.Cleanup(func() { dirMode = previous })
+	root := filepath.Join(t.TempDir(), "images", "formatted")
+
+	prepareRoot(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0o750 {
+		t.Errorf("created %v, want a 0750 directory", info.Mode())
+	}
+	// an existing root is kept
+	prepareRoot(root)
+
+	location, err := (&localStorage{root: root}).Put("photo.png", testPNG(t, 4, 4))
+	if err != nil {
+		t.Fatalf("writing into the root: %s", err)
+	}
+	if _, err := os.Stat(location); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestContactSheetOfADirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"a.png":      testPNG(t, 40, 20),
+		"b.png":      testPNG(t, 20, 40),
+		"c.png":      testPNG(t, 30, 30),
+		"d.png":      testPNG(t, 10, 10),
+		"notes.txt":  []byte("not an image"),
+		"sub/e.png":  testPNG(t, 10, 10),
+		"broken.png": []byte("not a png"),
+	})
+	dest := filepath.Join(t.TempDir(), "sheet.png")
+	sheet := &imageproc.ContactSheet{Columns: 2, CellWidth: 32, CellHeight: 32, Padding: 4}
+	startContactSheet(dir, dest, sheet, &imageproc.Options{}, &ScriptConfig{})
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 4 images of the directory in 2x2 cells
+	if config.Width != 76 || config.Height != 76 {
+		t.Errorf("got %dx%d, want 76x76", config.Width, config.Height)
+	}
+}
+
+func TestBatchManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"in/a.png": testPNG(t, 40, 20), "in/b.png": testPNG(t, 20, 40)})
+	options := imageproc.Options{Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}}}
+	config := ScriptConfig{Manifest: filepath.Join(dir, "manifest.json")}
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "out"), &options, &config)
+
+	data, err := os.ReadFile(config.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Images) != 2 {
+		t.Fatalf("got %d entries, want 2: %s", len(manifest.Images), data)
+	}
+	encoded, _ := json.Marshal(&options)
+	hash := sha256.Sum256(encoded)
+	sizes := map[string]image.Point{"a.png": image.Pt(40, 20), "b.png": image.Pt(20, 40)}
+	for _, entry := range manifest.Images {
+		name := filepath.Base(entry.Source)
+		if entry.Source != filepath.ToSlash(filepath.Join(dir, "in", name)) {
+			t.Errorf("got the source %s", entry.Source)
+		}
+		if entry.OptionsHash != hex.EncodeToString(hash[:]) {
+			t.Errorf("%s: got the options hash %s", name, entry.OptionsHash)
+		}
+		if entry.APIResponse == nil || entry.FormattedImage == nil || len(entry.ThumbnailImages) != 1 {
+			t.Errorf("%s: got %+v, want the formatted image and a thumbnail", name, entry.APIResponse)
+			continue
+		}
+		if size := image.Pt(entry.FormattedImage.Width, entry.FormattedImage.Height); size != sizes[name] {
+			t.Errorf("%s: got %v, want %v", name, size, sizes[name])
+		}
+		for _, info := range append([]ImageInfo{*entry.FormattedImage}, entry.ThumbnailImages...) {
+			stat, err := os.Stat(filepath.FromSlash(info.Path))
+			if err != nil {
+				t.Error(err)
+			} else if stat.Size() != info.Bytes {
+				t.Errorf("%s: listed %d bytes, wrote %d", info.Path, info.Bytes, stat.Size())
+			}
+		}
+	}
+}
+
+// useLocalStorage points the storage at a temporary root for the test.
+func useLocalStorage(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	previous := storage
+	storage = &localStorage{root: root}
+	t.Cleanup(func() { storage = previous })
+	return root
+}
+
+// useCache enables a result cache of size for the test.
+func useCache(t *testing.T, size int) {
+	t.Helper()
+	cache = newResultCache(size)
+	t.Cleanup(func() { cache = nil })
+}
+
+func TestCacheHitsAndEviction(t *testing.T) {
+	root := useLocalStorage(t)
+	useCache(t, 1)
+	metrics = newAPIMetrics()
+	t.Cleanup(func() { metrics = nil })
+	handler := metrics.instrument(handleFormatRequest(1 << 20)).ServeHTTP
+	format := func(data []byte) {
+		t.Helper()
+		if w := postJSON(t, handler, "/format", "photo.png", data, imageproc.Options{}); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+	saved := func() int {
+		entries, _ := os.ReadDir(root)
+		return len(entries)
+	}
+
+	a, b := testPNG(t, 8, 8), testPNG(t, 8, 9)
+	format(a)
+	format(a)
+	if saved() != 1 {
+		t.Errorf("saved %d images, want the second request served from the cache", saved())
+	}
+	// the cache holds a single result, b evicts a
+	format(b)
+	format(a)
+	if saved() != 3 {
+		t.Errorf("saved %d images, want a processed again after its eviction", saved())
+	}
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := "image_cache_hits_total 1"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("the metrics lack %s:\n%s", want, w.Body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	send := func(handler http.Handler, path string, remoteAddr string, forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	handler := limitRate(&APIConfig{RateLimit: 0.1, RateBurst: 2}, ok)
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := send(handler, "/images", "192.0.2.1:1234", "")
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests {
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != "10" {
+				t.Errorf("got Retry-After %q, want 10 seconds", retryAfter)
+			}
+			if err := decodeAPIError(t, w); err.Code != "rate_limited" {
+				t.Errorf("got the error %+v, want rate_limited", err)
+			}
+		}
+	}
+	if w := send(handler, "/images", "192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", w.Code)
+	}
+	if w := send(handler, "/healthz", "192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("the health check: status %d, want 200", w.Code)
+	}
+	// without a trusted proxy X-Forwarded-For is ignored
+	if w := send(handler, "/images", "192.0.2.1:1234", "198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a spoofed X-Forwarded-For: status %d, want 429", w.Code)
+	}
+
+	handler = limitRate(&APIConfig{RateLimit: 0.1, RateBurst: 1, TrustProxy: true}, ok)
+	for i, tt := range []struct {
+		forwarded string
+		want      int
+	}{
+		{"198.51.100.1", http.StatusOK},
+		{"198.51.100.2", http.StatusOK},
+		// the proxy appends the client IP, the first entry is spoofed
+		{"203.0.113.9, 198.51.100.1", http.StatusTooManyRequests},
+	} {
+		if w := send(handler, "/images", "10.0.0.1:1234", tt.forwarded); w.Code != tt.want {
+			t.Errorf("request %d from %s: status %d, want %d", i, tt.forwarded, w.Code, tt.want)
+		}
+	}
+}
+
+func TestFormatReportsTheBytesWithinMaxBytes(t *testing.T) {
+	root := useLocalStorage(t)
+	// noise, which doesn't fit at the default quality
+	img := testImage(64, 64)
+	seed := uint32(1)
+	for i := range img.Pix {
+		if i%4 != 3 {
+			seed = seed*1664525 + 1013904223
+			img.Pix[i] = uint8(seed >> 24)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	budget := 3000
+	response := decodeResponse(t, postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", buf.Bytes(), imageproc.Options{Format: "jpeg", MaxBytes: budget}))
+	info := response.FormattedImage
+	if info == nil || info.Bytes > int64(budget) {
+		t.Fatalf("got %+v, want at most %d bytes", info, budget)
+	}
+	stat, err := os.Stat(filepath.Join(root, filepath.Base(info.Path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != info.Bytes {
+		t.Errorf("reported %d bytes, wrote %d", info.Bytes, stat.Size())
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	handler := logAccess(&out, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	for _, target := range []string{"/images?prefix=a", "/missing"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.String())
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"time", "method", "path", "status", "bytes", "durationMs", "clientIp"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("the record lacks %s: %s", field, lines[0])
+		}
+	}
+	for i, want := range []AccessRecord{
+		{Method: "GET", Path: "/images", Status: 200, Bytes: 5, ClientIP: "192.0.2.1"},
+		{Method: "GET", Path: "/missing", Status: 404, Bytes: int64(len("404 page not found\n")), ClientIP: "192.0.2.1"},
+	} {
+		var record AccessRecord
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Time.IsZero() || record.Duration < 0 {
+			t.Errorf("record %d: got the time %v and duration %v", i, record.Time, record.Duration)
+		}
+		record.Time, record.Duration = time.Time{}, 0
+		if record != want {
+			t.Errorf("record %d: got %+v, want %+v", i, record, want)
+		}
+	}
+}
+
+func TestFormatBlurhash(t *testing.T) {
+	useLocalStorage(t)
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{Blurhash: true})
+	if response := decodeResponse(t, w); len(response.Blurhash) != 28 {
+		t.Errorf("got the blurhash %q, want 4x3 components", response.Blurhash)
+	}
+
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{})
+	if strings.Contains(w.Body.String(), "blurhash") {
+		t.Errorf("the response has a placeholder without asking for it: %s", w.Body)
+	}
+}
+
+func TestFormatColors(t *testing.T) {
+	useLocalStorage(t)
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{ExtractColors: 2})
+	// testImage is blue
+	if response := decodeResponse(t, w); len(response.Colors) != 1 || response.Colors[0] != "#0000ff" {
+		t.Errorf("got the colors %v, want only #0000ff", response.Colors)
+	}
+
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{ExtractColors: 300})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("extracting 300 colors: status %d, want 400", w.Code)
+	}
+}
+
+func TestBatchRecursiveWithExtensions(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, testImage(20, 20), nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"in/a.png":          testPNG(t, 20, 20),
+		"in/sub/b.png":      testPNG(t, 20, 20),
+		"in/sub/deep/c.JPG": jpg.Bytes(),
+		"in/sub/d.gif":      testPNG(t, 20, 20),
+		"in/notes.txt":      []byte("not an image"),
+	})
+	var logged bytes.Buffer
+	writer := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(writer) })
+
+	config := &ScriptConfig{Recursive: true, Extensions: []string{"png", "jpg"}}
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "out"), &imageproc.Options{}, config)
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "flat"), &imageproc.Options{}, &ScriptConfig{})
+
+	for root, want := range map[string][]string{
+		"out":  {"a.png", "sub/b.png", "sub/deep/c.JPG"},
+		"flat": {"a.png"},
+	} {
+		var got []string
+		filepath.WalkDir(filepath.Join(dir, root), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(filepath.Join(dir, root), path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", root, got, want)
+		}
+	}
+	// the unselected gif and the unsupported text file
+	if want := "Processed 3 file(s), skipped 2, failed 0"; !strings.Contains(logged.String(), want) {
+		t.Errorf("the log lacks the summary %q:\n%s", want, logged.String())
+	}
+}
+
+// postArchive posts a zip of the files and the options to handler, with the
+// Accept header.
+func postArchive(t *testing.T, handler http.HandlerFunc, files []upload, options string, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("options", options)
+	fw, err := mw.CreateFormFile("archive", "images.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(archive.Bytes())
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/batch", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestBatchArchive(t *testing.T) {
+	root := useLocalStorage(t)
+	saved := func() int {
+		n := 0
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				n++
+			}
+			return err
+		})
+		return n
+	}
+	files := []upload{
+		{"a.png", testPNG(t, 40, 20)},
+		{"sub/b.png", testPNG(t, 20, 40)},
+		{"notes.txt", []byte("not an image")},
+	}
+	options := `{"resize": {"width": 10}}`
+
+	w := postArchive(t, handleBatchRequest(1<<20), files, options, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var batch BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Results) != 3 {
+		t.Fatalf("got %d results, want 3: %s", len(batch.Results), w.Body)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusUnsupportedMediaType} {
+		result := batch.Results[i]
+		if result.Name != files[i].name || result.Status != want {
+			t.Errorf("results[%d] is %s with status %d, want %s with %d", i, result.Name, result.Status, files[i].name, want)
+		}
+		if want == http.StatusOK && (result.APIResponse == nil || result.FormattedImage.Width != 10) {
+			t.Errorf("%s wasn't resized: %+v", result.Name, result.APIResponse)
+		}
+	}
+	if saved() != 2 {
+		t.Errorf("saved %d files, want the 2 images", saved())
+	}
+
+	w = postArchive(t, handleBatchRequest(1<<20), files, options, "application/zip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status %d, %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	results, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range results.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "batch.json" {
+			var problems BatchResponse
+			if err := json.NewDecoder(rc).Decode(&problems); err != nil || len(problems.Results) != 1 || problems.Results[0].Name != "notes.txt" {
+				t.Errorf("got the problems %+v, %v, want notes.txt", problems, err)
+			}
+		} else if config, err := png.DecodeConfig(rc); err != nil || config.Width != 10 {
+			t.Errorf("%s: got %+v, %v, want a 10 pixels wide PNG", f.Name, config, err)
+		}
+		rc.Close()
+	}
+	if got := strings.Join(names, " "); got != "a.png sub/b.png batch.json" {
+		t.Errorf("the zip holds %s", got)
+	}
+	if saved() != 2 {
+		t.Errorf("the zip response saved %d more files", saved()-2)
+	}
+
+	if w = postArchive(t, handleBatchRequest(1<<20), files, `{"quality": 500}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid options: status %d, want 400", w.Code)
+	}
+}
+
+func TestServeImageConditionally(t *testing.T) {
+	root := useLocalStorage(t)
+	data := testPNG(t, 8, 8)
+	writeFiles(t, root, map[string][]byte{"photo.png": data})
+	handler := handleServeImage
+	get := func(header string, value string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/image/photo.png", nil), map[string]string{"name": "photo.png"})
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	w := get("", "")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) || etag == "" || modified == "" {
+		t.Fatalf("status %d, ETag %q, Last-Modified %q", w.Code, etag, modified)
+	}
+	for _, tt := range []struct {
+		header, value string
+		want          int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", modified, http.StatusNotModified},
+		{"If-Modified-Since", time.Unix(1600000000, 0).UTC().Format(http.TimeFormat), http.StatusOK},
+	} {
+		w := get(tt.header, tt.value)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s: status %d, want %d", tt.header, tt.value, w.Code, tt.want)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: the 304 has a body of %d bytes", tt.header, w.Body.Len())
+		}
+	}
+
+	// a changed image has another ETag
+	writeFiles(t, root, map[string][]byte{"photo.png": testPNG(t, 16, 16)})
+	if w := get("If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("the ETag of the replaced image matched: status %d", w.Code)
+	}
+}
+
+func TestBatchDedupe(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"in/a.png": testPNG(t, 20, 20),
+		"in/b.png": testPNG(t, 20, 20),
+		"in/c.png": testPNG(t, 30, 30),
+	})
+	same := func(root string, x, y string) bool {
+		t.Helper()
+		a, err := os.Stat(filepath.Join(dir, root, x))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(dir, root, y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(a, b)
+	}
+
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "linked"), &imageproc.Options{}, &ScriptConfig{Dedupe: true})
+	if !same("linked", "a.png", "b.png") {
+		t.Errorf("the identical outputs weren't linked")
+	}
+	if same("linked", "a.png", "c.png") {
+		t.Errorf("different outputs were linked")
+	}
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "copied"), &imageproc.Options{}, &ScriptConfig{})
+	if same("copied", "a.png", "b.png") {
+		t.Errorf("the outputs were linked without dedupe")
+	}
+
+	// overwriting b.png with another image leaves the a.png it was linked to alone
+	writeFiles(t, dir, map[string][]byte{"in/b.png": testPNG(t, 10, 10)})
+	startBatch(filepath.Join(dir, "in"), filepath.Join(dir, "linked"), &imageproc.Options{}, &ScriptConfig{Dedupe: true, Overwrite: true})
+	f, err := os.Open(filepath.Join(dir, "linked", "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if config, err := png.DecodeConfig(f); err != nil || config.Width != 20 {
+		t.Errorf("a.png became %+v, %v, want it 20 pixels wide", config, err)
+	}
+	if same("linked", "a.png", "b.png") {
+		t.Errorf("the different outputs are still linked")
+	}
+}
+
+func TestBatchDedupeKeepsTheOutputOfAFailedSave(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"in/a.png": testPNG(t, 20, 20), "out/a.png": []byte("kept")})
+	failSaves(t, 1, syscall.EACCES)
+	out := filepath.Join(dir, "out", "a.png")
+	if _, err := processFile(filepath.Join(dir, "in", "a.png"), out, &imageproc.Options{}, &ScriptConfig{Dedupe: true}); err == nil {
+		t.Fatal("the save didn't fail")
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "kept" {
+		t.Errorf("the failed save left %q, %v, want the previous output", data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "out")); len(entries) != 1 {
+		t.Errorf("the failed save left %d files, want 1", len(entries))
+	}
+}
+
+func TestFormatOptionsFromTheQuery(t *testing.T) {
+	useLocalStorage(t)
+	photo := upload{"photo.png", testPNG(t, 40, 20)}
+
+	fromQuery := postMultipart(t, handleFormatRequest(1<<20), "/format?inline=true&resizew=20&rotate=45&fill=white&grayscale=true", nil, photo)
+	fromJSON := postMultipart(t, handleFormatRequest(1<<20), "/format?inline=true&resizew=30", map[string]string{
+		"options": `{"resize": {"width": 20}, "rotate": 45, "fill": "white", "grayscale": true}`,
+	}, photo)
+	if fromQuery.Code != http.StatusOK || fromJSON.Code != http.StatusOK {
+		t.Fatalf("status %d and %d: %s %s", fromQuery.Code, fromJSON.Code, fromQuery.Body, fromJSON.Body)
+	}
+	if !bytes.Equal(fromQuery.Body.Bytes(), fromJSON.Body.Bytes()) {
+		t.Errorf("the query and the JSON options produced different images")
+	}
+
+	var options imageproc.Options
+	query := url.Values{"resizew": {"800"}, "rotate": {"90"}, "fill": {"white"}, "thumbs": {"small:10x"}, "inline": {"true"}, "other": {"x"}}
+	if err := optionsFromQuery(query, &options); err != nil {
+		t.Fatal(err)
+	}
+	if options.Resize.Width != 800 || options.Rotate != 90 || options.Fill != "white" ||
+		len(options.Thumbnails) != 1 || options.Thumbnails[0] != (imageproc.Thumb{Suffix: "-small", Width: 10}) {
+		t.Errorf("got %+v", options)
+	}
+
+	for _, query := range []string{"resizew=wide", "rotate=right", "grayscale=maybe", "thumbs=small", "crops=10x10"} {
+		w := postMultipart(t, handleFormatRequest(1<<20), "/format?"+query, nil, photo)
+		if err := decodeAPIError(t, w); w.Code != http.StatusBadRequest || err.Code != "invalid_options" {
+			t.Errorf("%s: status %d, %+v, want 400 invalid_options", query, w.Code, err)
+		}
+	}
+}
+
+func TestOptionsFromTheQueryMatchTheJSON(t *testing.T) {
+	// every field of the options, by JSON name, with a query setting it and
+	// the options field setting the same
+	cases := map[string]struct{ query, json string }{
+		"autoOrient":     {"autoorient=false", `{"autoOrient": false}`},
+		"saveOriginal":   {"saveoriginal=true", `{"saveOriginal": true}`},
+		"page":           {"page=2", `{"page": 2}`},
+		"orientOriginal": {"orientoriginal=true", `{"orientOriginal": true}`},
+		"stripMetadata":  {"stripmetadata=true", `{"stripMetadata": true}`},
+		"flipH":          {"fliph=true", `{"flipH": true}`},
+		"flipV":          {"flipv=true", `{"flipV": true}`},
+		"transpose":      {"transpose=true", `{"transpose": true}`},
+		"transverse":     {"transverse=true", `{"transverse": true}`},
+		"trim":           {"trim=true&trimtolerance=10&trimcolor=white", `{"trim": {"enabled": true, "tolerance": 10, "color": "white"}}`},
+		"crop": {"cropx=1&cropy=2&cropw=3&croph=4&cropunit=percent&cropanchor=top&cropratio=16:9",
+			`{"crop": {"x": 1, "y": 2, "width": 3, "height": 4, "unit": "percent", "anchor": "top", "aspectRatio": "16:9"}}`},
+		"rotate":         {"rotate=45", `{"rotate": 45}`},
+		"rotateKeepSize": {"rotatekeepsize=true", `{"rotateKeepSize": true}`},
+		"fill":           {"fill=white", `{"fill": "white"}`},
+		"flattenColor":   {"flatten=red", `{"flattenColor": "red"}`},
+		"grayscale":      {"grayscale=true", `{"grayscale": true}`},
+		"resize": {"resizew=10&resizeh=20&resizescale=0.5&resizemaxw=30&resizemaxh=40&resizemode=pad&resizebg=red&resizeanchor=top&resizefilter=box&upscale=true&smart=true",
+			`{"resize": {"width": 10, "height": 20, "scale": 0.5, "maxWidth": 30, "maxHeight": 40, "mode": "pad", "background": "red", "anchor": "top", "filter": "box", "allowUpscale": true, "smart": true}}`},
+		"colorModel": {"colormodel=gray", `{"colorModel": "gray"}`},
+		"brightness": {"brightness=10", `{"brightness": 10}`},
+		"contrast":   {"contrast=20", `{"contrast": 20}`},
+		"saturation": {"saturation=30", `{"saturation": 30}`},
+		"gamma":      {"gamma=1.5", `{"gamma": 1.5}`},
+		"blur":       {"blur=2", `{"blur": 2}`},
+		"sharpen":    {"sharpen=3", `{"sharpen": 3}`},
+		"caption": {"caption=hi&captionsize=12&captioncolor=red&captionposition=top&captionbg=black",
+			`{"caption": {"text": "hi", "size": 12, "color": "red", "position": "top", "background": "black"}}`},
+		"roundCorners":   {"roundcorners=5", `{"roundCorners": 5}`},
+		"circle":         {"circle=true", `{"circle": true}`},
+		"thumbnails":     {"thumbs=small:10x20", `{"thumbnails": [{"suffix": "-small", "width": 10, "height": 20}]}`},
+		"widths":         {"widths=320,640", `{"widths": [320, 640]}`},
+		"crops":          {"crops=x", ""},
+		"skipPrimary":    {"skipprimary=true", `{"skipPrimary": true}`},
+		"nameTemplate":   {"nametemplate={base}_{suffix}{ext}", `{"nameTemplate": "{base}_{suffix}{ext}"}`},
+		"blurhash":       {"blurhash=true", `{"blurhash": true}`},
+		"phash":          {"phash=true", `{"phash": true}`},
+		"extractColors":  {"extractcolors=4", `{"extractColors": 4}`},
+		"preserveICC":    {"preserveicc=true", `{"preserveICC": true}`},
+		"quality":        {"quality=80", `{"quality": 80}`},
+		"maxBytes":       {"maxbytes=2KB", `{"maxBytes": 2048}`},
+		"dpi":            {"dpi=300", `{"dpi": 300}`},
+		"progressive":    {"progressive=true", `{"progressive": true}`},
+		"pngCompression": {"pngcompression=best", `{"pngCompression": "best"}`},
+		"palette":        {"palette=16", `{"palette": 16}`},
+		"format":         {"format=png", `{"format": "png"}`},
+		"formats":        {"formats=jpeg,png", `{"formats": ["jpeg", "png"]}`},
+	}
+
+	fields := reflect.TypeOf(imageproc.Options{})
+	for i := 0; i < fields.NumField(); i++ {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		c, ok := cases[name]
+		if !ok {
+			t.Errorf("the options field %s isn't covered", name)
+			continue
+		}
+		query, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromQuery, fromJSON imageproc.Options
+		err = optionsFromQuery(query, &fromQuery)
+		if c.json == "" {
+			if err == nil {
+				t.Errorf("%s: the query %s was accepted, want it rejected", name, c.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(c.json), &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromQuery, fromJSON) {
+			t.Errorf("%s: the query %s gave %+v, want %+v", name, c.query, fromQuery, fromJSON)
+		}
+	}
+}
+
+func TestParseWidths(t *testing.T) {
+	widths, err := parseWidths("320, 640,960")
+	if err != nil || fmt.Sprint(widths) != "[320 640 960]" {
+		t.Errorf("got %v, %v, want [320 640 960]", widths, err)
+	}
+	if _, err := parseWidths("320,wide"); err == nil {
+		t.Errorf("a width that isn't a number was accepted")
+	}
+}
+
+func TestFormatPHash(t *testing.T) {
+	useMemStorage(t)
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{PHash: true})
+	response := decodeResponse(t, w)
+	hash, err := strconv.ParseUint(response.PHash, 16, 64)
+	if err != nil || len(response.PHash) != 16 {
+		t.Fatalf("got the hash %q, want 16 hex digits", response.PHash)
+	}
+	img, err := imageproc.Decode(bytes.NewReader(testPNG(t, 40, 20)), &imageproc.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := imageproc.PHash(img.Image); hash != want {
+		t.Errorf("got the hash %016x, want that of the image %016x", hash, want)
+	}
+
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), imageproc.Options{})
+	if response := decodeResponse(t, w); response.PHash != "" {
+		t.Errorf("got the hash %q without the option", response.PHash)
+	}
+}
+
+func TestFormatCrops(t *testing.T) {
+	mem := useMemStorage(t)
+	options := imageproc.Options{Crops: []imageproc.Crop{
+		{Width: 10, Height: 10},
+		{X: 10, Width: 30, Height: 20},
+		{Anchor: "center", Width: 20, Height: 4},
+	}}
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), options)
+	response := decodeResponse(t, w)
+	if response.FormattedImage == nil || !strings.HasSuffix(response.Formatted, "photo-crop1.png") || response.FormattedImage.Width != 10 {
+		t.Fatalf("got the formatted image %+v, want the 10x10 first crop", response.FormattedImage)
+	}
+	if len(response.ThumbnailImages) != 2 {
+		t.Fatalf("got the other images %+v, want the 2 other crops", response.ThumbnailImages)
+	}
+	for i, want := range []image.Point{image.Pt(30, 20), image.Pt(20, 4)} {
+		info := response.ThumbnailImages[i]
+		if !strings.HasSuffix(info.Path, fmt.Sprintf("photo-crop%d.png", i+2)) || image.Pt(info.Width, info.Height) != want {
+			t.Errorf("got %+v, want crop %d of %v", info, i+2, want)
+		}
+		if mem.objects[strings.TrimPrefix(info.Path, "mem://")] == nil {
+			t.Errorf("%s wasn't saved", info.Path)
+		}
+	}
+
+	options.Crops[2] = imageproc.Crop{X: 30, Width: 20, Height: 10}
+	w = postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", testPNG(t, 40, 20), options)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a crop out of the bounds: status %d, want 400", w.Code)
+	}
+}
+
+func TestBatchSkipsExistingOutputs(t *testing.T) {
+	saves := countSaves(t)
+
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string][]byte{"photo.png": testPNG(t, 40, 20)})
+	for _, options := range []imageproc.Options{
+		{Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}}, SkipPrimary: true, Formats: []string{"png", "jpeg"}},
+		{Crops: []imageproc.Crop{{Width: 10, Height: 10}, {X: 10, Width: 10, Height: 10}}},
+		// only known once processed
+		{Thumbnails: []imageproc.Thumb{{Width: 10, NameTemplate: "{base}-{width}w{ext}"}}},
+	} {
+		*saves = 0
+		startBatch(srcDir, dstDir, &options, &ScriptConfig{})
+		written := *saves
+		if written < 2 {
+			t.Fatalf("the first run saved %d outputs, want at least 2", written)
+		}
+		startBatch(srcDir, dstDir, &options, &ScriptConfig{})
+		if *saves != written {
+			t.Errorf("%+v: the second run saved %d outputs, want none", options, *saves-written)
+		}
+		startBatch(srcDir, dstDir, &options, &ScriptConfig{Overwrite: true})
+		if *saves != 2*written {
+			t.Errorf("%+v: the run with -overwrite saved %d outputs, want %d", options, *saves-written, written)
+		}
+		*saves = written
+
+		// a missing output reprocesses the source
+		entries, _ := os.ReadDir(dstDir)
+		os.Remove(filepath.Join(dstDir, entries[len(entries)-1].Name()))
+		startBatch(srcDir, dstDir, &options, &ScriptConfig{})
+		if *saves != 2*written {
+			t.Errorf("%+v: the run after removing an output saved %d outputs, want %d", options, *saves-written, written)
+		}
+		for _, e := range entries {
+			os.Remove(filepath.Join(dstDir, e.Name()))
+		}
+	}
+}
+
+func TestBatchFormats(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string][]byte{"photo.png": testPNG(t, 40, 20)})
+	options := &imageproc.Options{
+		Formats:    []string{"jpeg", "png", "gif"},
+		Resize:     imageproc.Resize{Width: 20},
+		Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}},
+	}
+	startBatch(srcDir, dstDir, options, &ScriptConfig{})
+
+	for name, want := range map[string]struct {
+		signature string
+		width     int
+	}{
+		"photo.jpg":       {"\xff\xd8\xff", 20},
+		"photo.png":       {"\x89PNG", 20},
+		"photo.gif":       {"GIF8", 20},
+		"photo-small.jpg": {"\xff\xd8\xff", 10},
+		"photo-small.png": {"\x89PNG", 10},
+		"photo-small.gif": {"GIF8", 10},
+	} {
+		data, err := os.ReadFile(filepath.Join(dstDir, name))
+		if err != nil {
+			t.Errorf("%s wasn't written: %s", name, err)
+			continue
+		}
+		if !bytes.HasPrefix(data, []byte(want.signature)) {
+			t.Errorf("%s starts with %q, want %q", name, data[:min(len(data), 4)], want.signature)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width != want.width {
+			t.Errorf("%s: got %+v, %v, want %d pixels wide", name, config, err, want.width)
+		}
+	}
+	if entries, _ := os.ReadDir(dstDir); len(entries) != 6 {
+		t.Errorf("wrote %d files, want 6", len(entries))
+	}
+}
+
+func TestPreviewIgnoresCropsAndFormats(t *testing.T) {
+	options := imageproc.Options{
+		Crops:      []imageproc.Crop{{Width: 100, Height: 100}, {X: 100, Width: 100, Height: 100}},
+		Formats:    []string{"png", "gif"},
+		Thumbnails: []imageproc.Thumb{{Width: 50, Height: 50}},
+	}
+	w := postJSON(t, handlePreviewRequest(1<<20), "/format/preview", "wide.png", testPNG(t, 1000, 500), options)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Fatalf("content type %q, want image/jpeg", ct)
+	}
+	cfg, format, err := image.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || cfg.Width != previewSize || cfg.Height != previewSize/2 {
+		t.Errorf("got a %dx%d %s, want the whole image as a %dx%d jpeg", cfg.Width, cfg.Height, format, previewSize, previewSize/2)
+	}
+}
+
+func TestCacheKeyIncludesName(t *testing.T) {
+	useLocalStorage(t)
+	useCache(t, 4)
+	data := testPNG(t, 20, 10)
+	options := imageproc.Options{}
+
+	first, fail := formatImage("first.png", bytes.NewReader(data), &options)
+	if fail != nil {
+		t.Fatal(fail.Err)
+	}
+	again, fail := formatImage("first.png", bytes.NewReader(data), &options)
+	if fail != nil {
+		t.Fatal(fail.Err)
+	}
+	if again != first {
+		t.Errorf("the same name and upload weren't served from the cache")
+	}
+
+	second, fail := formatImage("second.png", bytes.NewReader(data), &options)
+	if fail != nil {
+		t.Fatal(fail.Err)
+	}
+	if second == first || !strings.HasSuffix(second.Formatted, "-second.png") {
+		t.Errorf("got %s for second.png, want a file named after it", second.Formatted)
+	}
+}
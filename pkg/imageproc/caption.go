@@ -0,0 +1,134 @@
+package imageproc
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Caption renders a text label onto the image, e.g. an attribution.
+type Caption struct {
+	// Text of the caption, "\n" starts a new line. Empty disables the caption
+	Text string `json:"text,omitempty"`
+	// Size is the font size in pixels. Default: 5% of the image height, at least 12
+	Size float64 `json:"size,omitempty"`
+	// Color of the text, in the format of Options.Fill. Default: white
+	Color string `json:"color,omitempty"`
+	// Position is an anchor name as in Resize.Anchor, e.g. topleft. Default: bottom
+	Position string `json:"position,omitempty"`
+	// Background is the color of a band spanning the width of the image behind
+	// the text, e.g. #00000080. Default: no band
+	Background string `json:"background,omitempty"`
+}
+
+var (
+	captionFontOnce sync.Once
+	captionFont     *opentype.Font
+	captionFontErr  error
+)
+
+// defaultFont returns the embedded Go Regular font, parsed on first use.
+func defaultFont() (*opentype.Font, error) {
+	captionFontOnce.Do(func() {
+		captionFont, captionFontErr = opentype.Parse(goregular.TTF)
+	})
+	return captionFont, captionFontErr
+}
+
+func (c *Caption) validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("caption.size must not be negative, got %f", c.Size)
+	}
+	if c.Position != "" {
+		if _, err := ParseAnchor(c.Position); err != nil {
+			return fmt.Errorf("caption.position: %v", err)
+		}
+	}
+	return nil
+}
+
+// Apply draws the caption over img, with a padding of half the font size from
+// the edges of the image.
+func (c *Caption) Apply(img image.Image) (image.Image, error) {
+	if c.Text == "" {
+		return img, nil
+	}
+	textColor, err := parseColor(c.Color)
+	if err != nil {
+		return nil, err
+	}
+	if c.Color == "" {
+		textColor = image.White.C
+	}
+	background, err := parseColor(c.Background)
+	if err != nil {
+		return nil, err
+	}
+	position := c.Position
+	if position == "" {
+		position = "bottom"
+	}
+	anchor, err := ParseAnchor(position)
+	if err != nil {
+		return nil, err
+	}
+	f, err := defaultFont()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := imaging.Clone(img)
+	bounds := dst.Bounds()
+	size := c.Size
+	if size == 0 {
+		size = math.Max(12, float64(bounds.Dy())/20)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	lines := strings.Split(c.Text, "\n")
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	padding := int(size / 2)
+	blockHeight := len(lines)*lineHeight + 2*padding
+
+	top := bounds.Min.Y
+	switch anchor {
+	case imaging.Left, imaging.Center, imaging.Right:
+		top += (bounds.Dy() - blockHeight) / 2
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		top += bounds.Dy() - blockHeight
+	}
+	if _, _, _, a := background.RGBA(); a > 0 {
+		band := image.Rect(bounds.Min.X, top, bounds.Max.X, top+blockHeight)
+		draw.Draw(dst, band, image.NewUniform(background), image.Point{}, draw.Over)
+	}
+
+	drawer := &font.Drawer{Dst: dst, Src: image.NewUniform(textColor), Face: face}
+	for i, line := range lines {
+		width := drawer.MeasureString(line).Ceil()
+		x := bounds.Min.X + padding
+		switch anchor {
+		case imaging.Top, imaging.Center, imaging.Bottom:
+			x = bounds.Min.X + (bounds.Dx()-width)/2
+		case imaging.TopRight, imaging.Right, imaging.BottomRight:
+			x = bounds.Max.X - padding - width
+		}
+		y := top + padding + i*lineHeight + metrics.Ascent.Ceil()
+		drawer.Dot = fixed.P(x, y)
+		drawer.DrawString(line)
+	}
+	return dst, nil
+}
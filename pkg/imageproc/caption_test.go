@@ -0,0 +1,80 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// changed counts the pixels of r differing from black.
+func changed(img image.Image, r image.Rectangle) int {
+	n := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if r, g, b, _ := img.At(x, y).RGBA(); r|g|b != 0 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestCaption(t *testing.T) {
+	src := fill(200, 100, color.Black)
+	top, bottom := image.Rect(0, 0, 200, 50), image.Rect(0, 50, 200, 100)
+	left, right := image.Rect(0, 0, 100, 100), image.Rect(100, 0, 200, 100)
+
+	img, err := (&Caption{Text: "Hello"}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed(img, bottom) == 0 || changed(img, top) != 0 {
+		t.Errorf("the default caption changed %d pixels at the top and %d at the bottom, want only the bottom", changed(img, top), changed(img, bottom))
+	}
+	if changed(src, src.Bounds()) != 0 {
+		t.Errorf("the source was drawn on")
+	}
+
+	img, err = (&Caption{Text: "Hi", Position: "topleft", Size: 20, Color: "red"}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed(img, top.Intersect(left)) == 0 || changed(img, bottom) != 0 || changed(img, right) != 0 {
+		t.Errorf("the top left caption wasn't drawn only at the top left")
+	}
+	// anti-aliased red over black
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			if _, g, b, _ := img.At(x, y).RGBA(); g != 0 || b != 0 {
+				t.Fatalf("the red caption has the pixel %v", img.At(x, y))
+			}
+		}
+	}
+
+	// the band spans the width of the image
+	img, err = (&Caption{Text: "Hi", Background: "#0000ff", Position: "bottom"}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(0, 99).RGBA(); r != 0 || g != 0 || b>>8 != 0xff {
+		t.Errorf("the band is %v at the bottom left, want blue", img.At(0, 99))
+	}
+	if changed(img, top) != 0 {
+		t.Errorf("the band reaches the top")
+	}
+
+	// through Process, after the resize
+	images, err := Process("photo.png", fill(400, 200, color.Black), &Options{Resize: Resize{Width: 200}, Caption: Caption{Text: "Hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed(images[0].Image, bottom) == 0 {
+		t.Errorf("Process didn't draw the caption")
+	}
+
+	for _, caption := range []Caption{{Text: "Hi", Size: -1}, {Text: "Hi", Position: "nowhere"}, {Text: "Hi", Color: "nocolor"}} {
+		if err := (&Options{Caption: caption}).Validate(); err == nil {
+			t.Errorf("%+v was accepted", caption)
+		}
+	}
+}
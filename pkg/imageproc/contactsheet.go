@@ -0,0 +1,66 @@
+package imageproc
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"github.com/disintegration/imaging"
+)
+
+// ContactSheet composes images into a grid montage, e.g. to summarize a folder.
+type ContactSheet struct {
+	// Columns of the grid. Default: 4
+	Columns int `json:"columns,omitempty"`
+	// CellWidth and CellHeight bound every image, which is fitted into its cell
+	// keeping the aspect ratio and centered in it
+	CellWidth  int `json:"cellWidth"`
+	CellHeight int `json:"cellHeight"`
+	// Padding is the space around and between the cells, in pixels
+	Padding int `json:"padding,omitempty"`
+	// Background is the color of the sheet, in the format of Options.Fill
+	Background string `json:"background,omitempty"`
+}
+
+// Compose lays out the images row by row, in the given order.
+func (c *ContactSheet) Compose(images []image.Image) (image.Image, error) {
+	if len(images) == 0 {
+		return nil, errors.New("a contact sheet needs at least one image")
+	}
+	if c.CellWidth <= 0 || c.CellHeight <= 0 {
+		return nil, fmt.Errorf("contact sheet cells must have a positive size, got %dx%d", c.CellWidth, c.CellHeight)
+	}
+	if c.Padding < 0 {
+		return nil, fmt.Errorf("contact sheet padding must not be negative, got %d", c.Padding)
+	}
+	background, err := parseColor(c.Background)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := c.Columns
+	if columns <= 0 {
+		columns = 4
+	}
+	columns = min(columns, len(images))
+	rows := (len(images) + columns - 1) / columns
+
+	w := columns*c.CellWidth + (columns+1)*c.Padding
+	h := rows*c.CellHeight + (rows+1)*c.Padding
+	if err := checkMaxDimension(w, h, image.Pt(w, h)); err != nil {
+		return nil, err
+	}
+	logging.Debugf("Composing %d images into a %dx%d contact sheet of %dx%d.\n", len(images), columns, rows, w, h)
+
+	sheet := imaging.New(w, h, background)
+	for i, img := range images {
+		cell := imaging.Fit(img, c.CellWidth, c.CellHeight, imaging.Lanczos)
+		size := cell.Bounds().Size()
+		x := c.Padding + (i%columns)*(c.CellWidth+c.Padding) + (c.CellWidth-size.X)/2
+		y := c.Padding + (i/columns)*(c.CellHeight+c.Padding) + (c.CellHeight-size.Y)/2
+		// overlaid rather than pasted, so transparent images show the background
+		sheet = imaging.Overlay(sheet, cell, image.Pt(x, y), 1.0)
+	}
+	return sheet, nil
+}
@@ -0,0 +1,65 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestContactSheet(t *testing.T) {
+	blue := color.NRGBA{B: 255, A: 255}
+	images := []image.Image{
+		fill(100, 80, blue),
+		// wider than the cell, fitted to 50x20
+		fill(100, 40, blue),
+		fill(40, 80, blue),
+		fill(10, 8, blue),
+	}
+	sheet := &ContactSheet{Columns: 2, CellWidth: 50, CellHeight: 40, Padding: 5, Background: "#ff0000"}
+	img, err := sheet.Compose(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 cells and 3 paddings each way
+	if size := img.Bounds().Size(); size != image.Pt(115, 95) {
+		t.Fatalf("got %v, want 115x95", size)
+	}
+	isBlue := func(x, y int) bool {
+		r, _, b, _ := img.At(x, y).RGBA()
+		return r < 0x4000 && b > 0xc000
+	}
+	for _, tt := range []struct {
+		x, y int
+		blue bool
+	}{
+		{2, 2, false},   // padding
+		{30, 25, true},  // first cell
+		{60, 6, false},  // above the centered wide image
+		{80, 25, true},  // the wide image
+		{8, 60, false},  // left of the centered tall image
+		{30, 60, true},  // the tall image
+		{80, 60, false}, // the small image isn't upscaled
+		{85, 70, true},  // the small image
+	} {
+		if isBlue(tt.x, tt.y) != tt.blue {
+			t.Errorf("at %d,%d got %v, want blue %v", tt.x, tt.y, img.At(tt.x, tt.y), tt.blue)
+		}
+	}
+
+	// fewer images than columns narrow the sheet
+	if img, err = (&ContactSheet{CellWidth: 50, CellHeight: 40}).Compose(images[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(100, 40) {
+		t.Errorf("got %v, want 100x40", size)
+	}
+
+	for _, sheet := range []*ContactSheet{{CellWidth: 0, CellHeight: 40}, {CellWidth: 50, CellHeight: 40, Padding: -1}} {
+		if _, err := sheet.Compose(images); err == nil {
+			t.Errorf("composed %+v", sheet)
+		}
+	}
+	if _, err := sheet.Compose(nil); err == nil {
+		t.Errorf("composed no images")
+	}
+}
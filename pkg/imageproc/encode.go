@@ -0,0 +1,182 @@
+package imageproc
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"github.com/disintegration/imaging"
+)
+
+// encodeWebP is set when built with the webp tag. A quality of 0 uses the encoder default.
+var encodeWebP func(w io.Writer, img image.Image, quality int) error
+
+// encodeProgressiveJPEG is set when built with the libjpeg tag. A quality of 0 uses the imaging default.
+var encodeProgressiveJPEG func(w io.Writer, img image.Image, quality int) error
+
+// Encode encodes the image in the format implied by its name and
+// returns the matching content type.
+func Encode(w io.Writer, img *ProcessedImage, options *Options) (string, error) {
+	if img.Quality > 0 || img.MaxBytes > 0 {
+		overridden := *options
+		if img.Quality > 0 {
+			overridden.Quality = img.Quality
+		}
+		if img.MaxBytes > 0 {
+			overridden.MaxBytes = img.MaxBytes
+		}
+		options = &overridden
+	}
+	if options.MaxBytes > 0 && hasQuality(img.Name) {
+		return encodeWithinBudget(w, img, options)
+	}
+
+	if strings.EqualFold(filepath.Ext(img.Name), ".webp") {
+		if img.Animation != nil {
+			if err := encodeAnimatedWebP(w, img.Animation, options.Quality); err != nil {
+				return "", err
+			}
+			return "image/webp", nil
+		}
+		if encodeWebP == nil {
+			return "", errors.New("webp output requires building with -tags webp")
+		}
+		if err := encodeWebP(w, img.Image, options.Quality); err != nil {
+			return "", err
+		}
+		return "image/webp", nil
+	}
+
+	format, err := imaging.FormatFromFilename(img.Name)
+	if err != nil {
+		return "", err
+	}
+	if img.Animation != nil && format == imaging.GIF {
+		err = gif.EncodeAll(w, img.Animation)
+	} else if (img.ICC != nil || options.DPI > 0) && (format == imaging.JPEG || format == imaging.PNG) {
+		var buf bytes.Buffer
+		var encoded []byte
+		if err = encodeStill(&buf, img.Image, format, options); err == nil {
+			encoded = buf.Bytes()
+		}
+		if err == nil && img.ICC != nil {
+			encoded, err = embedICC(encoded, format, img.ICC)
+		}
+		if err == nil && options.DPI > 0 {
+			encoded, err = embedDPI(encoded, format, options.DPI)
+		}
+		if err == nil {
+			_, err = w.Write(encoded)
+		}
+	} else {
+		err = encodeStill(w, img.Image, format, options)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "image/" + strings.ToLower(format.String()), nil
+}
+
+// encodeStill encodes a single image, as a progressive JPEG when requested.
+func encodeStill(w io.Writer, img image.Image, format imaging.Format, options *Options) error {
+	if format == imaging.JPEG && options.Progressive {
+		if encodeProgressiveJPEG == nil {
+			return errors.New("progressive jpeg output requires building with -tags libjpeg")
+		}
+		return encodeProgressiveJPEG(w, img, options.Quality)
+	}
+	if format == imaging.PNG && options.Palette > 0 {
+		img = quantize(img, options.Palette)
+	}
+	return imaging.Encode(w, img, format, options.EncodeOptions()...)
+}
+
+// hasQuality reports whether the format of name is encoded with a quality.
+func hasQuality(name string) bool {
+	if strings.EqualFold(filepath.Ext(name), ".webp") {
+		return true
+	}
+	format, err := imaging.FormatFromFilename(name)
+	return err == nil && format == imaging.JPEG
+}
+
+// minBudgetQuality is the lowest quality encodeWithinBudget goes down to.
+const minBudgetQuality = 10
+
+// encodeWithinBudget binary searches the highest quality, up to the one of
+// the options, at which the image fits into options.MaxBytes. When even
+// minBudgetQuality doesn't fit, the image is encoded with it anyway.
+func encodeWithinBudget(w io.Writer, img *ProcessedImage, options *Options) (string, error) {
+	encode := func(quality int) (*bytes.Buffer, string, error) {
+		attempt := *options
+		attempt.Quality, attempt.MaxBytes = quality, 0
+		still := *img
+		still.Quality, still.MaxBytes = 0, 0
+		var buf bytes.Buffer
+		contentType, err := Encode(&buf, &still, &attempt)
+		return &buf, contentType, err
+	}
+
+	high := options.Quality
+	if high == 0 {
+		// the imaging default
+		high = 95
+	}
+	low := min(minBudgetQuality, high)
+
+	best, contentType, err := encode(high)
+	if err != nil {
+		return "", err
+	}
+	quality := high
+	if best.Len() > options.MaxBytes {
+		best = nil
+		for hi := high - 1; low <= hi; {
+			mid := (low + hi) / 2
+			buf, ct, err := encode(mid)
+			if err != nil {
+				return "", err
+			}
+			if buf.Len() <= options.MaxBytes {
+				best, contentType, quality = buf, ct, mid
+				low = mid + 1
+			} else {
+				hi = mid - 1
+			}
+		}
+	}
+	if best == nil {
+		quality = min(minBudgetQuality, high)
+		if best, contentType, err = encode(quality); err != nil {
+			return "", err
+		}
+		logging.Warnf("%s doesn't fit into %d bytes even at quality %d: %d bytes", img.Name, options.MaxBytes, quality, best.Len())
+	}
+
+	logging.Debugf("Encoded %s at quality %d: %d of %d bytes.\n", img.Name, quality, best.Len(), options.MaxBytes)
+	_, err = best.WriteTo(w)
+	return contentType, err
+}
+
+// Save encodes the image to path, in the format implied by its name. The
+// partially written file is removed when saving fails.
+func Save(path string, img *ProcessedImage, options *Options) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = Encode(f, img, options)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package imageproc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// noise returns a w x h image of pseudo random pixels, which compresses
+// differently at every quality and compression level.
+func noise(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(seed >> 24)
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestEncodeQuality(t *testing.T) {
+	src := noise(64, 64)
+	img := &ProcessedImage{Name: "photo.jpg", Image: src}
+	low, contentType := encode(t, img, &Options{Quality: 50})
+	high, _ := encode(t, img, &Options{Quality: 95})
+	if contentType != "image/jpeg" {
+		t.Errorf("content type %q, want image/jpeg", contentType)
+	}
+	if len(low) >= len(high) {
+		t.Errorf("quality 50 encoded %d bytes, quality 95 %d, want fewer", len(low), len(high))
+	}
+
+	for _, quality := range []int{-1, 101} {
+		if err := (&Options{Quality: quality}).Validate(); err == nil {
+			t.Errorf("quality %d is valid", quality)
+		}
+	}
+}
+
+func TestEncodePNGCompression(t *testing.T) {
+	src := fill(64, 64, color.White)
+	img := &ProcessedImage{Name: "flat.png", Image: src}
+	none, _ := encode(t, img, &Options{PNGCompression: "none"})
+	best, _ := encode(t, img, &Options{PNGCompression: "BEST"})
+	if len(best) >= len(none) {
+		t.Errorf("the best compression encoded %d bytes, none %d, want fewer", len(best), len(none))
+	}
+
+	// ignored for other formats
+	jpg := &ProcessedImage{Name: "flat.jpg", Image: img.Image}
+	a, _ := encode(t, jpg, &Options{PNGCompression: "none"})
+	b, _ := encode(t, jpg, &Options{})
+	if len(a) != len(b) {
+		t.Errorf("the png compression changed a jpeg from %d to %d bytes", len(b), len(a))
+	}
+
+	if err := (&Options{PNGCompression: "max"}).Validate(); err == nil {
+		t.Error("an unknown png compression is valid")
+	}
+}
+
+func TestEncodePalette(t *testing.T) {
+	img := &ProcessedImage{Name: "icon.png", Image: noise(64, 64)}
+	full, _ := encode(t, img, &Options{})
+	data, contentType := encode(t, img, &Options{Palette: 16})
+	if contentType != "image/png" {
+		t.Fatalf("got %s, want image/png", contentType)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted, ok := decoded.(*image.Paletted)
+	if !ok {
+		t.Fatalf("decoded a %T, want a paletted image", decoded)
+	}
+	if len(paletted.Palette) > 16 {
+		t.Errorf("got %d colors, want at most 16", len(paletted.Palette))
+	}
+	if len(data) >= len(full) {
+		t.Errorf("the indexed PNG has %d bytes, want less than the %d of the full color one", len(data), len(full))
+	}
+
+	// the transparency is kept in the palette
+	data, _ = encode(t, &ProcessedImage{Name: "icon.png", Image: transparentLeft(16, 16)}, &Options{Palette: 2})
+	if decoded, err = png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if a := alphaAt(decoded, 0, 0); a != 0 {
+		t.Errorf("the transparent half has the alpha %d", a)
+	}
+	if r, _, _, a := decoded.At(15, 0).RGBA(); r>>8 != 255 || a>>8 != 255 {
+		t.Errorf("the opaque half is %v, want red", decoded.At(15, 0))
+	}
+
+	for _, palette := range []int{1, 257, -2} {
+		if err := (&Options{Palette: palette}).Validate(); err == nil {
+			t.Errorf("a palette of %d colors was accepted", palette)
+		}
+	}
+}
+
+func TestEncodeWithinMaxBytes(t *testing.T) {
+	img := &ProcessedImage{Name: "photo.jpg", Image: noise(64, 64)}
+	full, _ := encode(t, img, &Options{})
+	floor, _ := encode(t, img, &Options{Quality: minBudgetQuality})
+
+	budget := (len(full) + len(floor)) / 2
+	data, _ := encode(t, img, &Options{MaxBytes: budget})
+	if len(data) > budget || len(data) <= len(floor) {
+		t.Errorf("got %d bytes, want at most %d and more than the %d of the lowest quality", len(data), budget, len(floor))
+	}
+	// a sufficient budget keeps the quality
+	if data, _ = encode(t, img, &Options{MaxBytes: len(full)}); len(data) != len(full) {
+		t.Errorf("got %d bytes for a budget of the full quality, want %d", len(data), len(full))
+	}
+	// an unreachable budget stops at the lowest quality
+	data, _ = encode(t, img, &Options{MaxBytes: 100})
+	if len(data) != len(floor) {
+		t.Errorf("got %d bytes for an unreachable budget, want the %d of quality %d", len(data), len(floor), minBudgetQuality)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+
+	// the budget of a thumbnail is its own
+	options := &Options{Format: "jpeg", Thumbnails: []Thumb{{Suffix: "-small", Width: 64, MaxBytes: budget}}}
+	images, err := Process("photo.png", noise(64, 64), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, _ := encode(t, &images[0], options)
+	thumb, _ := encode(t, &images[1], options)
+	if len(primary) != len(full) || len(thumb) > budget {
+		t.Errorf("got %d and %d bytes, want the full %d and at most %d for the thumbnail", len(primary), len(thumb), len(full), budget)
+	}
+}
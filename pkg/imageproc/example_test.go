@@ -0,0 +1,43 @@
+package imageproc_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+)
+
+func Example() {
+	var upload bytes.Buffer
+	png.Encode(&upload, image.NewNRGBA(image.Rect(0, 0, 800, 600)))
+
+	options := &imageproc.Options{
+		Resize:     imageproc.Resize{Width: 400},
+		Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 100}},
+	}
+	if err := options.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	src, err := imageproc.Decode(&upload, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	images, err := src.Process("photo.png", options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, img := range images {
+		var out bytes.Buffer
+		contentType, err := imageproc.Encode(&out, &img, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(img.Name, img.Image.Bounds().Dx(), img.Image.Bounds().Dy(), contentType)
+	}
+	// Output:
+	// photo.png 400 300 image/png
+	// photo-small.png 100 75 image/png
+}
@@ -0,0 +1,18 @@
+//go:build heif
+
+package imageproc
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/jdeng/goheif"
+)
+
+// The HEIF decoder needs cgo (libde265), so HEIC / HEIF input is only
+// supported with -tags heif.
+func init() {
+	decodeHEIF = func(data []byte) (image.Image, error) {
+		return goheif.Decode(bytes.NewReader(data))
+	}
+}
@@ -0,0 +1,39 @@
+//go:build heif
+
+package imageproc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"testing"
+)
+
+func TestDecodeHEIF(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testHEIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Decode(bytes.NewReader(data), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("photo.heic", &Options{Format: "png", Resize: Resize{Width: 16}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := images[0]
+	if img.Name != "photo.png" {
+		t.Errorf("got %s, want photo.png", img.Name)
+	}
+	if size := img.Image.Bounds().Size(); size != image.Pt(16, 8) {
+		t.Fatalf("got %v, want 16x8", size)
+	}
+	// HEIC is lossy
+	if r, _, b, _ := img.Image.At(1, 4).RGBA(); r>>8 < 200 || b>>8 > 60 {
+		t.Errorf("the left half is %v, want red", img.Image.At(1, 4))
+	}
+	if r, _, b, _ := img.Image.At(14, 4).RGBA(); r>>8 > 60 || b>>8 < 200 {
+		t.Errorf("the right half is %v, want blue", img.Image.At(14, 4))
+	}
+}
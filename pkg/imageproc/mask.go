@@ -0,0 +1,68 @@
+package imageproc
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// masked reports whether RoundCorners or Circle make the corners transparent.
+func (o *Options) masked() bool {
+	return o.RoundCorners > 0 || o.Circle
+}
+
+// carriesAlpha reports whether the format, as in Options.Format, can hold the
+// transparent corners of a masked image.
+func carriesAlpha(format string) bool {
+	switch strings.ToLower(format) {
+	case "jpeg", "jpg", "bmp":
+		return false
+	}
+	return true
+}
+
+// mask makes the corners of img outside a circle of the given radius
+// transparent, or everything outside the inscribed ellipse when circle is set.
+// The edge is anti-aliased by sampling every pixel at 4x4 points, the alpha
+// being the covered fraction.
+func mask(img image.Image, radius int, circle bool) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	rx, ry := float64(min(radius, w/2)), float64(min(radius, h/2))
+	if circle {
+		rx, ry = float64(w)/2, float64(h)/2
+	}
+	if rx <= 0 || ry <= 0 {
+		return img
+	}
+
+	// inside reports whether the point is within the shape, only checking the
+	// corner ellipses as everything between them is kept
+	inside := func(x, y float64) bool {
+		cx := math.Max(rx, math.Min(x, float64(w)-rx))
+		cy := math.Max(ry, math.Min(y, float64(h)-ry))
+		dx, dy := (x-cx)/rx, (y-cy)/ry
+		return dx*dx+dy*dy <= 1
+	}
+	alpha := image.NewAlpha(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			covered := 0
+			for sy := 0; sy < 4; sy++ {
+				for sx := 0; sx < 4; sx++ {
+					if inside(float64(x)+(float64(sx)+0.5)/4, float64(y)+(float64(sy)+0.5)/4) {
+						covered++
+					}
+				}
+			}
+			alpha.Pix[y*alpha.Stride+x] = uint8(covered * 255 / 16)
+		}
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.DrawMask(result, result.Bounds(), imaging.Clone(img), image.Point{}, alpha, image.Point{}, draw.Src)
+	return result
+}
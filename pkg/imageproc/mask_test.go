@@ -0,0 +1,77 @@
+package imageproc
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options *Options
+		// opaque and transparent points
+		opaque, transparent [][2]int
+	}{
+		{"round corners", &Options{RoundCorners: 10},
+			[][2]int{{20, 20}, {10, 0}, {0, 10}, {39, 10}, {3, 3}},
+			[][2]int{{0, 0}, {39, 0}, {0, 39}, {39, 39}, {1, 1}}},
+		{"circle", &Options{Circle: true},
+			[][2]int{{20, 20}, {20, 1}, {1, 20}, {38, 20}},
+			[][2]int{{0, 0}, {39, 39}, {4, 4}, {35, 35}}},
+		{"radius beyond the size", &Options{RoundCorners: 100},
+			[][2]int{{20, 20}, {20, 1}},
+			[][2]int{{0, 0}, {4, 4}}},
+	} {
+		images, err := Process("photo.jpg", fill(40, 40, color.White), tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := images[0]
+		// JPEG can't carry the transparency
+		if img.Name != "photo.png" {
+			t.Errorf("%s: named %s, want photo.png", tt.name, img.Name)
+		}
+		data, _ := encode(t, &img, tt.options)
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range tt.opaque {
+			if a := alphaAt(decoded, p[0], p[1]); a != 255 {
+				t.Errorf("%s: the alpha at %v is %d, want opaque", tt.name, p, a)
+			}
+		}
+		for _, p := range tt.transparent {
+			if a := alphaAt(decoded, p[0], p[1]); a != 0 {
+				t.Errorf("%s: the alpha at %v is %d, want transparent", tt.name, p, a)
+			}
+		}
+	}
+
+	// the edge is anti-aliased
+	edge := mask(fill(40, 40, color.White), 10, false)
+	partial := false
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if a := alphaAt(edge, x, y); a > 0 && a < 255 {
+				partial = true
+			}
+		}
+	}
+	if !partial {
+		t.Errorf("the rounded corner has no partially transparent pixels")
+	}
+
+	for _, options := range []*Options{
+		{Circle: true, Format: "jpeg"},
+		{RoundCorners: 4, Thumbnails: []Thumb{{Suffix: "-small", Width: 10, Format: "jpeg"}}},
+		{RoundCorners: 4, ColorModel: "rgb"},
+		{RoundCorners: -1},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%+v was accepted", options)
+		}
+	}
+}
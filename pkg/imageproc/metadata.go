@@ -0,0 +1,236 @@
+package imageproc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// The standard library encoders write no metadata, so it is injected into the
+// encoded JPEG segments / PNG chunks afterwards.
+
+var (
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+	iccJPEGPrefix  = []byte("ICC_PROFILE\x00")
+	errInvalidJPEG = errors.New("invalid jpeg stream")
+	errInvalidPNG  = errors.New("invalid png stream")
+)
+
+const (
+	jpegSOI  = 0xd8
+	jpegSOS  = 0xda
+	jpegAPP0 = 0xe0
+	jpegAPP2 = 0xe2
+	// a JPEG segment holds at most 65535 bytes, including its 2 length bytes
+	maxJPEGSegment = 65533
+)
+
+// extractICC returns the ICC profile embedded in a JPEG or PNG, or nil.
+func extractICC(data []byte) []byte {
+	if bytes.HasPrefix(data, pngSignature) {
+		return extractPNGICC(data)
+	}
+	if len(data) > 2 && data[0] == 0xff && data[1] == jpegSOI {
+		return extractJPEGICC(data)
+	}
+	return nil
+}
+
+func extractJPEGICC(data []byte) []byte {
+	chunks := map[byte][]byte{}
+	var count byte
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return nil
+		}
+		marker := data[pos+1]
+		if marker == jpegSOS {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		payload := data[pos+4 : end]
+		if marker == jpegAPP2 && bytes.HasPrefix(payload, iccJPEGPrefix) && len(payload) > len(iccJPEGPrefix)+2 {
+			seq := payload[len(iccJPEGPrefix)]
+			count = payload[len(iccJPEGPrefix)+1]
+			chunks[seq] = payload[len(iccJPEGPrefix)+2:]
+		}
+		pos = end
+	}
+
+	// the chunks are numbered from 1
+	var profile []byte
+	for seq := byte(1); seq <= count; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+func extractPNGICC(data []byte) []byte {
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == "iCCP" {
+			// profile name, 0 separator, compression method, zlib stream
+			chunk := data[pos+8 : pos+8+length]
+			sep := bytes.IndexByte(chunk, 0)
+			if sep < 0 || sep+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos = end
+	}
+	return nil
+}
+
+// extractDate returns the DateTimeOriginal (or DateTime) EXIF tag of JPEG and
+// TIFF data, zero when there is none.
+func extractDate(data []byte) time.Time {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return time.Time{}
+	}
+	date, err := x.DateTime()
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// embedICC inserts the ICC profile into an encoded JPEG or PNG. Other formats
+// are returned unchanged.
+func embedICC(encoded []byte, format imaging.Format, profile []byte) ([]byte, error) {
+	switch format {
+	case imaging.JPEG:
+		var segments [][]byte
+		chunkSize := maxJPEGSegment - len(iccJPEGPrefix) - 2
+		count := (len(profile) + chunkSize - 1) / chunkSize
+		if count > 255 {
+			return nil, errors.New("icc profile too large")
+		}
+		for i := 0; i < count; i++ {
+			chunk := profile[i*chunkSize : min((i+1)*chunkSize, len(profile))]
+			payload := append(append([]byte{}, iccJPEGPrefix...), byte(i+1), byte(count))
+			segments = append(segments, append(payload, chunk...))
+		}
+		return insertJPEGSegments(encoded, jpegAPP2, segments)
+	case imaging.PNG:
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(profile)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		chunk := append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...)
+		return insertPNGChunk(encoded, "iCCP", chunk)
+	}
+	return encoded, nil
+}
+
+// embedDPI sets the resolution of an encoded JPEG, with a JFIF APP0 segment, or
+// PNG, with a pHYs chunk. Other formats are returned unchanged.
+func embedDPI(encoded []byte, format imaging.Format, dpi int) ([]byte, error) {
+	switch format {
+	case imaging.JPEG:
+		// libjpeg already writes a JFIF segment, only its density is updated:
+		// SOI, APP0 marker, length, JFIF\x00, version, then units and densities
+		if len(encoded) > 18 && encoded[2] == 0xff && encoded[3] == jpegAPP0 && string(encoded[6:11]) == "JFIF\x00" {
+			result := append([]byte{}, encoded...)
+			result[13] = 1
+			binary.BigEndian.PutUint16(result[14:], uint16(dpi))
+			binary.BigEndian.PutUint16(result[16:], uint16(dpi))
+			return result, nil
+		}
+		// version 1.02, density in dots per inch, no thumbnail
+		payload := []byte("JFIF\x00\x01\x02\x01")
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dpi))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(dpi))
+		payload = append(payload, 0, 0)
+		return insertJPEGSegments(encoded, jpegAPP0, [][]byte{payload})
+	case imaging.PNG:
+		// pHYs is in pixels per meter
+		ppm := uint32(math.Round(float64(dpi) / 0.0254))
+		chunk := binary.BigEndian.AppendUint32(nil, ppm)
+		chunk = binary.BigEndian.AppendUint32(chunk, ppm)
+		chunk = append(chunk, 1)
+		return insertPNGChunk(encoded, "pHYs", chunk)
+	}
+	return encoded, nil
+}
+
+// insertJPEGSegments adds the segments right after the SOI marker, or after
+// the JFIF APP0 segment, which has to come first, when there is one.
+func insertJPEGSegments(encoded []byte, marker byte, payloads [][]byte) ([]byte, error) {
+	if len(encoded) < 2 || encoded[0] != 0xff || encoded[1] != jpegSOI {
+		return nil, errInvalidJPEG
+	}
+	pos := 2
+	if len(encoded) > 6 && encoded[2] == 0xff && encoded[3] == jpegAPP0 {
+		pos += 2 + int(binary.BigEndian.Uint16(encoded[4:]))
+		if pos > len(encoded) {
+			return nil, errInvalidJPEG
+		}
+	}
+	var out bytes.Buffer
+	out.Write(encoded[:pos])
+	for _, payload := range payloads {
+		if len(payload) > maxJPEGSegment {
+			return nil, errors.New("jpeg segment too large")
+		}
+		out.Write([]byte{0xff, marker})
+		binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+		out.Write(payload)
+	}
+	out.Write(encoded[pos:])
+	return out.Bytes(), nil
+}
+
+// insertPNGChunk adds the chunk right after the IHDR chunk.
+func insertPNGChunk(encoded []byte, chunkType string, data []byte) ([]byte, error) {
+	// signature, then IHDR: length, type, 13 bytes of data and crc
+	ihdrEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if !bytes.HasPrefix(encoded, pngSignature) || len(encoded) < ihdrEnd ||
+		string(encoded[len(pngSignature)+4:len(pngSignature)+8]) != "IHDR" {
+		return nil, errInvalidPNG
+	}
+
+	var out bytes.Buffer
+	out.Write(encoded[:ihdrEnd])
+	binary.Write(&out, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	out.WriteString(chunkType)
+	out.Write(data)
+	binary.Write(&out, binary.BigEndian, crc.Sum32())
+	out.Write(encoded[ihdrEnd:])
+	return out.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// testProfile returns a fake ICC profile of n bytes.
+func testProfile(n int) []byte {
+	profile := make([]byte, n)
+	for i := range profile {
+		profile[i] = byte(i * 7)
+	}
+	return profile
+}
+
+func TestPreserveICC(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, fill(16, 16, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	// split over two APP2 segments
+	profile := testProfile(70000)
+	data, err := embedICC(buf.Bytes(), imaging.JPEG, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"jpeg", "png"} {
+		options := &Options{PreserveICC: true, Format: format, Thumbnails: []Thumb{{Suffix: "-small", Width: 8}}}
+		src, err := Decode(bytes.NewReader(data), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images, err := src.Process("photo.jpg", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range images {
+			encoded, _ := encode(t, &img, options)
+			if !bytes.Equal(extractICC(encoded), profile) {
+				t.Errorf("%s lost the profile", img.Name)
+			}
+		}
+	}
+
+	for _, options := range []*Options{{}, {PreserveICC: true, StripMetadata: true}} {
+		src, err := Decode(bytes.NewReader(data), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.ICC != nil {
+			t.Errorf("preserveICC %v, stripMetadata %v kept the profile", options.PreserveICC, options.StripMetadata)
+		}
+	}
+}
+
+// pngChunk returns the data of the first chunk of the type in a PNG.
+func pngChunk(t *testing.T, data []byte, chunkType string) []byte {
+	t.Helper()
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+n > len(data) {
+			t.Fatalf("truncated %s chunk", data[pos+4:pos+8])
+		}
+		if string(data[pos+4:pos+8]) == chunkType {
+			return data[pos+8 : pos+8+n]
+		}
+		pos += 12 + n
+	}
+	return nil
+}
+
+func TestEncodeDPI(t *testing.T) {
+	img := &ProcessedImage{Name: "photo.png", Image: fill(8, 8, color.White), ICC: testProfile(100)}
+	data, _ := encode(t, img, &Options{DPI: 300})
+	phys := pngChunk(t, data, "pHYs")
+	// 300 dpi is 11811 pixels per meter
+	if len(phys) != 9 || binary.BigEndian.Uint32(phys) != 11811 || binary.BigEndian.Uint32(phys[4:]) != 11811 || phys[8] != 1 {
+		t.Errorf("got the pHYs chunk %v, want 11811 pixels per meter", phys)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decoding the PNG: %s", err)
+	}
+	data, _ = encode(t, img, &Options{})
+	if phys := pngChunk(t, data, "pHYs"); phys != nil {
+		t.Errorf("a pHYs chunk was written without a dpi")
+	}
+
+	img.Name = "photo.jpg"
+	data, _ = encode(t, img, &Options{DPI: 300})
+	// the JFIF segment comes first, the density is in dots per inch
+	if len(data) < 18 || data[3] != jpegAPP0 || string(data[6:11]) != "JFIF\x00" ||
+		data[13] != 1 || binary.BigEndian.Uint16(data[14:]) != 300 || binary.BigEndian.Uint16(data[16:]) != 300 {
+		t.Errorf("the JPEG doesn't start with a 300 dpi JFIF segment: % x", data[:min(len(data), 18)])
+	}
+	if !bytes.Equal(extractICC(data), img.ICC) {
+		t.Errorf("the JPEG lost the profile")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("decoding the JPEG: %s", err)
+	}
+
+	for _, dpi := range []int{-1, 65536} {
+		if err := (&Options{DPI: dpi}).Validate(); err == nil || !strings.Contains(err.Error(), "dpi") {
+			t.Errorf("dpi %d: got %v, want an error about the dpi", dpi, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !heif
+
+package imageproc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHEIFRequiresTheTag(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testHEIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHEIF(data) {
+		t.Fatalf("the HEIC isn't recognized")
+	}
+	_, err = Decode(bytes.NewReader(data), &Options{})
+	if err == nil || !strings.Contains(err.Error(), "-tags heif") {
+		t.Errorf("got %v, want an error naming the heif tag", err)
+	}
+}
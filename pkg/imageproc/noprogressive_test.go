@@ -0,0 +1,17 @@
+//go:build !libjpeg
+
+package imageproc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeProgressiveJPEGRequiresTheTag(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Encode(&buf, &ProcessedImage{Name: "photo.jpg", Image: noise(8, 8)}, &Options{Progressive: true})
+	if err == nil || !strings.Contains(err.Error(), "-tags libjpeg") {
+		t.Errorf("got %v, want an error naming the libjpeg tag", err)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !webp
+
+package imageproc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeWebPRequiresTheTag(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Encode(&buf, &ProcessedImage{Name: "photo.webp", Image: noise(8, 8)}, &Options{})
+	if err == nil || !strings.Contains(err.Error(), "-tags webp") {
+		t.Errorf("got %v, want an error naming the webp tag", err)
+	}
+}
+
+func TestEncodeAnimatedWebPRequiresTheTag(t *testing.T) {
+	options := &Options{Format: "webp"}
+	src, err := Decode(bytes.NewReader(testGIF(t, 20, 10, 3)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("anim.gif", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := Encode(&buf, &images[0], options); err == nil || !strings.Contains(err.Error(), "-tags webp") {
+		t.Errorf("got %v, want an error naming the webp tag", err)
+	}
+}
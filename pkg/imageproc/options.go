@@ -0,0 +1,566 @@
+package imageproc
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Options describes how an image is processed and which thumbnails are
+// generated from it. The JSON form is the one accepted by the Web API.
+type Options struct {
+	// AutoOrient applies the EXIF orientation when opening the source. Default: true
+	AutoOrient *bool `json:"autoOrient,omitempty"`
+	// SaveOriginal writes the uploaded image to the storage as {base}-original{ext} (API only).
+	// Otherwise the upload is decoded in memory.
+	SaveOriginal bool `json:"saveOriginal,omitempty"`
+	// Page selects the page of multi-page TIFF sources, starting at 0
+	Page int `json:"page,omitempty"`
+	// OrientOriginal also overwrites the saved original with the oriented image (API only)
+	OrientOriginal bool `json:"orientOriginal,omitempty"`
+	// StripMetadata re-encodes the saved original instead of keeping the uploaded bytes.
+	// Processed images are always re-encoded and never carry the source metadata.
+	// It also disables PreserveICC.
+	StripMetadata bool    `json:"stripMetadata,omitempty"`
+	FlipH         bool    `json:"flipH,omitempty"`
+	FlipV         bool    `json:"flipV,omitempty"`
+	Transpose     bool    `json:"transpose,omitempty"`
+	Transverse    bool    `json:"transverse,omitempty"`
+	Trim          Trim    `json:"trim,omitempty"`
+	Crop          Crop    `json:"crop,omitempty"`
+	Rotate        float64 `json:"rotate,omitempty"`
+	// RotateKeepSize center-crops the rotated image back to the size before the
+	// rotation instead of expanding the canvas, padding the sides it made shorter
+	// with Fill. The crop step runs after the rotation, so its coordinates refer
+	// to the image of the original size.
+	RotateKeepSize bool   `json:"rotateKeepSize,omitempty"`
+	Fill           string `json:"fill,omitempty"`
+	// FlattenColor is the background transparent areas are composited over when
+	// encoding to a format without alpha, in the format of Fill. Default: white
+	FlattenColor string `json:"flattenColor,omitempty"`
+	Grayscale    bool   `json:"grayscale,omitempty"`
+	Resize       Resize `json:"resize,omitempty"`
+	// ColorModel converts the source, and the outputs, to "rgba", "rgb" (opaque,
+	// transparent areas over FlattenColor) or "gray", e.g. for CMYK JPEG or
+	// grayscale sources. Default: the outputs keep the model of the processing
+	ColorModel string `json:"colorModel,omitempty"`
+	// Brightness, Contrast and Saturation are percentages in the range -100 to 100. 0 is a no-op
+	Brightness float64 `json:"brightness,omitempty"`
+	Contrast   float64 `json:"contrast,omitempty"`
+	Saturation float64 `json:"saturation,omitempty"`
+	// Gamma must be positive. 0 and 1 are a no-op
+	Gamma float64 `json:"gamma,omitempty"`
+	// Blur and Sharpen are the sigma of the respective filter. 0 disables it
+	Blur    float64 `json:"blur,omitempty"`
+	Sharpen float64 `json:"sharpen,omitempty"`
+	// Caption draws a text label after the adjustments, see Caption
+	Caption Caption `json:"caption,omitempty"`
+	// RoundCorners is the radius, in pixels, of the transparent rounded corners
+	// applied after the adjustments. Circle masks everything outside the ellipse
+	// inscribed in the image instead, a circle for square images e.g. avatars.
+	// Masked images are saved as PNG unless Format supports transparency
+	RoundCorners int     `json:"roundCorners,omitempty"`
+	Circle       bool    `json:"circle,omitempty"`
+	Thumbnails   []Thumb `json:"thumbnails,omitempty"`
+	// Widths adds a thumbnail per width keeping the aspect ratio, suffixed with
+	// the width, e.g. -320w, for srcset generation
+	Widths []int `json:"widths,omitempty"`
+	// Crops produces one output per crop, suffixed with its position starting
+	// at 1, e.g. -crop1, instead of the single Crop. Each output goes through the
+	// rest of the processing, resizing and thumbnails included. The first output
+	// of the first crop is then the formatted image of the API response
+	Crops []Crop `json:"crops,omitempty"`
+	// SkipPrimary only produces the thumbnails, dropping the formatted image.
+	// It requires at least one thumbnail.
+	SkipPrimary bool `json:"skipPrimary,omitempty"`
+	// NameTemplate names the thumbnails, e.g. {base}_{width}x{height}{ext}.
+	// Supports {base}, {ext}, {suffix}, {width} and {height}. Default: {base}{suffix}{ext}
+	// Source.Process also replaces {date:layout}, e.g. {date:2006-01-02}, with the
+	// EXIF capture date formatted with the time layout, or "unknown". The names
+	// stay next to the image, a template must not contain a path separator or ".."
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// Blurhash adds a BlurHash placeholder of the first output to the API response
+	// and the CLI manifest, see Blurhash
+	Blurhash bool `json:"blurhash,omitempty"`
+	// PHash adds the perceptual hash of the first output to the API response and
+	// the CLI manifest, for near-duplicate detection, see PHash
+	PHash bool `json:"phash,omitempty"`
+	// ExtractColors adds that many dominant colors (up to 256) of the first output
+	// to the API response and the CLI manifest, see DominantColors
+	ExtractColors int `json:"extractColors,omitempty"`
+	// PreserveICC copies the ICC color profile of JPEG and PNG sources into JPEG and PNG outputs.
+	// It is ignored when StripMetadata is set.
+	PreserveICC bool `json:"preserveICC,omitempty"`
+	// Quality is the JPEG and WebP quality (1-100). 0 uses the library default
+	Quality int `json:"quality,omitempty"`
+	// MaxBytes lowers the JPEG and WebP quality, down to 10, until the output fits
+	// into that many bytes. 0 disables the budget
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// DPI sets the resolution metadata of JPEG and PNG outputs. 0 leaves it unset
+	DPI int `json:"dpi,omitempty"`
+	// Progressive encodes JPEG outputs as progressive JPEGs, which render gradually
+	// on slow connections and are usually a bit smaller for large images, at the
+	// cost of slower encoding and decoding. Requires building with -tags libjpeg (cgo)
+	Progressive bool `json:"progressive,omitempty"`
+	// PNGCompression is one of "none", "fast", "default" or "best".
+	// It only applies to .png outputs and is ignored for other formats.
+	PNGCompression string `json:"pngCompression,omitempty"`
+	// Palette quantizes PNG outputs to an indexed image of at most that many colors
+	// (2-256), and limits the colors of GIF outputs. 0 keeps the full colors
+	Palette int `json:"palette,omitempty"`
+	// Format overrides the output format implied by the name's extension:
+	// jpeg, png, gif, tiff, bmp or webp (requires building with -tags webp)
+	Format string `json:"format,omitempty"`
+	// Formats encodes every output in each of the formats, in the format of
+	// Format, e.g. ["jpeg", "webp"] for photo.jpg and photo.webp. The images are
+	// processed once and shared by the encoders. It overrides Format and the
+	// formats of the thumbnails
+	Formats []string `json:"formats,omitempty"`
+}
+
+// Validate checks the option values that don't depend on the image.
+func (o *Options) Validate() error {
+	if o.DPI < 0 || o.DPI > 65535 {
+		return fmt.Errorf("dpi must be 0 (unset) or 1-65535, got %d", o.DPI)
+	}
+	if o.Page < 0 {
+		return fmt.Errorf("page must not be negative, got %d", o.Page)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("quality must be between 1 and 100, got %d", o.Quality)
+	}
+	for _, adj := range []struct {
+		name  string
+		value float64
+	}{{"brightness", o.Brightness}, {"contrast", o.Contrast}, {"saturation", o.Saturation}} {
+		if adj.value < -100 || adj.value > 100 {
+			return fmt.Errorf("%s must be between -100 and 100, got %f", adj.name, adj.value)
+		}
+	}
+	if o.Gamma < 0 {
+		return fmt.Errorf("gamma must be positive, got %f", o.Gamma)
+	}
+	if o.Blur < 0 {
+		return fmt.Errorf("blur must not be negative, got %f", o.Blur)
+	}
+	if o.Sharpen < 0 {
+		return fmt.Errorf("sharpen must not be negative, got %f", o.Sharpen)
+	}
+	if err := o.Caption.validate(); err != nil {
+		return err
+	}
+	switch strings.ToLower(o.ColorModel) {
+	case "", "rgba":
+	case "rgb", "gray":
+		if o.masked() {
+			return fmt.Errorf("roundCorners and circle need transparency, color model %q has none", o.ColorModel)
+		}
+	default:
+		return fmt.Errorf("unknown color model %q, expected rgba, rgb or gray", o.ColorModel)
+	}
+	if o.RoundCorners < 0 {
+		return fmt.Errorf("roundCorners must not be negative, got %d", o.RoundCorners)
+	}
+	if o.masked() && !carriesAlpha(o.Format) {
+		return fmt.Errorf("roundCorners and circle need a format with transparency, got %q", o.Format)
+	}
+	if o.Trim.Tolerance < 0 || o.Trim.Tolerance > 255 {
+		return fmt.Errorf("trim.tolerance must be between 0 and 255, got %d", o.Trim.Tolerance)
+	}
+	for field, c := range map[string]string{
+		"fill":               o.Fill,
+		"flattenColor":       o.FlattenColor,
+		"trim.color":         o.Trim.Color,
+		"resize.background":  o.Resize.Background,
+		"caption.color":      o.Caption.Color,
+		"caption.background": o.Caption.Background,
+	} {
+		if _, err := parseColor(c); err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+	if o.Crop.AspectRatio != "" {
+		if _, _, err := parseAspectRatio(o.Crop.AspectRatio); err != nil {
+			return err
+		}
+	}
+	for i, c := range o.Crops {
+		if c.AspectRatio != "" {
+			if _, _, err := parseAspectRatio(c.AspectRatio); err != nil {
+				return fmt.Errorf("crops[%d]: %v", i, err)
+			}
+		} else if c.Width <= 0 || c.Height <= 0 {
+			return fmt.Errorf("crops[%d].width and crops[%d].height must be positive, got %dx%d", i, i, c.Width, c.Height)
+		}
+	}
+	if o.Resize.Scale < 0 {
+		return fmt.Errorf("resize.scale must be greater than 0, got %v", o.Resize.Scale)
+	}
+	if o.Resize.MaxWidth < 0 || o.Resize.MaxHeight < 0 {
+		return fmt.Errorf("resize.maxWidth and resize.maxHeight must not be negative, got %dx%d", o.Resize.MaxWidth, o.Resize.MaxHeight)
+	}
+	if _, err := o.Resize.filter(); err != nil {
+		return err
+	}
+	if o.ExtractColors < 0 || o.ExtractColors > 256 {
+		return fmt.Errorf("extractColors must be between 0 and 256, got %d", o.ExtractColors)
+	}
+	if o.MaxBytes < 0 {
+		return fmt.Errorf("maxBytes must not be negative, got %d", o.MaxBytes)
+	}
+	if o.Palette != 0 && (o.Palette < 2 || o.Palette > 256) {
+		return fmt.Errorf("palette must be between 2 and 256 colors, got %d", o.Palette)
+	}
+	if _, ok := pngCompressionLevels[strings.ToLower(o.PNGCompression)]; !ok && o.PNGCompression != "" {
+		return fmt.Errorf("unknown png compression %q", o.PNGCompression)
+	}
+	if _, ok := formatExtensions[strings.ToLower(o.Format)]; !ok && o.Format != "" {
+		return fmt.Errorf("unknown format %q", o.Format)
+	}
+	for i, f := range o.Formats {
+		if _, ok := formatExtensions[strings.ToLower(f)]; !ok {
+			return fmt.Errorf("formats[%d]: unknown format %q", i, f)
+		}
+		if o.masked() && !carriesAlpha(f) {
+			return fmt.Errorf("formats[%d]: roundCorners and circle need a format with transparency, got %q", i, f)
+		}
+	}
+	for _, w := range o.Widths {
+		if w <= 0 {
+			return fmt.Errorf("widths must be positive, got %d", w)
+		}
+	}
+	if err := checkName("nameTemplate", o.NameTemplate); err != nil {
+		return err
+	}
+	if o.SkipPrimary && len(o.thumbnails()) == 0 {
+		return errors.New("skipPrimary requires at least one thumbnail")
+	}
+	for i, t := range o.Thumbnails {
+		if t.Quality < 0 || t.Quality > 100 {
+			return fmt.Errorf("thumbnails[%d].quality must be between 1 and 100, got %d", i, t.Quality)
+		}
+		if err := checkName(fmt.Sprintf("thumbnails[%d].nameTemplate", i), t.NameTemplate); err != nil {
+			return err
+		}
+		if err := checkName(fmt.Sprintf("thumbnails[%d].suffix", i), t.Suffix); err != nil {
+			return err
+		}
+		if t.MaxBytes < 0 {
+			return fmt.Errorf("thumbnails[%d].maxBytes must not be negative, got %d", i, t.MaxBytes)
+		}
+		if _, ok := formatExtensions[strings.ToLower(t.Format)]; !ok && t.Format != "" {
+			return fmt.Errorf("thumbnails[%d]: unknown format %q", i, t.Format)
+		}
+		if o.masked() && !carriesAlpha(t.Format) {
+			return fmt.Errorf("thumbnails[%d]: roundCorners and circle need a format with transparency, got %q", i, t.Format)
+		}
+	}
+	return nil
+}
+
+// checkName rejects a name template or suffix with a path separator or "..",
+// which would place the output outside the directory of the image.
+func checkName(field string, name string) error {
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return fmt.Errorf("%s must not contain a path separator or \"..\", got %q", field, name)
+	}
+	return nil
+}
+
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"jpg":  ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"tiff": ".tiff",
+	"tif":  ".tiff",
+	"bmp":  ".bmp",
+	"webp": ".webp",
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// EncodeOptions returns the imaging encoder options for the quality and PNG compression.
+func (o *Options) EncodeOptions() []imaging.EncodeOption {
+	var opts []imaging.EncodeOption
+	if o.Quality > 0 {
+		opts = append(opts, imaging.JPEGQuality(o.Quality))
+	}
+	// imaging only uses the compression level when encoding PNGs
+	if level, ok := pngCompressionLevels[strings.ToLower(o.PNGCompression)]; ok {
+		opts = append(opts, imaging.PNGCompressionLevel(level))
+	}
+	if o.Palette > 0 {
+		opts = append(opts, imaging.GIFNumColors(o.Palette))
+	}
+	return opts
+}
+
+// ShouldAutoOrient reports whether the EXIF orientation is applied, which is
+// the default when AutoOrient is unset.
+func (o *Options) ShouldAutoOrient() bool {
+	return o.AutoOrient == nil || *o.AutoOrient
+}
+
+// Trim removes the uniform borders of the image, e.g. the white margin of a scan.
+type Trim struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Tolerance is the maximum difference of every channel (0-255) of a border
+	// pixel to the border color
+	Tolerance int `json:"tolerance,omitempty"`
+	// Color is the border color, in the format of Options.Fill. Default: the top left pixel
+	Color string `json:"color,omitempty"`
+}
+
+type Crop struct {
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Anchor crops Width x Height relative to the given position (center, top, topleft...)
+	// and ignores X and Y. Empty means absolute cropping.
+	Anchor string `json:"anchor,omitempty"`
+	// Unit is "px" (default) or "percent", in which case X, Y, Width and Height
+	// are 0-100 percentages of the image size
+	Unit string `json:"unit,omitempty"`
+	// AspectRatio, e.g. "16:9", crops the largest rectangle of that ratio,
+	// positioned by Anchor (default: center). X, Y, Width, Height and Unit are ignored.
+	AspectRatio string `json:"aspectRatio,omitempty"`
+}
+
+// parseAspectRatio parses a "width:height" ratio such as 16:9 or 1.85:1.
+func parseAspectRatio(ratio string) (float64, float64, error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected width:height", ratio)
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errW != nil || errH != nil || !(w > 0) || !(h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected positive width:height", ratio)
+	}
+	return w, h, nil
+}
+
+// fromAspectRatio returns the largest crop of the AspectRatio fitting in the image.
+func (c *Crop) fromAspectRatio(img image.Image) (*Crop, error) {
+	rw, rh, err := parseAspectRatio(c.AspectRatio)
+	if err != nil {
+		return nil, err
+	}
+	size := img.Bounds().Size()
+	w, h := size.X, int(math.Round(float64(size.X)*rh/rw))
+	if h > size.Y {
+		w, h = int(math.Round(float64(size.Y)*rw/rh)), size.Y
+	}
+	anchor := c.Anchor
+	if anchor == "" {
+		anchor = "center"
+	}
+	return &Crop{Width: max(1, w), Height: max(1, h), Anchor: anchor}, nil
+}
+
+// toPixels returns the crop converted to pixels against the image size.
+func (c *Crop) toPixels(img image.Image) (*Crop, error) {
+	if c.AspectRatio != "" {
+		return c.fromAspectRatio(img)
+	}
+	switch strings.ToLower(c.Unit) {
+	case "", "px":
+		return c, nil
+	case "percent", "%":
+	default:
+		return nil, fmt.Errorf("unknown crop unit %q", c.Unit)
+	}
+
+	for _, v := range []int{c.X, c.Y, c.Width, c.Height} {
+		if v < 0 || v > 100 {
+			return nil, fmt.Errorf("crop percentages must be between 0 and 100, got %d", v)
+		}
+	}
+	if c.X+c.Width > 100 || c.Y+c.Height > 100 {
+		return nil, fmt.Errorf("crop rectangle exceeds the image bounds")
+	}
+
+	size := img.Bounds().Size()
+	px := *c
+	px.Unit = "px"
+	px.X = size.X * c.X / 100
+	px.Y = size.Y * c.Y / 100
+	px.Width = size.X * c.Width / 100
+	px.Height = size.Y * c.Height / 100
+	return &px, nil
+}
+
+func (c *Crop) shouldCrop(img image.Image) bool {
+	size := img.Bounds().Size()
+	if c.Anchor != "" {
+		return c.Width > 0 && c.Height > 0 && (c.Width != size.X || c.Height != size.Y)
+	}
+	return c.X != 0 || c.Y != 0 ||
+		(c.Width > 0 && c.Height > 0 && (c.Width != size.X || c.Height != size.Y))
+}
+
+type Resize struct {
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Scale resizes to a fraction of the source size, e.g. 0.5 for half of it.
+	// When set it overrides Width and Height. Scaling up requires AllowUpscale
+	Scale float64 `json:"scale,omitempty"`
+	// MaxWidth and MaxHeight bound the image after the other resizing: a larger
+	// image is scaled down to fit, keeping its aspect ratio, a smaller one passes
+	// through. 0 leaves the dimension unbounded
+	MaxWidth  int `json:"maxWidth,omitempty"`
+	MaxHeight int `json:"maxHeight,omitempty"`
+	// Mode is one of "exact" (default), "fit", "fill" or "pad". Pad fits the image
+	// inside Width x Height and centers it on a canvas of exactly that size
+	Mode string `json:"mode,omitempty"`
+	// Background is the canvas color of the "pad" mode, in the format of Options.Fill.
+	// Default: transparent, or white for JPEG outputs
+	Background string `json:"background,omitempty"`
+	// Anchor is used by the "fill" mode. Default: center
+	Anchor string `json:"anchor,omitempty"`
+	// Smart makes the "fill" mode keep the window with the most detail instead of
+	// the one at the Anchor, e.g. the subject of a portrait
+	Smart bool `json:"smart,omitempty"`
+	// AllowUpscale allows resizing beyond the source size. By default the target
+	// is shrunk to fit the source, keeping its aspect ratio. Thumbnails inherit it.
+	AllowUpscale bool `json:"allowUpscale,omitempty"`
+	// Filter is the resample filter: lanczos (default), catmullrom, linear, box, nearest...
+	// Thumbnails are resized with the same filter.
+	Filter string `json:"filter,omitempty"`
+}
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":           imaging.Lanczos,
+	"catmullrom":        imaging.CatmullRom,
+	"mitchellnetravali": imaging.MitchellNetravali,
+	"linear":            imaging.Linear,
+	"box":               imaging.Box,
+	"nearest":           imaging.NearestNeighbor,
+	"hermite":           imaging.Hermite,
+	"bspline":           imaging.BSpline,
+	"gaussian":          imaging.Gaussian,
+	"bartlett":          imaging.Bartlett,
+	"hann":              imaging.Hann,
+	"hamming":           imaging.Hamming,
+	"blackman":          imaging.Blackman,
+	"welch":             imaging.Welch,
+	"cosine":            imaging.Cosine,
+}
+
+func (r *Resize) filter() (imaging.ResampleFilter, error) {
+	if r.Filter == "" {
+		return imaging.Lanczos, nil
+	}
+	filter, ok := resampleFilters[strings.ToLower(r.Filter)]
+	if !ok {
+		return imaging.Lanczos, fmt.Errorf("unknown resize filter %q", r.Filter)
+	}
+	return filter, nil
+}
+
+type Thumb struct {
+	Suffix string `json:"suffix,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// NameTemplate overrides Options.NameTemplate for this thumbnail
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// Square crops a square of min(Width, Height) before resizing, positioned by
+	// Anchor, or by the detail of the image with Smart
+	Square bool   `json:"square,omitempty"`
+	Anchor string `json:"anchor,omitempty"`
+	Smart  bool   `json:"smart,omitempty"`
+	// Format, Quality and MaxBytes override the options of the same name for this thumbnail
+	Format   string `json:"format,omitempty"`
+	Quality  int    `json:"quality,omitempty"`
+	MaxBytes int    `json:"maxBytes,omitempty"`
+}
+
+// thumbnails returns the Thumbnails followed by the thumbnails of the Widths.
+func (o *Options) thumbnails() []Thumb {
+	if len(o.Widths) == 0 {
+		return o.Thumbnails
+	}
+	thumbs := append([]Thumb{}, o.Thumbnails...)
+	for _, w := range o.Widths {
+		thumbs = append(thumbs, Thumb{Suffix: "-" + strconv.Itoa(w) + "w", Width: w})
+	}
+	return thumbs
+}
+
+func (t *Thumb) resizeOptions(parent *Resize) *Resize {
+	r := &Resize{
+		Width:        t.Width,
+		Height:       t.Height,
+		Filter:       parent.Filter,
+		AllowUpscale: parent.AllowUpscale,
+	}
+	if t.Square {
+		side := t.Width
+		if side == 0 || (t.Height != 0 && t.Height < side) {
+			side = t.Height
+		}
+		r.Width, r.Height = side, side
+		r.Mode = "fill"
+		r.Anchor = t.Anchor
+		r.Smart = t.Smart
+	}
+	return r
+}
+
+var anchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"topleft":     imaging.TopLeft,
+	"top":         imaging.Top,
+	"topright":    imaging.TopRight,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"bottomleft":  imaging.BottomLeft,
+	"bottom":      imaging.Bottom,
+	"bottomright": imaging.BottomRight,
+}
+
+// ParseAnchor returns the imaging anchor named center, top, topleft, bottomright...
+// An empty name is the center.
+func ParseAnchor(name string) (imaging.Anchor, error) {
+	if name == "" {
+		return imaging.Center, nil
+	}
+	anchor, ok := anchors[strings.ToLower(name)]
+	if !ok {
+		return imaging.Center, fmt.Errorf("unknown anchor %q", name)
+	}
+	return anchor, nil
+}
+
+// usesDate reports whether a name template contains a {date:layout} token.
+func (o *Options) usesDate() bool {
+	if strings.Contains(o.NameTemplate, "{date:") {
+		return true
+	}
+	for _, t := range o.Thumbnails {
+		if strings.Contains(t.NameTemplate, "{date:") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFill parses a color option, see parseColor.
+func ParseFill(fill string) (color.Color, error) {
+	return parseColor(fill)
+}
@@ -0,0 +1,87 @@
+package imageproc
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestParseFill(t *testing.T) {
+	for fill, want := range map[string]color.Color{
+		"":          color.Transparent,
+		"t":         color.Transparent,
+		"b":         color.Black,
+		"w":         color.White,
+		"#ff8000":   color.NRGBA{R: 0xff, G: 0x80, A: 0xff},
+		"FF8000":    color.NRGBA{R: 0xff, G: 0x80, A: 0xff},
+		"#00ff0080": color.NRGBA{G: 0xff, A: 0x80},
+	} {
+		got, err := ParseFill(fill)
+		if err != nil {
+			t.Errorf("ParseFill(%q): %s", fill, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseFill(%q) = %v, want %v", fill, got, want)
+		}
+	}
+	for _, fill := range []string{"#fff", "#gg0000", "#ff00000", "nocolor"} {
+		if _, err := ParseFill(fill); err == nil {
+			t.Errorf("ParseFill(%q) didn't fail", fill)
+		}
+	}
+}
+
+func TestRotateFill(t *testing.T) {
+	src := fill(100, 100, color.White)
+	img, err := Rotate(src, 45, "#ff0000", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the uncovered corner
+	if r, g, b, a := img.At(0, 0).RGBA(); r>>8 != 0xff || g != 0 || b != 0 || a>>8 != 0xff {
+		t.Errorf("the corner is %v, want the fill color", img.At(0, 0))
+	}
+	if _, err := Rotate(src, 45, "#ff00", false); err == nil {
+		t.Error("an invalid fill didn't fail")
+	}
+}
+
+func TestParseColorNames(t *testing.T) {
+	for name, want := range map[string]color.Color{
+		"red":            color.NRGBA{R: 0xff, A: 0xff},
+		"cornflowerblue": color.NRGBA{R: 0x64, G: 0x95, B: 0xed, A: 0xff},
+		"RebeccaPurple":  color.NRGBA{R: 0x66, G: 0x33, B: 0x99, A: 0xff},
+		" navy ":         color.NRGBA{B: 0x80, A: 0xff},
+		"transparent":    color.Transparent,
+	} {
+		got, err := parseColor(name)
+		if err != nil {
+			t.Errorf("parseColor(%q): %s", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseColor(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	for _, options := range []*Options{
+		{Fill: "reddish"},
+		{FlattenColor: "cornflower"},
+		{Trim: Trim{Enabled: true, Color: "grey50"}},
+		{Resize: Resize{Width: 10, Height: 10, Mode: "pad", Background: "nocolor"}},
+	} {
+		if err := options.Validate(); err == nil || !strings.Contains(err.Error(), "invalid color") {
+			t.Errorf("%+v: got %v, want an invalid color", options, err)
+		}
+	}
+
+	// a named pad background
+	img, err := (&Resize{Width: 20, Height: 20, Mode: "pad", Background: "cornflowerblue"}).Apply(fill(20, 10, color.White))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBAModel.Convert(img.At(0, 0)); got != (color.NRGBA{R: 0x64, G: 0x95, B: 0xed, A: 0xff}) {
+		t.Errorf("the padding is %v, want cornflowerblue", got)
+	}
+}
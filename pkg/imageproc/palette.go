@@ -0,0 +1,174 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"github.com/disintegration/imaging"
+)
+
+// quantize reduces img to a palette of at most n colors, picked by median cut.
+func quantize(img image.Image, n int) *image.Paletted {
+	src := imaging.Clone(img)
+	pixels := make(colorBox, 0, len(src.Pix)/4)
+	for i := 0; i+3 < len(src.Pix); i += 4 {
+		pixels = append(pixels, color.NRGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]})
+	}
+	palette := medianCut(pixels, n)
+	logging.Debugf("Quantizing to %d colors.\n", len(palette))
+
+	result := image.NewPaletted(src.Bounds(), palette)
+	// no dithering, the noise would cost more bytes than the palette saves
+	draw.Draw(result, src.Bounds(), src, src.Bounds().Min, draw.Src)
+	return result
+}
+
+// colorBox is a set of pixel colors of the median cut.
+type colorBox []color.NRGBA
+
+// widest returns the channel (0-3 for R, G, B, A) with the largest range of
+// values in the box and that range.
+func (b colorBox) widest() (int, int) {
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for _, c := range b {
+		for i, v := range [4]uint8{c.R, c.G, c.B, c.A} {
+			lo[i] = min(lo[i], v)
+			hi[i] = max(hi[i], v)
+		}
+	}
+	channel := 0
+	for i := range hi {
+		if int(hi[i])-int(lo[i]) > int(hi[channel])-int(lo[channel]) {
+			channel = i
+		}
+	}
+	return channel, int(hi[channel]) - int(lo[channel])
+}
+
+func (b colorBox) average() color.NRGBA {
+	var sum [4]int
+	for _, c := range b {
+		sum[0] += int(c.R)
+		sum[1] += int(c.G)
+		sum[2] += int(c.B)
+		sum[3] += int(c.A)
+	}
+	n := len(b)
+	return color.NRGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+}
+
+// medianCut splits the pixels into n boxes, always splitting the box with the
+// widest channel range at the median of that channel, and returns the average
+// color of every box. The pixels are reordered.
+func medianCut(pixels colorBox, n int) color.Palette {
+	if len(pixels) == 0 {
+		return color.Palette{color.Transparent}
+	}
+
+	boxes := []colorBox{pixels}
+	for len(boxes) < n {
+		split, channel, widest := -1, 0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if c, r := b.widest(); r > widest {
+				split, channel, widest = i, c, r
+			}
+		}
+		// every box has a single color left
+		if split < 0 {
+			break
+		}
+
+		b := boxes[split]
+		sort.Slice(b, func(i, j int) bool {
+			return channelValue(b[i], channel) < channelValue(b[j], channel)
+		})
+		median := len(b) / 2
+		boxes[split] = b[:median]
+		boxes = append(boxes, b[median:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		palette[i] = b.average()
+	}
+	return palette
+}
+
+// DominantColors returns up to n colors covering most of img, the most
+// frequent first. They are found by k-means over a downscaled copy, seeded with
+// the median cut palette. Mostly transparent pixels are ignored.
+func DominantColors(img image.Image, n int) []color.NRGBA {
+	small := imaging.Fit(img, 64, 64, imaging.Box)
+	pixels := make(colorBox, 0, len(small.Pix)/4)
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		if small.Pix[i+3] >= 128 {
+			pixels = append(pixels, color.NRGBA{small.Pix[i], small.Pix[i+1], small.Pix[i+2], 255})
+		}
+	}
+	if len(pixels) == 0 || n <= 0 {
+		return nil
+	}
+
+	seeds := medianCut(append(colorBox{}, pixels...), n)
+	centers := make(colorBox, len(seeds))
+	for i, c := range seeds {
+		centers[i] = c.(color.NRGBA)
+	}
+	counts := make([]int, len(centers))
+	for iteration := 0; iteration < 10; iteration++ {
+		sums := make([][3]int, len(centers))
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, p := range pixels {
+			nearest, distance := 0, -1
+			for i, c := range centers {
+				dr, dg, db := int(p.R)-int(c.R), int(p.G)-int(c.G), int(p.B)-int(c.B)
+				if d := dr*dr + dg*dg + db*db; distance < 0 || d < distance {
+					nearest, distance = i, d
+				}
+			}
+			sums[nearest][0] += int(p.R)
+			sums[nearest][1] += int(p.G)
+			sums[nearest][2] += int(p.B)
+			counts[nearest]++
+		}
+		for i, s := range sums {
+			if counts[i] > 0 {
+				centers[i] = color.NRGBA{uint8(s[0] / counts[i]), uint8(s[1] / counts[i]), uint8(s[2] / counts[i]), 255}
+			}
+		}
+	}
+
+	order := make([]int, len(centers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return counts[order[i]] > counts[order[j]] })
+	var result []color.NRGBA
+	for _, i := range order {
+		if counts[i] > 0 {
+			result = append(result, centers[i])
+		}
+	}
+	return result
+}
+
+func channelValue(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	}
+	return c.A
+}
@@ -0,0 +1,43 @@
+package imageproc
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestDominantColors(t *testing.T) {
+	// 80% blue, 15% white and 5% red, in stripes
+	blue := color.NRGBA{R: 0x33, G: 0x66, B: 0xcc, A: 0xff}
+	img := fill(100, 100, blue)
+	for y := 0; y < 100; y++ {
+		for x := 80; x < 100; x++ {
+			if x < 95 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.NRGBA{R: 0xff, A: 0xff})
+			}
+		}
+	}
+
+	colors := DominantColors(img, 3)
+	if len(colors) == 0 || len(colors) > 3 {
+		t.Fatalf("got %v, want up to 3 colors", colors)
+	}
+	near := func(a, b color.NRGBA) bool {
+		return abs(int(a.R)-int(b.R)) < 8 && abs(int(a.G)-int(b.G)) < 8 && abs(int(a.B)-int(b.B)) < 8
+	}
+	if !near(colors[0], blue) {
+		t.Errorf("got %v first, want the dominant %v", colors[0], blue)
+	}
+	if len(colors) > 1 && !near(colors[1], color.NRGBA{R: 0xff, G: 0xff, B: 0xff}) {
+		t.Errorf("got %v second, want white", colors[1])
+	}
+
+	// the transparent pixels don't count
+	if colors := DominantColors(transparentLeft(40, 40), 2); len(colors) != 1 || !near(colors[0], color.NRGBA{R: 0xff}) {
+		t.Errorf("got %v, want only red", colors)
+	}
+	if colors := DominantColors(fill(10, 10, color.Transparent), 2); colors != nil {
+		t.Errorf("got %v for a transparent image, want none", colors)
+	}
+}
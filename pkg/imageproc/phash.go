@@ -0,0 +1,63 @@
+package imageproc
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// PHash returns the 64 bit perceptual hash of img: the signs, relative to their
+// median, of the 8x8 lowest frequencies of the DCT of a 32x32 grayscale copy.
+// Visually similar images have hashes differing in few bits, see PHashDistance.
+func PHash(img image.Image) uint64 {
+	const size, low = 32, 8
+	small := imaging.Grayscale(imaging.Resize(img, size, size, imaging.Box))
+	var pixels [size][size]float64
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			pixels[y][x] = float64(small.Pix[y*small.Stride+x*4])
+		}
+	}
+
+	// only the low frequencies are kept, so they are computed directly
+	var cos [low][size]float64
+	for u := 0; u < low; u++ {
+		for x := 0; x < size; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+	var coeffs []float64
+	for v := 0; v < low; v++ {
+		for u := 0; u < low; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y][x] * cos[u][x] * cos[v][y]
+				}
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// the DC coefficient is the average brightness, it would skew the median,
+	// which is then the middle one of the 63 others
+	sorted := append([]float64{}, coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash
+}
+
+// PHashDistance is the number of differing bits of two perceptual hashes, 0 for
+// identical images. Below about 10 the images are likely near-duplicates.
+func PHashDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,60 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestPHash(t *testing.T) {
+	// a diagonal gradient with a dark square
+	scene := func(w, h int) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := uint8(255 * (x + y) / (w + h))
+				if x > w/4 && x < w/2 && y > h/4 && y < h/2 {
+					v /= 4
+				}
+				img.Set(x, y, color.NRGBA{R: v, G: v, B: 255 - v, A: 0xff})
+			}
+		}
+		return img
+	}
+	original := scene(200, 200)
+	hash := PHash(original)
+	if PHash(original) != hash {
+		t.Fatalf("hashing twice differs")
+	}
+	// pinned, so that a changed hash, which breaks the stored ones, is noticed
+	if hash != 0xb131cece393131ce {
+		t.Errorf("got the hash %016x, want b131cece393131ce", hash)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		img     image.Image
+		similar bool
+	}{
+		{"the same", original, true},
+		{"smaller", imaging.Resize(original, 64, 64, imaging.Lanczos), true},
+		{"brighter", imaging.AdjustBrightness(original, 10), true},
+		{"blurred", imaging.Blur(original, 1), true},
+		{"flipped", imaging.FlipH(original), false},
+		{"inverted", imaging.Invert(original), false},
+		{"another image", checker(200, 200, 20), false},
+	} {
+		distance := PHashDistance(hash, PHash(tt.img))
+		if tt.similar && distance >= 10 {
+			t.Errorf("%s: the distance is %d, want under 10", tt.name, distance)
+		} else if !tt.similar && distance < 10 {
+			t.Errorf("%s: the distance is %d, want at least 10", tt.name, distance)
+		}
+	}
+
+	if d := PHashDistance(0, ^uint64(0)); d != 64 {
+		t.Errorf("got a distance of %d between opposite hashes, want 64", d)
+	}
+}
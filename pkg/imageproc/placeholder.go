@@ -0,0 +1,15 @@
+package imageproc
+
+import (
+	"image"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// Blurhash returns the BlurHash placeholder of img with 4x3 components. It only
+// holds the lowest frequencies, so it is computed on a downscaled copy.
+func Blurhash(img image.Image) (string, error) {
+	small := imaging.Fit(img, 32, 32, imaging.Box)
+	return blurhash.Encode(4, 3, small)
+}
@@ -0,0 +1,44 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/buckket/go-blurhash"
+)
+
+func TestBlurhash(t *testing.T) {
+	// the left half red, the right half blue
+	img := fill(64, 32, color.NRGBA{R: 255, A: 255})
+	for y := 0; y < 32; y++ {
+		for x := 32; x < 64; x++ {
+			img.Set(x, y, color.NRGBA{B: 255, A: 255})
+		}
+	}
+	hash, err := Blurhash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size flag, the maximum AC, 4 characters of DC and 2 per AC component
+	if len(hash) != 1+1+4+2*(4*3-1) {
+		t.Errorf("got %q of %d characters, want 28 for 4x3 components", hash, len(hash))
+	}
+	if x, y, err := blurhash.Components(hash); err != nil || x != 4 || y != 3 {
+		t.Errorf("got %dx%d components, %v, want 4x3", x, y, err)
+	}
+
+	placeholder, err := blurhash.Decode(hash, 16, 8, 1)
+	if err != nil {
+		t.Fatalf("decoding %q: %s", hash, err)
+	}
+	if size := placeholder.Bounds().Size(); size != image.Pt(16, 8) {
+		t.Fatalf("decoded %v, want 16x8", size)
+	}
+	if r, _, b, _ := placeholder.At(1, 4).RGBA(); r <= b {
+		t.Errorf("the left of the placeholder is %v, want mostly red", placeholder.At(1, 4))
+	}
+	if r, _, b, _ := placeholder.At(14, 4).RGBA(); b <= r {
+		t.Errorf("the right of the placeholder is %v, want mostly blue", placeholder.At(14, 4))
+	}
+}
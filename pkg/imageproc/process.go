@@ -0,0 +1,819 @@
+/*
+Package imageproc resizes, rotates and crops images and creates additional
+sizes / thumbnails of the formatted image. It is used by the go-image-resize
+CLI and Web API and can be embedded in other Go services.
+
+Order of actions: flip horizontal, flip vertical, transpose, transverse, rotation, trimming, cropping, grayscale,
+resizing, brightness, contrast, saturation, gamma, blur, sharpen, caption, rounded corners / circle mask
+*/
+package imageproc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"github.com/disintegration/imaging"
+	"golang.org/x/sync/errgroup"
+)
+
+// ThumbnailWorkers bounds the number of thumbnails generated concurrently.
+var ThumbnailWorkers = runtime.GOMAXPROCS(0)
+
+// MaxDimension caps the width and height of resized images and thumbnails,
+// guarding against huge allocations. 0 disables the cap.
+var MaxDimension = 10000
+
+// ProcessedImage is one output of Process: the formatted image or a thumbnail.
+type ProcessedImage struct {
+	Name  string
+	Image image.Image
+	// Animation holds every processed frame when the source is an animated GIF.
+	// It is encoded as an animated GIF or WebP. Image is then the first frame,
+	// used for the other formats.
+	Animation *gif.GIF
+	// ICC is the color profile to embed in JPEG and PNG outputs
+	ICC []byte
+	// Quality and MaxBytes override the options of the same name when encoding
+	// this image. 0 keeps them
+	Quality  int
+	MaxBytes int
+}
+
+// Process applies the options to src and generates the thumbnails. The
+// formatted image comes first, named after name with the extension of
+// Options.Format, followed by the thumbnails in the order of Options.Thumbnails
+// and Options.Widths.
+// With Options.SkipPrimary only the thumbnails are returned.
+func Process(name string, src image.Image, options *Options) ([]ProcessedImage, error) {
+	if len(options.Crops) > 0 {
+		return processCrops(name, src, options)
+	}
+
+	images := make([]ProcessedImage, 1)
+
+	name = OutputName(name, options)
+	src, err := convertColorModel(src, options.ColorModel, options.FlattenColor)
+	if err != nil {
+		return nil, err
+	}
+
+	src = flip(src, options)
+	src, err = Rotate(src, options.Rotate, options.Fill, options.RotateKeepSize)
+	if err != nil {
+		return nil, err
+	}
+	src, err = options.Trim.Apply(src)
+	if err != nil {
+		return nil, err
+	}
+	src, err = options.Crop.Apply(src)
+	if err != nil {
+		return nil, err
+	}
+	src = grayscale(src, options.Grayscale)
+	src, err = options.Resize.Apply(src)
+	if err != nil {
+		return nil, err
+	}
+	src = adjust(src, options)
+	src = blur(src, options.Blur)
+	src = sharpen(src, options.Sharpen)
+	src, err = options.Caption.Apply(src)
+	if err != nil {
+		return nil, err
+	}
+	if options.masked() {
+		src = mask(src, options.RoundCorners, options.Circle)
+	}
+
+	if len(options.Formats) == 0 {
+		// with Options.Formats only the JPEG variants are flattened, by encodeVariants
+		src, err = flattenJPEG(name, src, options.FlattenColor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the processing returns NRGBA images whatever the source was
+	primary, err := convertColorModel(src, options.ColorModel, options.FlattenColor)
+	if err != nil {
+		return nil, err
+	}
+	images[0] = ProcessedImage{
+		Name:  name,
+		Image: primary,
+	}
+
+	if thumbnails := options.thumbnails(); thumbnails != nil {
+		// imaging never mutates its input, so the thumbnails can share src
+		thumbs := make([]ProcessedImage, len(thumbnails))
+		var g errgroup.Group
+		g.SetLimit(ThumbnailWorkers)
+		for i, t := range thumbnails {
+			i, t := i, t
+			g.Go(func() error {
+				thumbImg, err := t.resizeOptions(&options.Resize).Apply(src)
+				if err != nil {
+					return err
+				}
+				thumbName := withFormat(name, t.Format)
+				if len(options.Formats) == 0 {
+					// a thumbnail of a PNG may still be a JPEG
+					thumbImg, err = flattenJPEG(thumbName, thumbImg, options.FlattenColor)
+					if err != nil {
+						return err
+					}
+				}
+				thumbImg, err = convertColorModel(thumbImg, options.ColorModel, options.FlattenColor)
+				if err != nil {
+					return err
+				}
+				template := t.NameTemplate
+				if template == "" {
+					template = options.NameTemplate
+				}
+				thumbs[i] = ProcessedImage{
+					Name:     getTemplateName(template, thumbName, t.Suffix, thumbImg.Bounds().Size()),
+					Image:    thumbImg,
+					Quality:  t.Quality,
+					MaxBytes: t.MaxBytes,
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		images = append(images, thumbs...)
+	}
+
+	if options.SkipPrimary {
+		images = images[1:]
+	}
+	if len(options.Formats) > 0 {
+		return encodeVariants(images, options)
+	}
+	return images, nil
+}
+
+// encodeVariants returns every image once per Options.Formats, with the
+// extension of the format. The variants share the processed image, which is
+// only flattened for the JPEG variants.
+func encodeVariants(images []ProcessedImage, options *Options) ([]ProcessedImage, error) {
+	variants := make([]ProcessedImage, 0, len(images)*len(options.Formats))
+	for _, img := range images {
+		for _, format := range options.Formats {
+			variant := img
+			variant.Name = withFormat(img.Name, format)
+			flattened, err := flattenJPEG(variant.Name, img.Image, options.FlattenColor)
+			if err != nil {
+				return nil, err
+			}
+			// flattening returns NRGBA whatever the color model was
+			variant.Image, err = convertColorModel(flattened, options.ColorModel, options.FlattenColor)
+			if err != nil {
+				return nil, err
+			}
+			variants = append(variants, variant)
+		}
+	}
+	return variants, nil
+}
+
+// OutputName returns the name Process gives the formatted image of name. See
+// OutputNames for the names of all the outputs.
+func OutputName(name string, options *Options) string {
+	if len(options.Crops) > 0 {
+		name = ThumbName(name, "-crop1")
+	}
+	format := options.Format
+	if len(options.Formats) > 0 {
+		format = options.Formats[0]
+	}
+	name = withFormat(name, format)
+	if format, err := imaging.FormatFromFilename(name); err == nil && options.masked() && (format == imaging.JPEG || format == imaging.BMP) {
+		// the transparent corners would be flattened away
+		name = withFormat(name, "png")
+	}
+	return name
+}
+
+// OutputNames returns the names of every output Process gives name, in the
+// same order. It reports false when they depend on the image, through the
+// {width}, {height} or {date:layout} tokens of a name template.
+func OutputNames(name string, options *Options) ([]string, bool) {
+	if len(options.Crops) > 0 {
+		var names []string
+		for i, crop := range options.Crops {
+			cropOptions := *options
+			cropOptions.Crops = nil
+			cropOptions.Crop = crop
+			cropNames, ok := OutputNames(ThumbName(name, "-crop"+strconv.Itoa(i+1)), &cropOptions)
+			if !ok {
+				return nil, false
+			}
+			names = append(names, cropNames...)
+		}
+		return names, true
+	}
+
+	name = OutputName(name, options)
+	var names []string
+	if !options.SkipPrimary {
+		names = append(names, name)
+	}
+	for _, t := range options.thumbnails() {
+		template := t.NameTemplate
+		if template == "" {
+			template = options.NameTemplate
+		}
+		if strings.Contains(template, "{width}") || strings.Contains(template, "{height}") || dateToken.MatchString(template) {
+			return nil, false
+		}
+		names = append(names, getTemplateName(template, withFormat(name, t.Format), t.Suffix, image.Point{}))
+	}
+	if len(options.Formats) == 0 {
+		return names, true
+	}
+	variants := make([]string, 0, len(names)*len(options.Formats))
+	for _, n := range names {
+		for _, format := range options.Formats {
+			variants = append(variants, withFormat(n, format))
+		}
+	}
+	return variants, true
+}
+
+// processCrops runs Process once per crop of Options.Crops, naming the outputs
+// after the crop, and returns all of them in the order of the crops.
+func processCrops(name string, src image.Image, options *Options) ([]ProcessedImage, error) {
+	var images []ProcessedImage
+	for i, crop := range options.Crops {
+		cropOptions := *options
+		cropOptions.Crops = nil
+		cropOptions.Crop = crop
+		result, err := Process(ThumbName(name, "-crop"+strconv.Itoa(i+1)), src, &cropOptions)
+		if err != nil {
+			return nil, fmt.Errorf("crops[%d]: %v", i, err)
+		}
+		images = append(images, result...)
+	}
+	return images, nil
+}
+
+// withFormat replaces the extension of name with the one of format, if set.
+func withFormat(name string, format string) string {
+	if ext, ok := formatExtensions[strings.ToLower(format)]; ok {
+		return strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+	return name
+}
+
+// ThumbName inserts the suffix between the base name and the extension of name.
+func ThumbName(name string, suffix string) string {
+	ext := filepath.Ext(name)
+	base := string(name[0 : len(name)-len(ext)])
+	return base + suffix + ext
+}
+
+func flip(img image.Image, options *Options) image.Image {
+	if options.FlipH {
+		logging.Debugf("Flipping horizontally.")
+		img = imaging.FlipH(img)
+	}
+	if options.FlipV {
+		logging.Debugf("Flipping vertically.")
+		img = imaging.FlipV(img)
+	}
+	if options.Transpose {
+		logging.Debugf("Transposing.")
+		img = imaging.Transpose(img)
+	}
+	if options.Transverse {
+		logging.Debugf("Transversing.")
+		img = imaging.Transverse(img)
+	}
+	return img
+}
+
+// getTemplateName replaces the {base}, {ext}, {suffix}, {width} and {height}
+// tokens of the template, naming a file in the directory of name. An empty
+// template falls back to ThumbName.
+func getTemplateName(template string, name string, suffix string, size image.Point) string {
+	if template == "" {
+		return ThumbName(name, suffix)
+	}
+	dir, file := filepath.Split(name)
+	ext := filepath.Ext(file)
+	return dir + strings.NewReplacer(
+		"{base}", file[0:len(file)-len(ext)],
+		"{ext}", ext,
+		"{suffix}", suffix,
+		"{width}", strconv.Itoa(size.X),
+		"{height}", strconv.Itoa(size.Y),
+	).Replace(template)
+}
+
+// Rotate rotates img counter-clockwise by deg degrees, filling the uncovered
+// corners with the fill color (see parseColor). With keepSize the result is
+// center-cropped back to the size of img. A side the rotation made shorter,
+// such as the width of a landscape image turned by 90 degrees, is padded with
+// the fill color instead, so the result always has the size of img.
+func Rotate(img image.Image, deg float64, fill string, keepSize bool) (image.Image, error) {
+	if deg == 0 {
+		return img, nil
+	}
+	result, err := rotateImage(img, deg, fill)
+	if err != nil || !keepSize {
+		return result, err
+	}
+
+	size := img.Bounds().Size()
+	logging.Debugf("Cropping rotated image back to w = %d, h = %d.\n", size.X, size.Y)
+	cropped := imaging.CropAnchor(result, size.X, size.Y, imaging.Center)
+	if cropped.Bounds().Size() == size {
+		return cropped, nil
+	}
+	c, err := parseColor(fill)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.PasteCenter(imaging.New(size.X, size.Y, c), cropped), nil
+}
+
+func rotateImage(img image.Image, deg float64, fill string) (image.Image, error) {
+	// multiples of 90 degrees are rotated losslessly, without a fill background
+	var result image.Image
+	switch normalized := math.Mod(math.Mod(deg, 360)+360, 360); normalized {
+	case 0:
+		return img, nil
+	case 90:
+		result = imaging.Rotate90(img)
+	case 180:
+		result = imaging.Rotate180(img)
+	case 270:
+		result = imaging.Rotate270(img)
+	}
+	if result != nil {
+		logging.Debugf("Rotating %f degrees.\n", deg)
+		return result, nil
+	}
+
+	c, err := parseColor(fill)
+	if err != nil {
+		return nil, err
+	}
+	logging.Debugf("Rotating %f degrees. Fill color: %v\n", deg, c)
+	return imaging.Rotate(img, deg, c), nil
+}
+
+// flattenJPEG flattens img onto the flatten color when name is a JPEG, white
+// when it is unset or transparent.
+func flattenJPEG(name string, img image.Image, flattenColor string) (image.Image, error) {
+	if format, err := imaging.FormatFromFilename(name); err != nil || format != imaging.JPEG {
+		return img, nil
+	}
+	// JPEG has no alpha channel, transparent areas would otherwise turn black
+	c, err := parseColor(flattenColor)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, a := c.RGBA(); a == 0 {
+		c = color.White
+	}
+	return flatten(img, c), nil
+}
+
+func flatten(img image.Image, c color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	size := img.Bounds().Size()
+	return imaging.Overlay(imaging.New(size.X, size.Y, c), img, image.Pt(0, 0), 1.0)
+}
+
+// Apply crops img to the bounding box of the pixels differing from the border
+// color. An image without borders, or consisting only of them, is returned unchanged.
+func (t *Trim) Apply(img image.Image) (image.Image, error) {
+	if !t.Enabled {
+		return img, nil
+	}
+	src := imaging.Clone(img)
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return img, nil
+	}
+
+	border := color.NRGBAModel.Convert(src.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	if t.Color != "" {
+		c, err := parseColor(t.Color)
+		if err != nil {
+			return nil, err
+		}
+		border = color.NRGBAModel.Convert(c).(color.NRGBA)
+	}
+	tolerance := t.Tolerance
+	isBorder := func(x, y int) bool {
+		i := src.PixOffset(x, y)
+		for c, v := range []uint8{border.R, border.G, border.B, border.A} {
+			if d := int(src.Pix[i+c]) - int(v); d > tolerance || d < -tolerance {
+				return false
+			}
+		}
+		return true
+	}
+	rowIsBorder := func(y, minX, maxX int) bool {
+		for x := minX; x < maxX; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colIsBorder := func(x, minY, maxY int) bool {
+		for y := minY; y < maxY; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	content := bounds
+	for content.Min.Y < content.Max.Y && rowIsBorder(content.Min.Y, content.Min.X, content.Max.X) {
+		content.Min.Y++
+	}
+	if content.Empty() {
+		return img, nil
+	}
+	for rowIsBorder(content.Max.Y-1, content.Min.X, content.Max.X) {
+		content.Max.Y--
+	}
+	for colIsBorder(content.Min.X, content.Min.Y, content.Max.Y) {
+		content.Min.X++
+	}
+	for colIsBorder(content.Max.X-1, content.Min.Y, content.Max.Y) {
+		content.Max.X--
+	}
+	if content == bounds {
+		return img, nil
+	}
+
+	logging.Debugf("Trimming: x = %d, y = %d, w = %d, h = %d.\n", content.Min.X, content.Min.Y, content.Dx(), content.Dy())
+	return imaging.Crop(src, content), nil
+}
+
+// normalize turns a negative width or height of an absolute crop into a
+// rectangle extending left / up from X and Y, e.g. x = 100, width = -50
+// becomes x = 50, width = 50. Anchored crops have no such meaning.
+func (c *Crop) normalize() (*Crop, error) {
+	if c.Width >= 0 && c.Height >= 0 {
+		return c, nil
+	}
+	if c.Anchor != "" {
+		return nil, fmt.Errorf("crop.width and crop.height must not be negative, got %dx%d", c.Width, c.Height)
+	}
+	n := *c
+	if n.Width < 0 {
+		if n.X+n.Width < 0 {
+			return nil, fmt.Errorf("crop.x + crop.width (%d) must not be negative", n.X+n.Width)
+		}
+		n.X, n.Width = n.X+n.Width, -n.Width
+	}
+	if n.Height < 0 {
+		if n.Y+n.Height < 0 {
+			return nil, fmt.Errorf("crop.y + crop.height (%d) must not be negative", n.Y+n.Height)
+		}
+		n.Y, n.Height = n.Y+n.Height, -n.Height
+	}
+	return &n, nil
+}
+
+// validateCrop checks that the crop rectangle fits inside the image, as
+// imaging.Crop would otherwise silently clamp it.
+func validateCrop(img image.Image, crop *Crop) error {
+	size := img.Bounds().Size()
+	if crop.Width <= 0 || crop.Height <= 0 {
+		return fmt.Errorf("crop.width and crop.height must be positive, got %dx%d", crop.Width, crop.Height)
+	}
+	if crop.Anchor != "" {
+		if crop.Width > size.X {
+			return fmt.Errorf("crop.width %d exceeds the image width %d", crop.Width, size.X)
+		}
+		if crop.Height > size.Y {
+			return fmt.Errorf("crop.height %d exceeds the image height %d", crop.Height, size.Y)
+		}
+		return nil
+	}
+	if crop.X < 0 {
+		return fmt.Errorf("crop.x must not be negative, got %d", crop.X)
+	}
+	if crop.Y < 0 {
+		return fmt.Errorf("crop.y must not be negative, got %d", crop.Y)
+	}
+	if crop.X+crop.Width > size.X {
+		return fmt.Errorf("crop.x + crop.width (%d) extends past the image width %d", crop.X+crop.Width, size.X)
+	}
+	if crop.Y+crop.Height > size.Y {
+		return fmt.Errorf("crop.y + crop.height (%d) extends past the image height %d", crop.Y+crop.Height, size.Y)
+	}
+	return nil
+}
+
+// Apply crops img. It is returned unchanged when the crop covers the whole
+// image, and a crop reaching outside of it is an error.
+func (c *Crop) Apply(img image.Image) (image.Image, error) {
+	crop, err := c.toPixels(img)
+	if err == nil {
+		crop, err = crop.normalize()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !crop.shouldCrop(img) {
+		return img, nil
+	}
+	if err := validateCrop(img, crop); err != nil {
+		return nil, err
+	}
+
+	if crop.Anchor != "" {
+		anchor, err := ParseAnchor(crop.Anchor)
+		if err != nil {
+			return nil, err
+		}
+		logging.Debugf("Cropping: anchor = %s, w = %d, h = %d.\n", crop.Anchor, crop.Width, crop.Height)
+		return imaging.CropAnchor(img, crop.Width, crop.Height, anchor), nil
+	}
+
+	var (
+		w = crop.X + crop.Width
+		h = crop.Y + crop.Height
+	)
+
+	logging.Debugf("Cropping: x = %d, y = %d, w = %d, h = %d.\n", crop.X, crop.Y, w, h)
+	return imaging.Crop(img, image.Rect(crop.X, crop.Y, w, h)), nil
+}
+
+// convertColorModel converts img to the ColorModel: rgba, rgb, which is opaque
+// with the transparent areas over flattenColor (default: white), or gray.
+// An empty model and images already in the model are returned unchanged.
+func convertColorModel(img image.Image, model string, flattenColor string) (image.Image, error) {
+	bounds := img.Bounds()
+	switch strings.ToLower(model) {
+	case "":
+		return img, nil
+	case "rgba":
+		if _, ok := img.(*image.RGBA); ok {
+			return img, nil
+		}
+		logging.Debugf("Converting to RGBA.\n")
+		result := image.NewRGBA(bounds)
+		draw.Draw(result, bounds, img, bounds.Min, draw.Src)
+		return result, nil
+	case "rgb":
+		if rgba, ok := img.(*image.RGBA); ok && rgba.Opaque() {
+			return img, nil
+		}
+		c, err := parseColor(flattenColor)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, _, a := c.RGBA(); a == 0 {
+			c = color.White
+		}
+		logging.Debugf("Converting to opaque RGB.\n")
+		result := image.NewRGBA(bounds)
+		draw.Draw(result, bounds, image.NewUniform(c), image.Point{}, draw.Src)
+		draw.Draw(result, bounds, img, bounds.Min, draw.Over)
+		return result, nil
+	case "gray":
+		if _, ok := img.(*image.Gray); ok {
+			return img, nil
+		}
+		logging.Debugf("Converting to the gray color model.\n")
+		result := image.NewGray(bounds)
+		draw.Draw(result, bounds, img, bounds.Min, draw.Src)
+		return result, nil
+	}
+	return nil, fmt.Errorf("unknown color model %q", model)
+}
+
+func grayscale(img image.Image, enabled bool) image.Image {
+	if !enabled {
+		return img
+	}
+	logging.Debugf("Converting to grayscale.")
+	return imaging.Grayscale(img)
+}
+
+func adjust(img image.Image, options *Options) image.Image {
+	if options.Brightness != 0 {
+		logging.Debugf("Adjusting brightness: %f.\n", options.Brightness)
+		img = imaging.AdjustBrightness(img, options.Brightness)
+	}
+	if options.Contrast != 0 {
+		logging.Debugf("Adjusting contrast: %f.\n", options.Contrast)
+		img = imaging.AdjustContrast(img, options.Contrast)
+	}
+	if options.Saturation != 0 {
+		logging.Debugf("Adjusting saturation: %f.\n", options.Saturation)
+		img = imaging.AdjustSaturation(img, options.Saturation)
+	}
+	if options.Gamma != 0 && options.Gamma != 1 {
+		logging.Debugf("Adjusting gamma: %f.\n", options.Gamma)
+		img = imaging.AdjustGamma(img, options.Gamma)
+	}
+	return img
+}
+
+func blur(img image.Image, sigma float64) image.Image {
+	if sigma <= 0 {
+		return img
+	}
+	logging.Debugf("Blurring: sigma = %f.\n", sigma)
+	return imaging.Blur(img, sigma)
+}
+
+func sharpen(img image.Image, sigma float64) image.Image {
+	if sigma <= 0 {
+		return img
+	}
+	logging.Debugf("Sharpening: sigma = %f.\n", sigma)
+	return imaging.Sharpen(img, sigma)
+}
+
+// Apply resizes img. A 0 width or height preserves the aspect ratio and img
+// is returned unchanged when it already has the target size.
+func (r *Resize) Apply(img image.Image) (image.Image, error) {
+	if r.MaxWidth > 0 || r.MaxHeight > 0 {
+		unbounded := *r
+		unbounded.MaxWidth, unbounded.MaxHeight = 0, 0
+		img, err := unbounded.Apply(img)
+		if err != nil {
+			return nil, err
+		}
+		return r.bound(img)
+	}
+	if r.Scale > 0 {
+		size := img.Bounds().Size()
+		scaled := *r
+		scaled.Scale = 0
+		scaled.Width = max(1, int(math.Round(float64(size.X)*r.Scale)))
+		scaled.Height = max(1, int(math.Round(float64(size.Y)*r.Scale)))
+		logging.Debugf("Scaling by %v: w = %d, h = %d.\n", r.Scale, scaled.Width, scaled.Height)
+		return scaled.Apply(img)
+	}
+	w, h := r.Width, r.Height
+	if w <= 0 && h <= 0 {
+		return img, nil
+	}
+	if strings.ToLower(r.Mode) == "pad" {
+		return r.pad(img)
+	}
+	// a 0 dimension is passed on to imaging, which preserves the aspect ratio
+	if w < 0 {
+		w = 0
+	} else if h < 0 {
+		h = 0
+	}
+	size := img.Bounds().Size()
+	if !r.AllowUpscale {
+		w, h = limitUpscale(w, h, size)
+	}
+	if size.X == w && size.Y == h || (w == 0 && size.Y == h) || (h == 0 && size.X == w) {
+		return img, nil
+	}
+	if err := checkMaxDimension(w, h, size); err != nil {
+		return nil, err
+	}
+
+	filter, err := r.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(r.Mode) {
+	case "", "exact":
+		logging.Debugf("Resizing: w = %d, h = %d.\n", w, h)
+		return imaging.Resize(img, w, h, filter), nil
+	case "fit":
+		if w == 0 || h == 0 {
+			return nil, fmt.Errorf("resize mode %q requires both width and height", r.Mode)
+		}
+		logging.Debugf("Resizing to fit: w = %d, h = %d.\n", w, h)
+		return imaging.Fit(img, w, h, filter), nil
+	case "fill":
+		if w == 0 || h == 0 {
+			return nil, fmt.Errorf("resize mode %q requires both width and height", r.Mode)
+		}
+		if r.Smart {
+			logging.Debugf("Resizing to fill smartly: w = %d, h = %d.\n", w, h)
+			return smartFill(img, w, h, filter), nil
+		}
+		anchor, err := ParseAnchor(r.Anchor)
+		if err != nil {
+			return nil, err
+		}
+		logging.Debugf("Resizing to fill: w = %d, h = %d, anchor = %s.\n", w, h, r.Anchor)
+		return imaging.Fill(img, w, h, anchor, filter), nil
+	}
+	return nil, fmt.Errorf("unknown resize mode %q", r.Mode)
+}
+
+// bound scales img down to fit into MaxWidth x MaxHeight, never up.
+func (r *Resize) bound(img image.Image) (image.Image, error) {
+	size := img.Bounds().Size()
+	scale := 1.0
+	if r.MaxWidth > 0 {
+		scale = math.Min(scale, float64(r.MaxWidth)/float64(size.X))
+	}
+	if r.MaxHeight > 0 {
+		scale = math.Min(scale, float64(r.MaxHeight)/float64(size.Y))
+	}
+	if scale >= 1 {
+		return img, nil
+	}
+	filter, err := r.filter()
+	if err != nil {
+		return nil, err
+	}
+	w := max(1, int(math.Round(float64(size.X)*scale)))
+	h := max(1, int(math.Round(float64(size.Y)*scale)))
+	logging.Debugf("Bounding to %dx%d: w = %d, h = %d.\n", r.MaxWidth, r.MaxHeight, w, h)
+	return imaging.Resize(img, w, h, filter), nil
+}
+
+// pad fits img inside Width x Height, upscaling it only with AllowUpscale,
+// and centers it on a canvas of exactly that size filled with Background.
+func (r *Resize) pad(img image.Image) (image.Image, error) {
+	if r.Width <= 0 || r.Height <= 0 {
+		return nil, fmt.Errorf("resize mode %q requires both width and height", r.Mode)
+	}
+	size := img.Bounds().Size()
+	if err := checkMaxDimension(r.Width, r.Height, size); err != nil {
+		return nil, err
+	}
+	c, err := parseColor(r.Background)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := r.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	fitted := img
+	if size.X > r.Width || size.Y > r.Height || r.AllowUpscale {
+		scale := math.Min(float64(r.Width)/float64(size.X), float64(r.Height)/float64(size.Y))
+		w := max(1, int(math.Round(float64(size.X)*scale)))
+		h := max(1, int(math.Round(float64(size.Y)*scale)))
+		if w != size.X || h != size.Y {
+			fitted = imaging.Resize(img, w, h, filter)
+		}
+	}
+	logging.Debugf("Resizing to pad: w = %d, h = %d, background = %v.\n", r.Width, r.Height, c)
+	return imaging.PasteCenter(imaging.New(r.Width, r.Height, c), fitted), nil
+}
+
+// checkMaxDimension rejects a target exceeding MaxDimension, including the
+// dimension derived from the aspect ratio when the other one is 0.
+func checkMaxDimension(w int, h int, size image.Point) error {
+	if MaxDimension <= 0 {
+		return nil
+	}
+	if w == 0 {
+		w = int(math.Round(float64(h) * float64(size.X) / float64(size.Y)))
+	} else if h == 0 {
+		h = int(math.Round(float64(w) * float64(size.Y) / float64(size.X)))
+	}
+	if w > MaxDimension || h > MaxDimension {
+		return fmt.Errorf("resizing to %dx%d exceeds the maximum dimension of %d", w, h, MaxDimension)
+	}
+	return nil
+}
+
+// limitUpscale shrinks the target dimensions so they don't exceed the source
+// size, keeping the requested aspect ratio.
+func limitUpscale(w int, h int, size image.Point) (int, int) {
+	if w == 0 {
+		return 0, min(h, size.Y)
+	}
+	if h == 0 {
+		return min(w, size.X), 0
+	}
+	scale := math.Min(1, math.Min(float64(size.X)/float64(w), float64(size.Y)/float64(h)))
+	if scale == 1 {
+		return w, h
+	}
+	return max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
+}
@@ -0,0 +1,1135 @@
+package imageproc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// fill returns a w x h image of the color c.
+func fill(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// transparentLeft returns a w x h red image with a transparent left half.
+func transparentLeft(w, h int) *image.NRGBA {
+	img := fill(w, h, color.NRGBA{R: 255, A: 255})
+	for y := 0; y < h; y++ {
+		for x := 0; x < w/2; x++ {
+			img.Set(x, y, color.NRGBA{})
+		}
+	}
+	return img
+}
+
+func TestResizePreservesTheRatio(t *testing.T) {
+	for _, tt := range []struct {
+		width, height int
+		want          image.Point
+	}{
+		{400, 0, image.Pt(400, 200)},
+		{0, 100, image.Pt(200, 100)},
+		{300, 300, image.Pt(300, 300)},
+	} {
+		src := fill(800, 400, color.White)
+		img, err := (&Resize{Width: tt.width, Height: tt.height}).Apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != tt.want {
+			t.Errorf("resizing 800x400 to %dx%d gave %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestResizeModes(t *testing.T) {
+	src := fill(400, 200, color.White)
+	for _, tt := range []struct {
+		mode string
+		want image.Point
+	}{
+		{"", image.Pt(100, 100)},
+		{"exact", image.Pt(100, 100)},
+		{"fit", image.Pt(100, 50)},
+		{"fill", image.Pt(100, 100)},
+	} {
+		img, err := (&Resize{Width: 100, Height: 100, Mode: tt.mode}).Apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != tt.want {
+			t.Errorf("the %q mode gave %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+	if _, err := (&Resize{Width: 100, Height: 100, Mode: "stretch"}).Apply(src); err == nil {
+		t.Error("an unknown mode didn't fail")
+	}
+}
+
+func TestResizeFillAnchor(t *testing.T) {
+	// left half red, right half blue
+	halves := fill(400, 200, color.NRGBA{B: 255, A: 255})
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			halves.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	src := halves
+	img, err := (&Resize{Width: 100, Height: 100, Mode: "fill", Anchor: "left"}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, b, _ := img.At(50, 50).RGBA(); r>>8 != 255 || b != 0 {
+		t.Errorf("filling from the left gave %v, want the red half", img.At(50, 50))
+	}
+}
+
+// encode encodes img with options and returns the bytes and the content type.
+func encode(t *testing.T, img *ProcessedImage, options *Options) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	contentType, err := Encode(&buf, img, options)
+	if err != nil {
+		t.Fatalf("encoding %s: %s", img.Name, err)
+	}
+	return buf.Bytes(), contentType
+}
+
+func TestProcessConvertsTheFormat(t *testing.T) {
+	for _, tt := range []struct {
+		name, format, want, contentType string
+	}{
+		{"photo.png", "jpeg", "photo.jpg", "image/jpeg"},
+		{"photo.jpg", "png", "photo.png", "image/png"},
+		{"photo.jpg", "", "photo.jpg", "image/jpeg"},
+		{"photo.png", "bmp", "photo.bmp", "image/bmp"},
+	} {
+		src := transparentLeft(20, 20)
+		images, err := Process(tt.name, src, &Options{Format: tt.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if images[0].Name != tt.want {
+			t.Errorf("%s as %q is named %s, want %s", tt.name, tt.format, images[0].Name, tt.want)
+		}
+		data, contentType := encode(t, &images[0], &Options{})
+		if contentType != tt.contentType {
+			t.Errorf("%s is encoded as %s, want %s", images[0].Name, contentType, tt.contentType)
+		}
+		if _, err := imaging.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("decoding %s: %s", images[0].Name, err)
+		}
+	}
+	if err := (&Options{Format: "svg"}).Validate(); err == nil {
+		t.Error("an unknown format is valid")
+	}
+}
+
+// coords returns a w x h image, up to 1024 x 1024, whose pixels encode their
+// position: red x / 4 and green y / 4.
+func coords(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x / 4), G: uint8(y / 4), A: 255})
+		}
+	}
+	return img
+}
+
+// originOf returns the source position of the top left pixel of a crop of coords.
+func originOf(img image.Image) image.Point {
+	c := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X, img.Bounds().Min.Y)).(color.NRGBA)
+	return image.Pt(int(c.R)*4, int(c.G)*4)
+}
+
+func TestCropAnchors(t *testing.T) {
+	src := coords(1000, 800)
+	for anchor, want := range map[string]image.Point{
+		"center":      image.Pt(400, 300),
+		"topleft":     image.Pt(0, 0),
+		"top":         image.Pt(400, 0),
+		"bottomright": image.Pt(800, 600),
+		"left":        image.Pt(0, 300),
+	} {
+		img, err := (&Crop{Anchor: anchor, Width: 200, Height: 200, X: 10, Y: 10}).Apply(src)
+		if err != nil {
+			t.Fatalf("%s: %s", anchor, err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(200, 200) {
+			t.Errorf("%s: cropped %v, want 200x200", anchor, size)
+		}
+		if got := originOf(img); got != want {
+			t.Errorf("%s: cropped from %v, want %v", anchor, got, want)
+		}
+	}
+	if _, err := (&Crop{Anchor: "middle", Width: 200, Height: 200}).Apply(src); err == nil {
+		t.Error("an unknown anchor didn't fail")
+	}
+}
+
+func TestCropPercent(t *testing.T) {
+	src := coords(800, 400)
+	img, err := (&Crop{Unit: "percent", X: 25, Y: 25, Width: 50, Height: 50}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(400, 200) {
+		t.Errorf("cropped %v, want 400x200", size)
+	}
+	if got := originOf(img); got != image.Pt(200, 100) {
+		t.Errorf("cropped from %v, want 200,100", got)
+	}
+
+	for _, c := range []Crop{
+		{Unit: "percent", X: 60, Width: 50, Height: 50},
+		{Unit: "percent", Width: 101, Height: 50},
+		{Unit: "inch", Width: 1, Height: 1},
+	} {
+		if _, err := c.Apply(src); err == nil {
+			t.Errorf("%+v didn't fail", c)
+		}
+	}
+}
+
+func TestCropOutOfBounds(t *testing.T) {
+	src := coords(200, 100)
+	for _, tt := range []struct {
+		crop  Crop
+		field string
+	}{
+		{Crop{X: 150, Width: 100, Height: 50}, "crop.x + crop.width"},
+		{Crop{Y: 80, Width: 50, Height: 50}, "crop.y + crop.height"},
+		{Crop{X: -1, Width: 50, Height: 50}, "crop.x"},
+		{Crop{Anchor: "center", Width: 300, Height: 50}, "crop.width"},
+	} {
+		_, err := tt.crop.Apply(src)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.field) {
+			t.Errorf("%+v: got %v, want an error naming %s", tt.crop, err, tt.field)
+		}
+	}
+}
+
+func TestProcessThumbnailsConcurrently(t *testing.T) {
+	previous := ThumbnailWorkers
+	ThumbnailWorkers = 3
+	t.Cleanup(func() { ThumbnailWorkers = previous })
+
+	var thumbs []Thumb
+	for i := 1; i <= 8; i++ {
+		thumbs = append(thumbs, Thumb{Suffix: "-" + strconv.Itoa(i), Width: 10 * i})
+	}
+	src := fill(200, 100, color.White)
+	images, err := Process("photo.png", src, &Options{Thumbnails: thumbs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 9 {
+		t.Fatalf("got %d images, want the formatted one and 8 thumbnails", len(images))
+	}
+	for i, img := range images[1:] {
+		want := image.Pt(10*(i+1), 5*(i+1))
+		if img.Name != "photo-"+strconv.Itoa(i+1)+".png" || img.Image.Bounds().Size() != want {
+			t.Errorf("thumbnail %d is %s of %v, want photo-%d.png of %v", i, img.Name, img.Image.Bounds().Size(), i+1, want)
+		}
+	}
+}
+
+// process runs Process on src and fails the test on an error.
+func process(t *testing.T, name string, src image.Image, options *Options) []ProcessedImage {
+	t.Helper()
+	images, err := Process(name, src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return images
+}
+
+func TestProcessGrayscale(t *testing.T) {
+	options := &Options{Grayscale: true, Thumbnails: []Thumb{{Suffix: "-small", Width: 20}, {Suffix: "-tiny", Width: 5}}}
+	for _, img := range process(t, "photo.png", coords(40, 40), options) {
+		size := img.Image.Bounds().Size()
+		for _, p := range []image.Point{{0, 0}, {size.X / 2, size.Y / 3}, {size.X - 1, size.Y - 1}} {
+			if r, g, b, _ := img.Image.At(p.X, p.Y).RGBA(); r != g || g != b {
+				t.Errorf("%s at %v is %v, want a gray", img.Name, p, img.Image.At(p.X, p.Y))
+			}
+		}
+	}
+}
+
+// samePixels reports whether a and b have the same size and pixels.
+func samePixels(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	return bytes.Equal(na.Pix, nb.Pix)
+}
+
+// checker returns a w x h checkerboard of size x size dark and light gray
+// squares, which sharpening doesn't clip.
+func checker(w, h int, size int) *image.NRGBA {
+	img := fill(w, h, color.Gray{0xc0})
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/size+y/size)%2 == 1 {
+				img.Set(x, y, color.Gray{0x40})
+			}
+		}
+	}
+	return img
+}
+
+func TestProcessBlurAndSharpen(t *testing.T) {
+	src := checker(40, 40, 4)
+	plain := process(t, "photo.png", src, &Options{})
+	for _, options := range []Options{{Blur: 2}, {Sharpen: 2}} {
+		images := process(t, "photo.png", src, &options)
+		if samePixels(images[0].Image, plain[0].Image) {
+			t.Errorf("blur %v, sharpen %v didn't change the image", options.Blur, options.Sharpen)
+		}
+	}
+	for _, options := range []Options{{Blur: -1}, {Sharpen: -0.5}} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%+v is valid", options)
+		}
+	}
+}
+
+func TestProcessAdjustments(t *testing.T) {
+	src := fill(4, 4, color.NRGBA{R: 100, G: 150, B: 200, A: 255})
+	for _, tt := range []struct {
+		options Options
+		want    func(color.NRGBA) bool
+	}{
+		{Options{Brightness: 20}, func(c color.NRGBA) bool { return c.R > 100 && c.G > 150 && c.B > 200 }},
+		{Options{Brightness: -20}, func(c color.NRGBA) bool { return c.R < 100 && c.G < 150 && c.B < 200 }},
+		{Options{Contrast: 50}, func(c color.NRGBA) bool { return c.R < 100 && c.B > 200 }},
+		{Options{Saturation: -100}, func(c color.NRGBA) bool { return c.R == c.G && c.G == c.B }},
+		{Options{Gamma: 2}, func(c color.NRGBA) bool { return c.R > 100 && c.G > 150 }},
+		{Options{Gamma: 1}, func(c color.NRGBA) bool { return c == color.NRGBA{R: 100, G: 150, B: 200, A: 255} }},
+	} {
+		images := process(t, "photo.png", src, &tt.options)
+		c := color.NRGBAModel.Convert((images[0].Image).At(1, 1)).(color.NRGBA)
+		if !tt.want(c) {
+			t.Errorf("brightness %v, contrast %v, saturation %v, gamma %v gave %v", tt.options.Brightness, tt.options.Contrast, tt.options.Saturation, tt.options.Gamma, c)
+		}
+	}
+	for _, options := range []Options{{Brightness: 101}, {Contrast: -101}, {Saturation: 200}, {Gamma: -1}} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("brightness %v, contrast %v, saturation %v, gamma %v is valid", options.Brightness, options.Contrast, options.Saturation, options.Gamma)
+		}
+	}
+}
+
+// positions returns a w x h image, up to 256 x 256, whose pixels are red x and green y.
+func positions(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestProcessFlips(t *testing.T) {
+	const w, h = 3, 2
+	for _, tt := range []struct {
+		options Options
+		// source returns the source position of the output pixel x, y
+		source func(x, y int) image.Point
+	}{
+		{Options{FlipH: true}, func(x, y int) image.Point { return image.Pt(w-1-x, y) }},
+		{Options{FlipV: true}, func(x, y int) image.Point { return image.Pt(x, h-1-y) }},
+		{Options{Transpose: true}, func(x, y int) image.Point { return image.Pt(y, x) }},
+		{Options{Transverse: true}, func(x, y int) image.Point { return image.Pt(w-1-y, h-1-x) }},
+		// flipped before the counter-clockwise rotation, a transpose
+		{Options{FlipH: true, Rotate: 90}, func(x, y int) image.Point { return image.Pt(y, x) }},
+	} {
+		img := process(t, "photo.png", positions(w, h), &tt.options)[0].Image
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if got, want := image.Pt(int(c.R), int(c.G)), tt.source(x, y); got != want {
+					t.Errorf("%+v: the pixel %d,%d comes from %v, want %v", tt.options, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRotateRightAngles(t *testing.T) {
+	white := fill(40, 20, color.White)
+	for _, deg := range []float64{90, 180, 270, -90, 450} {
+		img, err := Rotate(white, deg, "#ff0000", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := image.Pt(20, 40)
+		if int(deg)%180 == 0 {
+			want = image.Pt(40, 20)
+		}
+		if size := img.Bounds().Size(); size != want {
+			t.Errorf("rotating %v degrees gave %v, want %v", deg, size, want)
+		}
+		for _, p := range []image.Point{{0, 0}, {want.X - 1, 0}, {want.X - 1, want.Y - 1}} {
+			if r, g, b, _ := img.At(p.X, p.Y).RGBA(); r != g || g != b {
+				t.Errorf("rotating %v degrees filled %v with %v", deg, p, img.At(p.X, p.Y))
+			}
+		}
+	}
+}
+
+func TestResizeFilter(t *testing.T) {
+	src := checker(40, 40, 3)
+	for name, filter := range map[string]imaging.ResampleFilter{
+		"":           imaging.Lanczos,
+		"catmullrom": imaging.CatmullRom,
+		"Linear":     imaging.Linear,
+		"box":        imaging.Box,
+		"nearest":    imaging.NearestNeighbor,
+	} {
+		img, err := (&Resize{Width: 17, Height: 17, Filter: name}).Apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePixels(img, imaging.Resize(src, 17, 17, filter)) {
+			t.Errorf("the %q filter wasn't used", name)
+		}
+	}
+	if samePixels(imaging.Resize(src, 17, 17, imaging.Lanczos), imaging.Resize(src, 17, 17, imaging.NearestNeighbor)) {
+		t.Fatal("the test image doesn't tell the filters apart")
+	}
+	if err := (&Options{Resize: Resize{Filter: "bicubic"}}).Validate(); err == nil {
+		t.Error("an unknown filter is valid")
+	}
+}
+
+func TestResizeUpscale(t *testing.T) {
+	src := fill(100, 100, color.White)
+	for _, tt := range []struct {
+		resize Resize
+		want   image.Point
+	}{
+		{Resize{Width: 500, Height: 500}, image.Pt(100, 100)},
+		{Resize{Width: 500, Height: 500, AllowUpscale: true}, image.Pt(500, 500)},
+		{Resize{Width: 500, Height: 250}, image.Pt(100, 50)},
+		{Resize{Width: 500}, image.Pt(100, 100)},
+		{Resize{Width: 500, AllowUpscale: true}, image.Pt(500, 500)},
+		{Resize{Width: 50}, image.Pt(50, 50)},
+	} {
+		img, err := tt.resize.Apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != tt.want {
+			t.Errorf("%+v gave %v, want %v", tt.resize, size, tt.want)
+		}
+	}
+}
+
+// names returns the names of the images.
+func names(images []ProcessedImage) []string {
+	var result []string
+	for _, img := range images {
+		result = append(result, img.Name)
+	}
+	return result
+}
+
+// alphaAt returns the 8 bit alpha of img at x, y.
+func alphaAt(img image.Image, x, y int) uint8 {
+	_, _, _, a := img.At(x, y).RGBA()
+	return uint8(a >> 8)
+}
+
+func TestThumbnailNameTemplates(t *testing.T) {
+	options := &Options{
+		NameTemplate: "{base}_{width}x{height}{ext}",
+		Thumbnails: []Thumb{
+			{Suffix: "-small", Width: 20},
+			{Suffix: "-tiny", Width: 10, NameTemplate: "thumbs-{base}{suffix}{ext}"},
+		},
+	}
+	images := process(t, "dir/photo.png", fill(40, 30, color.White), options)
+	if got := strings.Join(names(images), " "); got != "dir/photo.png dir/photo_20x15.png dir/thumbs-photo-tiny.png" {
+		t.Errorf("got %s", got)
+	}
+
+	images = process(t, "photo.png", fill(40, 30, color.White), &Options{Thumbnails: []Thumb{{Suffix: "-small", Width: 20}}})
+	if images[1].Name != "photo-small.png" {
+		t.Errorf("without a template the thumbnail is named %s, want photo-small.png", images[1].Name)
+	}
+
+	for _, options := range []*Options{
+		{NameTemplate: "../{base}{ext}"},
+		{NameTemplate: "{date:2006/01/02}-{base}{ext}"},
+		{Thumbnails: []Thumb{{Width: 10, NameTemplate: `thumbs\{base}{ext}`}}},
+		{Thumbnails: []Thumb{{Width: 10, Suffix: "/../x"}}},
+	} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%+v is valid, want an error", options)
+		}
+	}
+}
+
+func TestSquareThumbnails(t *testing.T) {
+	for anchor, wantX := range map[string]int{"": 100, "left": 0, "right": 200} {
+		options := &Options{
+			Resize:     Resize{Filter: "nearest"},
+			Thumbnails: []Thumb{{Suffix: "-avatar", Width: 100, Height: 160, Square: true, Anchor: anchor}},
+		}
+		avatar := process(t, "photo.png", coords(400, 200), options)[1].Image
+		if size := avatar.Bounds().Size(); size != image.Pt(100, 100) {
+			t.Errorf("anchor %q: the avatar is %v, want 100x100", anchor, size)
+		}
+		if got := originOf(avatar); got.X < wantX-4 || got.X > wantX+4 || got.Y > 4 {
+			t.Errorf("anchor %q: the avatar was cropped from %v, want %d,0", anchor, got, wantX)
+		}
+	}
+}
+
+func TestRotateKeepSize(t *testing.T) {
+	for _, deg := range []float64{45, 90, 180, 270, -90, 30} {
+		img, err := Rotate(fill(40, 20, color.White), deg, "red", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(40, 20) {
+			t.Errorf("rotating by %v gave %v, want 40x20", deg, size)
+		}
+	}
+
+	// the width turned into the height is padded with the fill color
+	img, err := Rotate(fill(40, 20, color.White), 90, "red", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, _, _ := img.At(0, 10).RGBA(); r>>8 != 255 || g != 0 {
+		t.Errorf("the padding is %v, want red", img.At(0, 10))
+	}
+	if r, g, _, _ := img.At(20, 10).RGBA(); r>>8 != 255 || g>>8 != 255 {
+		t.Errorf("the center is %v, want the white image", img.At(20, 10))
+	}
+}
+
+func TestRotateExpands(t *testing.T) {
+	src := fill(40, 20, color.White)
+	img, err := Rotate(src, 90, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(20, 40) {
+		t.Errorf("got %v, want 20x40", size)
+	}
+}
+
+func TestOutputNamesMatchProcess(t *testing.T) {
+	thumbs := []Thumb{{Suffix: "-small", Width: 10}, {Suffix: "-jpeg", Width: 8, Format: "jpeg"}}
+	for _, options := range []Options{
+		{},
+		{Format: "jpeg"},
+		{Thumbnails: thumbs, Widths: []int{12}},
+		{Thumbnails: thumbs, SkipPrimary: true},
+		{Thumbnails: thumbs, NameTemplate: "{base}_{suffix}{ext}"},
+		{Crops: []Crop{{Width: 10, Height: 10}, {X: 10, Width: 10, Height: 10}}, Thumbnails: thumbs},
+		{Formats: []string{"png", "jpeg"}, Thumbnails: thumbs},
+		{Formats: []string{"gif"}, Thumbnails: thumbs, SkipPrimary: true},
+		{Format: "jpeg", Circle: true},
+	} {
+		images, err := Process("dir/photo.png", fill(40, 20, color.White), &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := OutputNames("dir/photo.png", &options)
+		want := names(images)
+		if !ok || strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("OutputNames(%+v) = %v, %v, want %v", options, got, ok, want)
+		}
+	}
+}
+
+func TestOutputNamesDependingOnTheImage(t *testing.T) {
+	for _, template := range []string{"{base}-{width}x{height}{ext}", "{date:2006}/{base}{suffix}{ext}"} {
+		options := &Options{Thumbnails: []Thumb{{Suffix: "-small", Width: 10, NameTemplate: template}}}
+		if names, ok := OutputNames("photo.png", options); ok {
+			t.Errorf("OutputNames with the template %s = %v, want them unknown", template, names)
+		}
+	}
+}
+
+func TestProcessLeavesTheSourceUnchanged(t *testing.T) {
+	src := coords(60, 40)
+	before := imaging.Clone(src)
+	options := &Options{
+		FlipH: true, Rotate: 30, Crop: Crop{Width: 30, Height: 20, Anchor: "center"}, Grayscale: true,
+		Resize: Resize{Width: 20}, Blur: 1,
+		Thumbnails: []Thumb{{Suffix: "-a", Width: 10}, {Suffix: "-b", Width: 5}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Process("photo.png", src, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !samePixels(src, before) {
+		t.Error("processing modified the source")
+	}
+
+	// without options the image passes through
+	images := process(t, "photo.png", src, &Options{})
+	if !samePixels(images[0].Image, src) {
+		t.Error("processing without options changed the image")
+	}
+}
+
+func TestThumbnailFormatAndQuality(t *testing.T) {
+	options := &Options{Thumbnails: []Thumb{
+		{Suffix: "-small", Width: 32, Format: "jpeg", Quality: 20},
+		{Suffix: "-fine", Width: 32, Format: "jpeg"},
+	}}
+	images, err := Process("photo.png", noise(64, 64), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names(images), " "); got != "photo.png photo-small.jpg photo-fine.jpg" {
+		t.Fatalf("got %s", got)
+	}
+	var sizes []int
+	for i, want := range []string{"image/png", "image/jpeg", "image/jpeg"} {
+		data, contentType := encode(t, &images[i], &Options{Quality: 90})
+		if contentType != want {
+			t.Errorf("%s is encoded as %s, want %s", images[i].Name, contentType, want)
+		}
+		sizes = append(sizes, len(data))
+	}
+	if sizes[1] >= sizes[2] {
+		t.Errorf("the quality 20 thumbnail has %d bytes, the one at the global quality %d, want fewer", sizes[1], sizes[2])
+	}
+}
+
+func TestCropNegativeDimensions(t *testing.T) {
+	// extending left and up from x, y
+	img, err := (&Crop{X: 100, Y: 60, Width: -50, Height: -20}).Apply(coords(200, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// coords rounds the position 50,40 down to multiples of 4
+	if size, origin := img.Bounds().Size(), originOf(img); size != image.Pt(50, 20) || origin != image.Pt(48, 40) {
+		t.Errorf("cropped %v from %v, want 50x20 from 48,40", size, origin)
+	}
+
+	for _, crop := range []Crop{
+		{X: 20, Width: -50, Height: 10},
+		{Y: 5, Width: 10, Height: -10},
+		{Anchor: "center", Width: -10, Height: 10},
+	} {
+		if _, err := crop.Apply(coords(200, 100)); err == nil {
+			t.Errorf("%+v didn't fail", crop)
+		}
+	}
+}
+
+func TestResizeMaxDimension(t *testing.T) {
+	previous := MaxDimension
+	MaxDimension = 100
+	t.Cleanup(func() { MaxDimension = previous })
+	src := fill(10, 10, color.White)
+
+	for _, tt := range []struct {
+		resize Resize
+		ok     bool
+	}{
+		{Resize{Width: 100, Height: 100, AllowUpscale: true}, true},
+		{Resize{Width: 101, Height: 50, AllowUpscale: true}, false},
+		// the height derived from the ratio
+		{Resize{Width: 80, AllowUpscale: true}, true},
+		{Resize{Height: 120, AllowUpscale: true}, false},
+		{Resize{Width: 200, Height: 200, Mode: "pad"}, false},
+	} {
+		_, err := tt.resize.Apply(src)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v, want ok %v", tt.resize, err, tt.ok)
+		}
+	}
+	_, err := Process("photo.png", src, &Options{Resize: Resize{AllowUpscale: true}, Thumbnails: []Thumb{{Width: 500}}})
+	if err == nil {
+		t.Error("a thumbnail over the maximum dimension didn't fail")
+	}
+}
+
+func TestCropAspectRatio(t *testing.T) {
+	for _, tt := range []struct {
+		src    image.Point
+		ratio  string
+		want   image.Point
+		origin image.Point
+	}{
+		{image.Pt(1000, 800), "16:9", image.Pt(1000, 563), image.Pt(0, 116)},
+		{image.Pt(1000, 800), "1:1", image.Pt(800, 800), image.Pt(100, 0)},
+		{image.Pt(600, 1000), "16:9", image.Pt(600, 338), image.Pt(0, 328)},
+		{image.Pt(600, 1000), "1:1", image.Pt(600, 600), image.Pt(0, 200)},
+		{image.Pt(600, 1000), "1.5:1", image.Pt(600, 400), image.Pt(0, 300)},
+	} {
+		img, err := (&Crop{AspectRatio: tt.ratio}).Apply(coords(tt.src.X, tt.src.Y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != tt.want {
+			t.Errorf("%s of %v: cropped %v, want %v", tt.ratio, tt.src, size, tt.want)
+		}
+		if got := originOf(img); got != tt.origin {
+			t.Errorf("%s of %v: cropped from %v, want the centered %v", tt.ratio, tt.src, got, tt.origin)
+		}
+	}
+	for _, ratio := range []string{"16x9", "16:", "0:1", "a:b", "1:2:3"} {
+		if err := (&Options{Crop: Crop{AspectRatio: ratio}}).Validate(); err == nil {
+			t.Errorf("the ratio %q is valid", ratio)
+		}
+	}
+}
+
+func TestResizePad(t *testing.T) {
+	img, err := (&Resize{Width: 200, Height: 200, Mode: "pad", Background: "#00ff00"}).Apply(fill(400, 200, color.White))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(200, 200) {
+		t.Fatalf("padded to %v, want 200x200", size)
+	}
+	// fitted to 200x100, centered between two 50 pixels borders
+	for _, tt := range []struct {
+		p    image.Point
+		want color.NRGBA
+	}{
+		{image.Pt(100, 10), color.NRGBA{G: 255, A: 255}},
+		{image.Pt(100, 190), color.NRGBA{G: 255, A: 255}},
+		{image.Pt(100, 100), color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+	} {
+		if c := color.NRGBAModel.Convert(img.At(tt.p.X, tt.p.Y)); c != tt.want {
+			t.Errorf("the pixel at %v is %v, want %v", tt.p, c, tt.want)
+		}
+	}
+
+	// smaller images are centered without upscaling
+	img, err = (&Resize{Width: 200, Height: 200, Mode: "pad"}).Apply(fill(50, 50, color.White))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(200, 200) || alphaAt(img, 10, 10) != 0 || alphaAt(img, 100, 100) != 255 {
+		t.Errorf("padded the small image to %v, alpha %d at the border", size, alphaAt(img, 10, 10))
+	}
+}
+
+func TestResponsiveWidths(t *testing.T) {
+	options := Options{SkipPrimary: true, Widths: []int{320, 640, 960}, Thumbnails: []Thumb{{Suffix: "-wide", Width: 500}}}
+	images, err := Process("photo.png", fill(1280, 720, color.White), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]image.Point{
+		"photo-wide.png": image.Pt(500, 281),
+		"photo-320w.png": image.Pt(320, 180),
+		"photo-640w.png": image.Pt(640, 360),
+		"photo-960w.png": image.Pt(960, 540),
+	}
+	if len(images) != len(want) {
+		t.Fatalf("got %v, want %d thumbnails", names(images), len(want))
+	}
+	for _, img := range images {
+		if size := img.Image.Bounds().Size(); size != want[img.Name] {
+			t.Errorf("%s: got %v, want %v", img.Name, size, want[img.Name])
+		}
+	}
+
+	if err := (&Options{Widths: []int{320, 0}}).Validate(); err == nil {
+		t.Errorf("a zero width was accepted")
+	}
+}
+
+// bordered returns a w x h red image inside a 20px border of the color c.
+func bordered(w, h int, c color.Color) *image.NRGBA {
+	img := fill(w+40, h+40, c)
+	for y := 20; y < h+20; y++ {
+		for x := 20; x < w+20; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	return img
+}
+
+func TestTrim(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	offWhite := color.NRGBA{R: 250, G: 252, B: 248, A: 255}
+	for _, tt := range []struct {
+		name string
+		img  *image.NRGBA
+		trim Trim
+		want image.Point
+	}{
+		{"white border", bordered(60, 40, color.White), Trim{Enabled: true}, image.Pt(60, 40)},
+		{"explicit color", bordered(60, 40, color.White), Trim{Enabled: true, Color: "#ffffff"}, image.Pt(60, 40)},
+		{"other color", bordered(60, 40, color.White), Trim{Enabled: true, Color: "black"}, image.Pt(100, 80)},
+		{"within the tolerance", bordered(60, 40, offWhite), Trim{Enabled: true, Color: "white", Tolerance: 8}, image.Pt(60, 40)},
+		{"beyond the tolerance", bordered(60, 40, offWhite), Trim{Enabled: true, Color: "white", Tolerance: 2}, image.Pt(100, 80)},
+		{"no border", fill(60, 40, red), Trim{Enabled: true, Color: "white"}, image.Pt(60, 40)},
+		{"only border", fill(60, 40, color.White), Trim{Enabled: true}, image.Pt(60, 40)},
+		{"disabled", bordered(60, 40, color.White), Trim{}, image.Pt(100, 80)},
+	} {
+		img, err := tt.trim.Apply(tt.img)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		size := img.Bounds().Size()
+		if size != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, size, tt.want)
+		} else if size != tt.img.Bounds().Size() {
+			corner := img.At(img.Bounds().Min.X, img.Bounds().Min.Y)
+			if r, g, _, _ := corner.RGBA(); r>>8 != 255 || g != 0 {
+				t.Errorf("%s: the corner is %v, want the red content", tt.name, corner)
+			}
+		}
+	}
+
+	// the crop is relative to the trimmed image
+	options := &Options{Trim: Trim{Enabled: true}, Crop: Crop{Width: 10, Height: 10}}
+	images, err := Process("photo.png", bordered(60, 40, color.White), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, _, _ := images[0].Image.At(0, 0).RGBA(); r>>8 != 255 || g != 0 {
+		t.Errorf("the crop of the trimmed image starts with %v, want red", images[0].Image.At(0, 0))
+	}
+}
+
+func TestFlattenColor(t *testing.T) {
+	for _, tt := range []struct {
+		flattenColor string
+		want         color.NRGBA
+	}{
+		{"", color.NRGBA{R: 255, G: 255, B: 255}},
+		{"#00ff00", color.NRGBA{G: 255}},
+		{"navy", color.NRGBA{B: 128}},
+	} {
+		options := &Options{Format: "jpeg", FlattenColor: tt.flattenColor}
+		images, err := Process("photo.png", transparentLeft(40, 20), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := encode(t, &images[0], options)
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// JPEG is lossy
+		near := func(c color.Color, want color.NRGBA) bool {
+			r, g, b, _ := c.RGBA()
+			for _, d := range []int{int(r>>8) - int(want.R), int(g>>8) - int(want.G), int(b>>8) - int(want.B)} {
+				if d <= -8 || d >= 8 {
+					return false
+				}
+			}
+			return true
+		}
+		if c := img.At(5, 10); !near(c, tt.want) {
+			t.Errorf("flattenColor %q: the transparent half is %v, want %v", tt.flattenColor, c, tt.want)
+		}
+		if c := img.At(35, 10); !near(c, color.NRGBA{R: 255}) {
+			t.Errorf("flattenColor %q: the opaque half is %v, want red", tt.flattenColor, c)
+		}
+	}
+
+	options := &Options{Format: "png", FlattenColor: "#00ff00"}
+	images, err := Process("photo.png", transparentLeft(40, 20), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := alphaAt(images[0].Image, 5, 10); a != 0 {
+		t.Errorf("the PNG was flattened: alpha %d", a)
+	}
+}
+
+func TestResizeScale(t *testing.T) {
+	src := fill(1000, 600, color.White)
+	for _, tt := range []struct {
+		resize Resize
+		want   image.Point
+	}{
+		{Resize{Scale: 0.5}, image.Pt(500, 300)},
+		{Resize{Scale: 0.5, Width: 200, Height: 200}, image.Pt(500, 300)},
+		{Resize{Scale: 0.0001}, image.Pt(1, 1)},
+		{Resize{Scale: 2}, image.Pt(1000, 600)},
+		{Resize{Scale: 1.5, AllowUpscale: true}, image.Pt(1500, 900)},
+	} {
+		img, err := tt.resize.Apply(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.resize, size, tt.want)
+		}
+	}
+
+	if err := (&Options{Resize: Resize{Scale: -0.5}}).Validate(); err == nil {
+		t.Errorf("a negative scale was accepted")
+	}
+}
+
+func TestSmartFill(t *testing.T) {
+	// plain white apart from the detailed rectangle r
+	detailed := func(w, h int, r image.Rectangle) *image.NRGBA {
+		return imaging.Paste(fill(w, h, color.White), checker(r.Dx(), r.Dy(), 15), r.Min)
+	}
+	isDetail := func(img image.Image, x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r>>8 < 0xd0
+	}
+	for _, tt := range []struct {
+		name string
+		src  *image.NRGBA
+	}{
+		{"detail on the right", detailed(300, 100, image.Rect(200, 0, 300, 100))},
+		{"detail on the left", detailed(300, 100, image.Rect(0, 0, 100, 100))},
+		{"detail at the bottom", detailed(100, 300, image.Rect(0, 200, 100, 300))},
+	} {
+		resize := Resize{Width: 50, Height: 50, Mode: "fill", Smart: true}
+		img, err := resize.Apply(tt.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(50, 50) {
+			t.Fatalf("%s: got %v, want 50x50", tt.name, size)
+		}
+		if !isDetail(img, 25, 25) {
+			t.Errorf("%s: the center of the crop is %v, want the detail", tt.name, img.At(25, 25))
+		}
+		resize.Smart = false
+		if centered, _ := resize.Apply(tt.src); isDetail(centered, 25, 25) {
+			t.Errorf("%s: the centered crop has the detail as well, the test image is wrong", tt.name)
+		}
+	}
+
+	// the gradient is the same everywhere, the tie keeps the center
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.Gray{uint8(x)})
+		}
+	}
+	smart, err := (&Resize{Width: 100, Height: 100, Mode: "fill", Smart: true}).Apply(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	centered, _ := (&Resize{Width: 100, Height: 100, Mode: "fill"}).Apply(src)
+	if !samePixels(smart, centered) {
+		t.Errorf("a uniform image wasn't cropped at the center")
+	}
+
+	images, err := Process("photo.png", detailed(300, 100, image.Rect(200, 0, 300, 100)), &Options{
+		Thumbnails: []Thumb{{Suffix: "-square", Width: 30, Square: true, Smart: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb := images[1].Image; thumb.Bounds().Size() != image.Pt(30, 30) || !isDetail(thumb, 15, 15) {
+		t.Errorf("the smart square thumbnail is %v without the detail at its center", thumb.Bounds().Size())
+	}
+}
+
+func TestResizeBoundingBox(t *testing.T) {
+	bound := Resize{MaxWidth: 1920, MaxHeight: 1080}
+	for _, tt := range []struct {
+		name   string
+		src    image.Point
+		resize Resize
+		want   image.Point
+	}{
+		{"wide", image.Pt(3840, 1000), bound, image.Pt(1920, 500)},
+		{"tall", image.Pt(1000, 2160), bound, image.Pt(500, 1080)},
+		{"both over", image.Pt(3840, 3240), bound, image.Pt(1280, 1080)},
+		{"already small", image.Pt(800, 600), bound, image.Pt(800, 600)},
+		{"exactly the bounds", image.Pt(1920, 1080), bound, image.Pt(1920, 1080)},
+		{"only a max width", image.Pt(4000, 3000), Resize{MaxWidth: 1000}, image.Pt(1000, 750)},
+		// the bound applies after the other resizing and never upscales
+		{"after a resize", image.Pt(100, 100), Resize{Width: 400, AllowUpscale: true, MaxWidth: 200}, image.Pt(200, 200)},
+		{"after a small resize", image.Pt(1000, 500), Resize{Width: 100, MaxWidth: 200, MaxHeight: 200}, image.Pt(100, 50)},
+	} {
+		src := fill(tt.src.X, tt.src.Y, color.White)
+		img, err := tt.resize.Apply(src)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if size := img.Bounds().Size(); size != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, size, tt.want)
+		}
+		if tt.want == tt.src && img != image.Image(src) {
+			t.Errorf("%s: a fitting image wasn't passed through", tt.name)
+		}
+	}
+
+	if err := (&Options{Resize: Resize{MaxWidth: -1}}).Validate(); err == nil {
+		t.Errorf("a negative max width was accepted")
+	}
+}
+
+func TestCrops(t *testing.T) {
+	options := &Options{
+		Crops: []Crop{
+			{X: 100, Y: 40, Width: 200, Height: 100},
+			{Anchor: "bottomright", Width: 80, Height: 80},
+			{AspectRatio: "1:1", Anchor: "left"},
+		},
+		Thumbnails: []Thumb{{Suffix: "-small", Width: 40}},
+	}
+	images, err := Process("photo.png", coords(400, 200), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		name   string
+		size   image.Point
+		origin image.Point
+	}{
+		{"photo-crop1.png", image.Pt(200, 100), image.Pt(100, 40)},
+		{"photo-crop1-small.png", image.Pt(40, 20), image.Pt(-1, -1)},
+		{"photo-crop2.png", image.Pt(80, 80), image.Pt(320, 120)},
+		{"photo-crop2-small.png", image.Pt(40, 40), image.Pt(-1, -1)},
+		{"photo-crop3.png", image.Pt(200, 200), image.Pt(0, 0)},
+		{"photo-crop3-small.png", image.Pt(40, 40), image.Pt(-1, -1)},
+	} {
+		if i >= len(images) {
+			t.Fatalf("got %v, want 6 images", names(images))
+		}
+		img := images[i]
+		if img.Name != want.name || img.Image.Bounds().Size() != want.size {
+			t.Errorf("got %s of %v, want %s of %v", img.Name, img.Image.Bounds().Size(), want.name, want.size)
+		}
+		if want.origin.X >= 0 && originOf(img.Image) != want.origin {
+			t.Errorf("%s: cropped from %v, want %v", img.Name, originOf(img.Image), want.origin)
+		}
+	}
+	if predicted, ok := OutputNames("photo.png", options); !ok || strings.Join(predicted, ",") != strings.Join(names(images), ",") {
+		t.Errorf("predicted %v, want %v", predicted, names(images))
+	}
+	if name := OutputName("photo.png", options); name != "photo-crop1.png" {
+		t.Errorf("the formatted image is %s, want photo-crop1.png", name)
+	}
+
+	// each crop is checked against the bounds of the image
+	options.Crops[1] = Crop{X: 300, Width: 200, Height: 50}
+	if _, err := Process("photo.png", coords(400, 200), options); err == nil || !strings.Contains(err.Error(), "crops[1]") {
+		t.Errorf("got %v, want an error naming crops[1]", err)
+	}
+	if err := (&Options{Crops: []Crop{{Width: 10, Height: 10}, {Width: 0, Height: 10}}}).Validate(); err == nil {
+		t.Errorf("a crop without a width was accepted")
+	}
+}
+
+func TestColorModel(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 40, 20))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	cmyk := image.NewCMYK(image.Rect(0, 0, 40, 20))
+	for i := 0; i < len(cmyk.Pix); i += 4 {
+		cmyk.Pix[i], cmyk.Pix[i+1] = 0xff, 0x80
+	}
+
+	for _, tt := range []struct {
+		name    string
+		src     image.Image
+		options Options
+		want    color.Model
+	}{
+		{"gray as rgba", gray, Options{ColorModel: "rgba"}, color.RGBAModel},
+		{"cmyk as rgb", cmyk, Options{ColorModel: "RGB"}, color.RGBAModel},
+		{"transparent as rgb", transparentLeft(40, 20), Options{ColorModel: "rgb", FlattenColor: "#00ff00"}, color.RGBAModel},
+		{"color as gray", coords(40, 20), Options{ColorModel: "gray", Resize: Resize{Width: 20}}, color.GrayModel},
+	} {
+		tt.options.Thumbnails = []Thumb{{Suffix: "-small", Width: 10}}
+		images, err := Process("photo.png", tt.src, &tt.options)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		for _, img := range images {
+			if model := img.Image.ColorModel(); model != tt.want {
+				t.Errorf("%s: %s has the model %T, want %T", tt.name, img.Name, model, tt.want)
+			}
+			if tt.options.ColorModel != "rgba" && !img.Image.(interface{ Opaque() bool }).Opaque() {
+				t.Errorf("%s: %s isn't opaque", tt.name, img.Name)
+			}
+		}
+		if tt.options.FlattenColor != "" {
+			if got := color.RGBAModel.Convert(images[0].Image.At(0, 0)); got != (color.RGBA{G: 0xff, A: 0xff}) {
+				t.Errorf("%s: the transparent half is %v, want the flatten color", tt.name, got)
+			}
+		}
+	}
+
+	// the gray source comes out as it was, only in another model
+	images, err := Process("photo.png", gray, &Options{ColorModel: "rgba"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := images[0].Image.At(5, 1).RGBA(); r>>8 != 45 || g != r || b != r {
+		t.Errorf("got %v, want the gray 45", images[0].Image.At(5, 1))
+	}
+	data, _ := encode(t, &images[0], &Options{})
+	if decoded, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if _, ok := decoded.(*image.Gray); ok {
+		t.Errorf("the rgba output was encoded as a gray PNG")
+	}
+
+	for _, options := range []Options{{ColorModel: "cmyk"}, {ColorModel: "rgb", Circle: true}} {
+		if err := options.Validate(); err == nil {
+			t.Errorf("%+v was accepted", options)
+		}
+	}
+}
+
+func TestFormatsFlattenOnlyJPEG(t *testing.T) {
+	options := &Options{
+		Formats:    []string{"jpeg", "png"},
+		Thumbnails: []Thumb{{Suffix: "-small", Width: 10, Height: 10}},
+	}
+	images, err := Process("photo.png", transparentLeft(40, 40), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"photo.jpg", "photo.png", "photo-small.jpg", "photo-small.png"}
+	if got := names(images); len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	signatures := map[string]string{"image/jpeg": "\xff\xd8\xff", "image/png": "\x89PNG"}
+	for i, img := range images {
+		if img.Name != want[i] {
+			t.Errorf("images[%d] is %s, want %s", i, img.Name, want[i])
+		}
+		data, contentType := encode(t, &img, options)
+		if !bytes.HasPrefix(data, []byte(signatures[contentType])) {
+			t.Errorf("%s isn't a %s", img.Name, contentType)
+		}
+		a := alphaAt(img.Image, 0, 0)
+		if contentType == "image/png" && a != 0 {
+			t.Errorf("%s lost its transparency: alpha %d", img.Name, a)
+		}
+		if contentType == "image/jpeg" && a != 255 {
+			t.Errorf("%s wasn't flattened: alpha %d", img.Name, a)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//go:build libjpeg
+
+package imageproc
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct error_mgr {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+// libjpeg calls exit() on errors by default
+static void error_exit(j_common_ptr cinfo) {
+	struct error_mgr *err = (struct error_mgr *)cinfo->err;
+	longjmp(err->jump, 1);
+}
+
+static int encode_progressive(unsigned char *pixels, int width, int height, int quality,
+                              unsigned char **out, unsigned long *size) {
+	struct jpeg_compress_struct cinfo;
+	struct error_mgr jerr;
+
+	cinfo.err = jpeg_std_error(&jerr.pub);
+	jerr.pub.error_exit = error_exit;
+	if (setjmp(jerr.jump)) {
+		jpeg_destroy_compress(&cinfo);
+		return 1;
+	}
+
+	jpeg_create_compress(&cinfo);
+	jpeg_mem_dest(&cinfo, out, size);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	cinfo.input_components = 3;
+	cinfo.in_color_space = JCS_RGB;
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_quality(&cinfo, quality, TRUE);
+	jpeg_simple_progression(&cinfo);
+
+	jpeg_start_compress(&cinfo, TRUE);
+	while (cinfo.next_scanline < cinfo.image_height) {
+		JSAMPROW row = &pixels[cinfo.next_scanline * width * 3];
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"io"
+	"unsafe"
+
+	"github.com/disintegration/imaging"
+)
+
+// The standard library has no progressive JPEG encoder, so it is done with
+// libjpeg through cgo, only included with -tags libjpeg.
+func init() {
+	encodeProgressiveJPEG = func(w io.Writer, img image.Image, quality int) error {
+		if quality == 0 {
+			// the imaging default, so that only the scan layout differs
+			quality = 95
+		}
+		src := imaging.Clone(img)
+		size := src.Bounds().Size()
+		if size.X == 0 || size.Y == 0 {
+			return errors.New("cannot encode an empty image")
+		}
+
+		// JPEG has no alpha channel, the image is flattened beforehand
+		rgb := make([]byte, 0, size.X*size.Y*3)
+		for i := 0; i < len(src.Pix); i += 4 {
+			rgb = append(rgb, src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+		}
+
+		var out *C.uchar
+		var outSize C.ulong
+		failed := C.encode_progressive((*C.uchar)(unsafe.Pointer(&rgb[0])), C.int(size.X), C.int(size.Y),
+			C.int(quality), &out, &outSize)
+		if out != nil {
+			defer C.free(unsafe.Pointer(out))
+		}
+		if failed != 0 {
+			return errors.New("libjpeg failed to encode the image")
+		}
+		_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(outSize)))
+		return err
+	}
+}
@@ -0,0 +1,28 @@
+//go:build libjpeg
+
+package imageproc
+
+import (
+	"bytes"
+	"image/jpeg"
+	"testing"
+)
+
+func TestEncodeProgressiveJPEG(t *testing.T) {
+	img := &ProcessedImage{Name: "photo.jpg", Image: noise(64, 32)}
+	data, contentType := encode(t, img, &Options{Progressive: true, Quality: 80})
+	if contentType != "image/jpeg" {
+		t.Errorf("content type %q, want image/jpeg", contentType)
+	}
+	// SOF2 starts the frame of progressive JPEGs, SOF0 the baseline ones
+	if !bytes.Contains(data, []byte{0xff, 0xc2}) || bytes.Contains(data, []byte{0xff, 0xc0}) {
+		t.Error("the output isn't a progressive JPEG")
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := decoded.Bounds().Size(); size.X != 64 || size.Y != 32 {
+		t.Errorf("decoded %v, want 64x32", size)
+	}
+}
@@ -0,0 +1,85 @@
+package imageproc
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartFill resizes img to cover w x h and crops the window with the most
+// edge energy, instead of the one at a fixed anchor, so that the detailed
+// subject of the image is kept.
+func smartFill(img image.Image, w int, h int, filter imaging.ResampleFilter) *image.NRGBA {
+	size := img.Bounds().Size()
+	var covered *image.NRGBA
+	// same as imaging.Fill, resize along the dimension that needs the least scaling
+	if float64(size.X)/float64(size.Y) < float64(w)/float64(h) {
+		covered = imaging.Resize(img, w, 0, filter)
+	} else {
+		covered = imaging.Resize(img, 0, h, filter)
+	}
+	return imaging.Crop(covered, smartWindow(covered, w, h))
+}
+
+// smartWindow returns the w x h window of img with the highest sum of
+// luminance gradients. img overflows w x h in at most one dimension, so the
+// window only slides along that one. Ties are broken towards the center.
+func smartWindow(img *image.NRGBA, w int, h int) image.Rectangle {
+	size := img.Bounds().Size()
+	horizontal := size.X > w
+	length, window := size.Y, h
+	if horizontal {
+		length, window = size.X, w
+	}
+	if length <= window {
+		return image.Rect(0, 0, min(w, size.X), min(h, size.Y))
+	}
+
+	luma := func(x, y int) int {
+		i := y*img.Stride + x*4
+		return (299*int(img.Pix[i]) + 587*int(img.Pix[i+1]) + 114*int(img.Pix[i+2])) / 1000
+	}
+	// energy of every column, or row, along the sliding direction
+	energy := make([]int, length)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			e := 0
+			if x+1 < size.X {
+				e += abs(luma(x+1, y) - luma(x, y))
+			}
+			if y+1 < size.Y {
+				e += abs(luma(x, y+1) - luma(x, y))
+			}
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+
+	sum := 0
+	for i := 0; i < window; i++ {
+		sum += energy[i]
+	}
+	center := (length - window) / 2
+	best, bestSum := 0, sum
+	for offset := 1; offset+window <= length; offset++ {
+		sum += energy[offset+window-1] - energy[offset-1]
+		if sum > bestSum || (sum == bestSum && abs(offset-center) < abs(best-center)) {
+			best, bestSum = offset, sum
+		}
+	}
+
+	if horizontal {
+		return image.Rect(best, 0, best+w, h)
+	}
+	return image.Rect(0, best, w, best+h)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,275 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/logging"
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// Source is a decoded input image.
+type Source struct {
+	Image image.Image
+	// Animation is set for animated GIFs. Image is then its first frame
+	Animation *gif.GIF
+	// ICC is the source color profile, only extracted with Options.PreserveICC
+	ICC []byte
+	// Date is the EXIF capture date, only read when a name template uses
+	// {date:layout}. It is zero when unknown
+	Date   time.Time
+	frames []image.Image
+}
+
+// Decode decodes the image read from r, keeping every frame of animated GIFs.
+func Decode(r io.Reader, options *Options) (*Source, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(anim.Image) > 1 {
+			frames := composeFrames(anim)
+			return &Source{Image: frames[0], Animation: anim, frames: frames}, nil
+		}
+	}
+
+	if options.Page > 0 {
+		if !isTIFF(data) {
+			return nil, errors.New("page is only supported for tiff sources")
+		}
+		if data, err = tiffPage(data, options.Page); err != nil {
+			return nil, err
+		}
+		img, err := tiff.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return &Source{Image: img}, nil
+	}
+
+	if IsHEIF(data) {
+		if decodeHEIF == nil {
+			return nil, errors.New("heic input requires building with -tags heif")
+		}
+		img, err := decodeHEIF(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Source{Image: img}, nil
+	}
+
+	// imaging can't decode WebP
+	if isWebP(data) {
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return &Source{Image: img}, nil
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(options.ShouldAutoOrient()))
+	if err != nil {
+		return nil, err
+	}
+	src := &Source{Image: img}
+	if options.PreserveICC && !options.StripMetadata {
+		src.ICC = extractICC(data)
+	}
+	if options.usesDate() {
+		src.Date = extractDate(data)
+	}
+	return src, nil
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// decodeHEIF is set when built with the heif tag.
+var decodeHEIF func(data []byte) (image.Image, error)
+
+// heifBrands are the major brands of the ftyp box identifying HEIC / HEIF files.
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true,
+	"heim": true, "heis": true, "mif1": true, "msf1": true,
+}
+
+// IsHEIF reports whether data starts like a HEIC / HEIF file.
+func IsHEIF(data []byte) bool {
+	return len(data) >= 12 && string(data[4:8]) == "ftyp" && heifBrands[string(data[8:12])]
+}
+
+func isTIFF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// tiffPage returns the TIFF with its first IFD offset pointing at the IFD of
+// the page, as tiff.Decode only reads the first one. The other offsets in the
+// file are absolute, so the rest of the data stays valid.
+func tiffPage(data []byte, page int) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errors.New("invalid tiff header")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	offset := order.Uint32(data[4:])
+	for i := 0; i < page; i++ {
+		if uint64(offset)+2 > uint64(len(data)) {
+			return nil, errors.New("invalid tiff ifd offset")
+		}
+		entries := uint64(order.Uint16(data[offset:]))
+		next := uint64(offset) + 2 + entries*12
+		if next+4 > uint64(len(data)) {
+			return nil, errors.New("invalid tiff ifd offset")
+		}
+		offset = order.Uint32(data[next:])
+		if offset == 0 {
+			return nil, fmt.Errorf("page %d is out of range, the tiff has %d page(s)", page, i+1)
+		}
+	}
+
+	result := append([]byte{}, data...)
+	order.PutUint32(result[4:], offset)
+	return result, nil
+}
+
+// IsSupportedInput reports whether the file extension is one Decode can read.
+func IsSupportedInput(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".webp", ".heic", ".heif":
+		return true
+	}
+	_, err := imaging.FormatFromFilename(path)
+	return err == nil
+}
+
+// Process runs the source through Process, frame by frame for animations,
+// and carries its ICC profile over to the results.
+func (s *Source) Process(name string, options *Options) ([]ProcessedImage, error) {
+	options = withDate(options, s.Date)
+	if s.Animation != nil {
+		return processAnimation(name, s.Animation, s.frames, options)
+	}
+
+	result, err := Process(name, s.Image, options)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].ICC = s.ICC
+	}
+	return result, nil
+}
+
+// withDate returns the options with the {date:layout} tokens of the name
+// templates replaced by date, or "unknown" when it is zero.
+func withDate(options *Options, date time.Time) *Options {
+	if !options.usesDate() {
+		return options
+	}
+	expand := func(template string) string {
+		return dateToken.ReplaceAllStringFunc(template, func(token string) string {
+			if date.IsZero() {
+				return "unknown"
+			}
+			return date.Format(dateToken.FindStringSubmatch(token)[1])
+		})
+	}
+
+	result := *options
+	result.NameTemplate = expand(options.NameTemplate)
+	result.Thumbnails = make([]Thumb, len(options.Thumbnails))
+	for i, t := range options.Thumbnails {
+		t.NameTemplate = expand(t.NameTemplate)
+		result.Thumbnails[i] = t
+	}
+	return &result
+}
+
+var dateToken = regexp.MustCompile(`\{date:([^}]*)\}`)
+
+// processAnimation runs every composed frame of the animation through
+// Process and assembles the results into animations with the original timing.
+// Every processed frame is quantized to its own palette of Options.Palette
+// colors, 256 by default, since resizing and adjusting blend in colors the
+// source palette lacks.
+func processAnimation(name string, anim *gif.GIF, frames []image.Image, options *Options) ([]ProcessedImage, error) {
+	logging.Debugf("Processing %d frames.\n", len(frames))
+	colors := options.Palette
+	if colors == 0 {
+		colors = 256
+	}
+
+	var result []ProcessedImage
+	for i := range frames {
+		images, err := Process(name, frames[i], options)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = images
+			for j := range result {
+				result[j].Animation = &gif.GIF{LoopCount: anim.LoopCount}
+			}
+		}
+		for j, img := range images {
+			result[j].Animation.Image = append(result[j].Animation.Image, quantize(img.Image, colors))
+			result[j].Animation.Delay = append(result[j].Animation.Delay, anim.Delay[i])
+		}
+	}
+	return result, nil
+}
+
+// composeFrames renders the GIF frames, which may only cover part of the
+// canvas, into full images honoring their disposal methods.
+func composeFrames(anim *gif.GIF) []image.Image {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = anim.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(bounds)
+	frames := make([]image.Image, len(anim.Image))
+
+	for i, frame := range anim.Image {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames[i] = imaging.Clone(canvas)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
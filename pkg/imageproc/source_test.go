@@ -0,0 +1,238 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// testGIF returns an animated GIF of frames w x h frames, each of a single
+// color of the palette {red, blue}.
+func testGIF(t *testing.T, w, h int, frames int) []byte {
+	t.Helper()
+	palette := color.Palette{color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i % 2)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimationIsResized(t *testing.T) {
+	options := &Options{Resize: Resize{Width: 10}, Rotate: 90}
+	src, err := Decode(bytes.NewReader(testGIF(t, 40, 20, 3)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("anim.gif", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, contentType := encode(t, &images[0], options)
+	if contentType != "image/gif" {
+		t.Errorf("content type %q, want image/gif", contentType)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 3 {
+		t.Fatalf("got %d frames, want 3", len(anim.Image))
+	}
+	for i, frame := range anim.Image {
+		if size := frame.Bounds().Size(); size != image.Pt(10, 20) {
+			t.Errorf("frame %d is %v, want the rotated and resized 10x20", i, size)
+		}
+		if anim.Delay[i] != 10*(i+1) {
+			t.Errorf("frame %d has the delay %d, want %d", i, anim.Delay[i], 10*(i+1))
+		}
+	}
+	if anim.LoopCount != 0 {
+		t.Errorf("the loop count is %d, want 0, forever", anim.LoopCount)
+	}
+}
+
+// testWebP is an 8x4 lossless WebP, red on the left half and blue on the right.
+const testWebP = "UklGRh4AAABXRUJQVlA4TBIAAAAvB8AAAA8Q87//8x8O+hDR/wA="
+
+func TestDecodeWebP(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Decode(bytes.NewReader(data), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("photo.png", &Options{Resize: Resize{Width: 4, Filter: "nearest"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := images[0].Image
+	if size := img.Bounds().Size(); size != image.Pt(4, 2) {
+		t.Fatalf("got %v, want 4x2", size)
+	}
+	if r, _, b, _ := img.At(0, 0).RGBA(); r>>8 != 255 || b != 0 {
+		t.Errorf("the left half is %v, want red", img.At(0, 0))
+	}
+	if r, _, b, _ := img.At(3, 1).RGBA(); r != 0 || b>>8 != 255 {
+		t.Errorf("the right half is %v, want blue", img.At(3, 1))
+	}
+}
+
+// testHEIC is a 64x32 HEIC, red on the left half and blue on the right.
+const testHEIC = "AAAAHGZ0eXBoZWljAAAAAG1pZjFoZWljbWlhZgAAAa1tZXRhAAAAAAAAACFoZGxyAAAAAAAAAABwaWN0AAAAAAAAAAAAAAAAAAAAAA5waXRtAAAAAAACAAAAEGlkYXQAAAAAAEAAIAAAADhpbG9jAQAAAERAAAIAAQAAAAAAAAHRAAEAAAAAAAAAjgACAAEAAAAAAAAAAQAAAAAAAAAIAAAAOGlpbmYAAAAAAAIAAAAVaW5mZQIAAAEAAQAAaHZjMQAAAAAVaW5mZQIAAAAAAgAAZ3JpZAAAAADYaXBycAAAALZpcGNvAAAAdmh2Y0MBA3AAAAAAAAAAAAAe8AD8/fj4AAAPAyAAAQAYQAEMAf//A3AAAAMAkAAAAwAAAwAeugJAIQABACpCAQEDcAAAAwCQAAADAAADAB6gIIEFlurkprm4EBAwIAAAAwAgAAADACEiAAEABkQBwXPAiQAAABRpc3BlAAAAAAAAAEAAAABAAAAAFGlzcGUAAAAAAAAAQAAAACAAAAAQcGl4aQAAAAADCAgIAAAAGmlwbWEAAAAAAAAAAgABAoECAAICA4QAAAAaaXJlZgAAAAAAAAAOZGltZwACAAEAAQAAAJZtZGF0AAAAiigBrwY4iS58L/ajX///stn9l/kw5KaZf4+hXI/5ViP//4zGpv/ATs0T9bJQ1ZyXuwR0xhlteo5eLFSIzQB/A9kJdqtANlHYrs2PVlrKD+BExrceEWBQc6h2fsAGDTLg5qUV1HDk5xqStZ1z8JLDjk270qmXo9qTvp6BzVf396AplRBiSls9IaERwA=="
+
+// testTIFF returns an uncompressed, little endian, grayscale TIFF with a page
+// per size, page i filled with the gray 50 * (i + 1).
+func testTIFF(pages ...image.Point) []byte {
+	le := binary.LittleEndian
+	data := []byte("II*\x00\x00\x00\x00\x00")
+	next := 4 // the offset pointing at the next IFD
+	for i, size := range pages {
+		pixels := len(data)
+		data = append(data, bytes.Repeat([]byte{byte(50 * (i + 1))}, size.X*size.Y)...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+		le.PutUint32(data[next:], uint32(len(data)))
+
+		entries := [][2]uint32{
+			{256, uint32(size.X)}, {257, uint32(size.Y)}, {258, 8}, {259, 1}, {262, 1},
+			{273, uint32(pixels)}, {277, 1}, {278, uint32(size.Y)}, {279, uint32(size.X * size.Y)},
+		}
+		data = le.AppendUint16(data, uint16(len(entries)))
+		for _, e := range entries {
+			// every value as a LONG
+			data = le.AppendUint16(data, uint16(e[0]))
+			data = le.AppendUint16(data, 4)
+			data = le.AppendUint32(data, 1)
+			data = le.AppendUint32(data, e[1])
+		}
+		next = len(data)
+		data = le.AppendUint32(data, 0)
+	}
+	return data
+}
+
+func TestDecodeTIFFPage(t *testing.T) {
+	data := testTIFF(image.Pt(8, 4), image.Pt(6, 6))
+	for page, want := range []struct {
+		size image.Point
+		gray uint8
+	}{{image.Pt(8, 4), 50}, {image.Pt(6, 6), 100}} {
+		src, err := Decode(bytes.NewReader(data), &Options{Page: page})
+		if err != nil {
+			t.Fatalf("page %d: %s", page, err)
+		}
+		if size := src.Image.Bounds().Size(); size != want.size {
+			t.Errorf("page %d is %v, want %v", page, size, want.size)
+		}
+		if c := color.GrayModel.Convert(src.Image.At(1, 1)).(color.Gray); c.Y != want.gray {
+			t.Errorf("page %d is %v, want the gray %d", page, c, want.gray)
+		}
+	}
+
+	if _, err := Decode(bytes.NewReader(data), &Options{Page: 2}); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("got %v for page 2, want an out of range error", err)
+	}
+	if _, err := Decode(bytes.NewReader(testGIF(t, 4, 4, 1)), &Options{Page: 1}); err == nil {
+		t.Error("a page of a gif source didn't fail")
+	}
+}
+
+// testDatedJPEG returns a w x h JPEG with the EXIF DateTimeOriginal date, in
+// the format 2006:01:02 15:04:05.
+func testDatedJPEG(t *testing.T, w, h int, date string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, fill(w, h, color.White), nil); err != nil {
+		t.Fatal(err)
+	}
+	// a big endian TIFF header, an IFD pointing to the EXIF IFD at 26, which
+	// holds DateTimeOriginal at 44
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01\x87\x69\x00\x04\x00\x00\x00\x01\x00\x00\x00\x1a\x00\x00\x00\x00" +
+		"\x00\x01\x90\x03\x00\x02\x00\x00\x00\x14\x00\x00\x00\x2c\x00\x00\x00\x00" +
+		date + "\x00")
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(segment, exif...)...), data[2:]...)
+}
+
+func TestDateInTheNameTemplate(t *testing.T) {
+	options := &Options{Thumbnails: []Thumb{{Suffix: "-small", Width: 10, NameTemplate: "{date:2006-01-02}_{base}{suffix}{ext}"}}}
+	undated, _ := encode(t, &ProcessedImage{Name: "photo.jpg", Image: fill(40, 20, color.White)}, &Options{})
+	for _, tt := range []struct {
+		data []byte
+		want string
+	}{
+		{testDatedJPEG(t, 40, 20, "2023:07:14 10:30:00"), "dir/2023-07-14_photo-small.jpg"},
+		{undated, "dir/unknown_photo-small.jpg"},
+	} {
+		src, err := Decode(bytes.NewReader(tt.data), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images, err := src.Process("dir/photo.jpg", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 2 || images[1].Name != tt.want {
+			t.Errorf("got %v, want %s", names(images), tt.want)
+		}
+	}
+
+	// the date is only read when a template uses it
+	src, err := Decode(bytes.NewReader(testDatedJPEG(t, 40, 20, "2023:07:14 10:30:00")), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !src.Date.IsZero() {
+		t.Errorf("read the date %v without a template using it", src.Date)
+	}
+}
+
+func TestAnimationFramesGetTheirOwnPalette(t *testing.T) {
+	options := &Options{Grayscale: true, Palette: 16}
+	src, err := Decode(bytes.NewReader(testGIF(t, 20, 10, 3)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("anim.gif", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim := images[0].Animation
+	if anim == nil || len(anim.Image) != 3 {
+		t.Fatalf("got %v, want an animation of 3 frames", anim)
+	}
+	if anim.Delay[2] != 30 {
+		t.Errorf("the delay of the last frame is %d, want 30", anim.Delay[2])
+	}
+	for i, frame := range anim.Image {
+		if len(frame.Palette) > 16 {
+			t.Errorf("frame %d has %d colors, want at most 16", i, len(frame.Palette))
+		}
+		// snapped to the red and blue source palette, the gray would be lost
+		if r, g, b, _ := frame.At(5, 5).RGBA(); r != g || g != b {
+			t.Errorf("frame %d is %v, want gray", i, frame.At(5, 5))
+		}
+	}
+}
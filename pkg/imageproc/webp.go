@@ -0,0 +1,20 @@
+//go:build webp
+
+package imageproc
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// The WebP encoder needs cgo, so it's only included with -tags webp.
+func init() {
+	encodeWebP = func(w io.Writer, img image.Image, quality int) error {
+		if quality == 0 {
+			quality = 75
+		}
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	}
+}
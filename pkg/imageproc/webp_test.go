@@ -0,0 +1,142 @@
+//go:build webp
+
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	images := process(t, "photo.png", noise(64, 32), &Options{Format: "webp", Resize: Resize{Width: 32}})
+	if images[0].Name != "photo.webp" {
+		t.Fatalf("named %s, want photo.webp", images[0].Name)
+	}
+	low, _ := encode(t, &images[0], &Options{Quality: 20})
+	high, _ := encode(t, &images[0], &Options{Quality: 90})
+	if len(low) >= len(high) {
+		t.Errorf("quality 20 encoded %d bytes, quality 90 %d, want fewer", len(low), len(high))
+	}
+	src, err := Decode(bytes.NewReader(high), &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := src.Image.Bounds().Size(); size != image.Pt(32, 16) {
+		t.Errorf("decoded %v, want 32x16", size)
+	}
+}
+
+// riffChunk is a chunk of a WebP file.
+type riffChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+// webpChunks returns the top level chunks of a WebP file.
+func webpChunks(t *testing.T, data []byte) []riffChunk {
+	t.Helper()
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatalf("not a webp file")
+	}
+	if size := int(binary.LittleEndian.Uint32(data[4:8])); size != len(data)-8 {
+		t.Fatalf("the RIFF size is %d, want %d", size, len(data)-8)
+	}
+	var chunks []riffChunk
+	for rest := data[12:]; len(rest) > 0; {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		end := 8 + size + size%2
+		if len(rest) < end {
+			t.Fatalf("truncated %s chunk", rest[0:4])
+		}
+		chunks = append(chunks, riffChunk{string(rest[0:4]), rest[8 : 8+size]})
+		rest = rest[end:]
+	}
+	return chunks
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	options := &Options{Format: "webp", Resize: Resize{Width: 20}}
+	src, err := Decode(bytes.NewReader(testGIF(t, 40, 20, 3)), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := src.Process("anim.gif", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, contentType := encode(t, &images[0], options)
+	if images[0].Name != "anim.webp" || contentType != "image/webp" {
+		t.Fatalf("got %s as %s, want anim.webp", images[0].Name, contentType)
+	}
+
+	chunks := webpChunks(t, data)
+	if len(chunks) < 2 || chunks[0].fourCC != "VP8X" || chunks[1].fourCC != "ANIM" {
+		t.Fatalf("the file starts with %v, want VP8X and ANIM", chunks)
+	}
+	vp8x := chunks[0].payload
+	if vp8x[0]&0x02 == 0 {
+		t.Errorf("the animation flag isn't set")
+	}
+	if w, h := int(vp8x[4])|int(vp8x[5])<<8|int(vp8x[6])<<16, int(vp8x[7])|int(vp8x[8])<<8|int(vp8x[9])<<16; w != 19 || h != 9 {
+		t.Errorf("the canvas is %dx%d, want 20x10", w+1, h+1)
+	}
+	// testGIF loops forever
+	if loops := binary.LittleEndian.Uint16(chunks[1].payload[4:]); loops != 0 {
+		t.Errorf("the loop count is %d, want 0, forever", loops)
+	}
+
+	var frames []riffChunk
+	for _, c := range chunks[2:] {
+		if c.fourCC == "ANMF" {
+			frames = append(frames, c)
+		}
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	for i, frame := range frames {
+		header := frame.payload[:16]
+		// testGIF delays are 10, 20 and 30 hundredths of a second
+		if duration := int(header[12]) | int(header[13])<<8 | int(header[14])<<16; duration != 100*(i+1) {
+			t.Errorf("frame %d lasts %dms, want %d", i, duration, 100*(i+1))
+		}
+		// the frame data as a still WebP
+		still := append([]byte("RIFF\x00\x00\x00\x00WEBP"), frame.payload[16:]...)
+		binary.LittleEndian.PutUint32(still[4:], uint32(len(still)-8))
+		img, err := webp.Decode(bytes.NewReader(still))
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+		// testGIF alternates red and blue frames
+		r, _, b, _ := img.At(10, 5).RGBA()
+		if red := i%2 == 0; red != (r > b) {
+			t.Errorf("frame %d is %v", i, img.At(10, 5))
+		}
+	}
+}
+
+func TestFormatsJPEGAndWebP(t *testing.T) {
+	options := &Options{Formats: []string{"jpeg", "webp"}}
+	images, err := Process("photo.png", transparentLeft(40, 40), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Name != "photo.jpg" || images[1].Name != "photo.webp" {
+		t.Fatalf("got %v, want photo.jpg and photo.webp", names(images))
+	}
+	jpeg, _ := encode(t, &images[0], options)
+	if !bytes.HasPrefix(jpeg, []byte("\xff\xd8\xff")) {
+		t.Errorf("%s isn't a JPEG", images[0].Name)
+	}
+	webp, contentType := encode(t, &images[1], options)
+	if contentType != "image/webp" || len(webp) < 12 || string(webp[:4]) != "RIFF" || string(webp[8:12]) != "WEBP" {
+		t.Errorf("%s isn't a WebP", images[1].Name)
+	}
+	if a := alphaAt(images[1].Image, 0, 0); a != 0 {
+		t.Errorf("%s lost its transparency: alpha %d", images[1].Name, a)
+	}
+}
@@ -0,0 +1,133 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/gif"
+	"io"
+)
+
+// encodeAnimatedWebP encodes every frame of the animation with encodeWebP and
+// muxes the frames into an animated WebP container, keeping the delays and the
+// loop count. The frames cover the whole canvas, see processAnimation, so they
+// replace each other without blending.
+func encodeAnimatedWebP(w io.Writer, anim *gif.GIF, quality int) error {
+	if encodeWebP == nil {
+		return errors.New("webp output requires building with -tags webp")
+	}
+	if len(anim.Image) == 0 {
+		return errors.New("animation has no frames")
+	}
+	bounds := anim.Image[0].Bounds()
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	var frames bytes.Buffer
+	alpha := false
+	for i, frame := range anim.Image {
+		var still bytes.Buffer
+		if err := encodeWebP(&still, frame, quality); err != nil {
+			return err
+		}
+		chunks, err := webpImageChunks(still.Bytes())
+		if err != nil {
+			return fmt.Errorf("frame %d: %v", i, err)
+		}
+		// lossy frames with transparency start with an ALPH chunk, VP8L carries its own alpha
+		if kind := string(chunks[:4]); kind == "ALPH" || kind == "VP8L" {
+			alpha = true
+		}
+
+		size := frame.Bounds().Size()
+		var header [16]byte
+		putUint24(header[0:], 0)
+		putUint24(header[3:], 0)
+		putUint24(header[6:], size.X-1)
+		putUint24(header[9:], size.Y-1)
+		delay := 0
+		if i < len(anim.Delay) {
+			// GIF delays are in hundredths of a second, WebP ones in milliseconds
+			delay = anim.Delay[i] * 10
+		}
+		putUint24(header[12:], delay)
+		// do not blend with the previous frame, keep it as the canvas
+		header[15] = 0x02
+		writeWebPChunk(&frames, "ANMF", append(header[:], chunks...))
+	}
+
+	var vp8x [10]byte
+	// animation flag, and the alpha flag when a frame may be transparent
+	vp8x[0] = 0x02
+	if alpha {
+		vp8x[0] |= 0x10
+	}
+	putUint24(vp8x[4:], bounds.Dx()-1)
+	putUint24(vp8x[7:], bounds.Dy()-1)
+	writeWebPChunk(&body, "VP8X", vp8x[:])
+
+	var animChunk [6]byte
+	// transparent background, the loop count of GIF counts the repetitions
+	// after the first play while the one of WebP counts every play
+	loops := 0
+	switch {
+	case anim.LoopCount < 0:
+		loops = 1
+	case anim.LoopCount > 0:
+		loops = anim.LoopCount + 1
+	}
+	binary.LittleEndian.PutUint16(animChunk[4:], uint16(min(loops, 0xffff)))
+	writeWebPChunk(&body, "ANIM", animChunk[:])
+	frames.WriteTo(&body)
+
+	var riff [8]byte
+	copy(riff[:], "RIFF")
+	binary.LittleEndian.PutUint32(riff[4:], uint32(body.Len()))
+	if _, err := w.Write(riff[:]); err != nil {
+		return err
+	}
+	_, err := body.WriteTo(w)
+	return err
+}
+
+// webpImageChunks returns the ALPH, VP8 and VP8L chunks of a still WebP file,
+// the part of it that makes up an animation frame.
+func webpImageChunks(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp file")
+	}
+	var chunks []byte
+	for rest := data[12:]; len(rest) >= 8; {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		end := 8 + size + size%2
+		if end > len(rest) {
+			return nil, errors.New("truncated webp chunk")
+		}
+		switch string(rest[0:4]) {
+		case "ALPH", "VP8 ", "VP8L":
+			chunks = append(chunks, rest[:end]...)
+		}
+		rest = rest[end:]
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("webp file without image data")
+	}
+	return chunks, nil
+}
+
+// writeWebPChunk writes a RIFF chunk, padded to an even size.
+func writeWebPChunk(buf *bytes.Buffer, fourCC string, payload []byte) {
+	var header [8]byte
+	copy(header[:], fourCC)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	buf.Write(header[:])
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
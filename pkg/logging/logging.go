@@ -0,0 +1,56 @@
+// Package logging is a leveled wrapper around the standard logger, shared by
+// the CLI, the Web API and the imageproc package.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levels = map[string]Level{
+	"debug":   Debug,
+	"info":    Info,
+	"warn":    Warn,
+	"warning": Warn,
+	"error":   Error,
+}
+
+// level is set once on startup, before any goroutine logs.
+var level = Info
+
+// ParseLevel returns the level named debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	l, ok := levels[strings.ToLower(name)]
+	if !ok {
+		return Info, fmt.Errorf("unknown log level %q", name)
+	}
+	return l, nil
+}
+
+// SetLevel discards the messages below l. Default: Info
+func SetLevel(l Level) {
+	level = l
+}
+
+func Debugf(format string, v ...interface{}) { output(Debug, format, v...) }
+func Infof(format string, v ...interface{})  { output(Info, format, v...) }
+func Warnf(format string, v ...interface{})  { output(Warn, format, v...) }
+func Errorf(format string, v ...interface{}) { output(Error, format, v...) }
+
+func output(l Level, format string, v ...interface{}) {
+	if l < level {
+		return
+	}
+	// skip output and the level function
+	log.Output(3, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+		SetLevel(Info)
+	})
+
+	for name, want := range map[string]string{
+		"debug": "debug info warn error",
+		"INFO":  "info warn error",
+		"warn":  "warn error",
+		"error": "error",
+	} {
+		l, err := ParseLevel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetLevel(l)
+		buf.Reset()
+		Debugf("debug\n")
+		Infof("info\n")
+		Warnf("%s\n", "warn")
+		Errorf("error")
+		if got := strings.Join(strings.Fields(buf.String()), " "); got != want {
+			t.Errorf("at %s logged %q, want %q", name, got, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("an unknown level didn't fail")
+	}
+}
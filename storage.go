@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+)
+
+// Storage is where the processed images are written, by both the Web API and
+// the CLI, and where the Web API keeps the originals and serves, lists and
+// deletes the images from. Names are relative to the root of the storage.
+type Storage interface {
+	// Save encodes the image under name and returns its location, a path or
+	// URL, and its size in bytes.
+	Save(name string, img *imageproc.ProcessedImage, options *imageproc.Options) (string, int64, error)
+	// Put writes data, e.g. an uploaded original, under name and returns its location.
+	Put(name string, data []byte) (string, error)
+	// Open returns the content of the image saved under name and its
+	// description. Like Remove, it fails with an error matching
+	// fs.ErrNotExist when nothing is saved under name.
+	Open(name string) (io.ReadSeekCloser, StoredImage, error)
+	// List returns the images at the root whose name starts with prefix, sorted by name.
+	List(prefix string) ([]StoredImage, error)
+	// Remove deletes the image saved under name.
+	Remove(name string) error
+	// Location returns the location Save and Put report for name.
+	Location(name string) string
+	// Check fails when nothing can be written to the storage.
+	Check() error
+}
+
+// storage is set from -storage.
+var storage Storage = &localStorage{}
+
+// newStorage returns the storage named by kind: local, writing below root,
+// or s3, writing to bucket with the credentials and region of the environment.
+func newStorage(kind string, bucket string, root string) (Storage, error) {
+	switch kind {
+	case "", "local":
+		return &localStorage{root: root}, nil
+	case "s3":
+		if bucket == "" {
+			return nil, fmt.Errorf("the s3 storage requires a bucket")
+		}
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &s3Storage{client: s3.NewFromConfig(cfg), bucket: bucket}, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q, expected local or s3", kind)
+}
+
+// localStorage saves the images to the filesystem, below root when set.
+type localStorage struct {
+	root string
+}
+
+// errOutsideRoot is the error of the names reaching outside of the root. It
+// matches fs.ErrNotExist, nothing of the storage is there.
+var errOutsideRoot = fmt.Errorf("outside of the storage root: %w", fs.ErrNotExist)
+
+// file returns the path of name below the root. With a root, a name reaching
+// outside of it, through ".." or as an absolute path, fails with
+// errOutsideRoot. Without one, as for the CLI, any path is accepted.
+func (s *localStorage) file(op string, name string) (string, error) {
+	if s.root != "" && !filepath.IsLocal(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+func (s *localStorage) Location(name string) string {
+	return filepath.Join(s.root, name)
+}
+
+func (s *localStorage) Save(name string, img *imageproc.ProcessedImage, options *imageproc.Options) (string, int64, error) {
+	p, err := s.file("save", name)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := saveWithRetry(p, img, options); err != nil {
+		return "", 0, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return "", 0, err
+	}
+	return p, stat.Size(), nil
+}
+
+func (s *localStorage) Put(name string, data []byte) (string, error) {
+	p, err := s.file("put", name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, data, 0o666); err != nil {
+		os.Remove(p)
+		return "", err
+	}
+	return p, nil
+}
+
+func (s *localStorage) Open(name string) (io.ReadSeekCloser, StoredImage, error) {
+	p, err := s.file("open", name)
+	if err != nil {
+		return nil, StoredImage{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, StoredImage{}, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = &fs.PathError{Op: "open", Path: f.Name(), Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		f.Close()
+		return nil, StoredImage{}, err
+	}
+	return f, StoredImage{Name: name, Bytes: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (s *localStorage) List(prefix string) ([]StoredImage, error) {
+	root := s.root
+	if root == "" {
+		root = "."
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var images []StoredImage
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// removed since ReadDir
+			continue
+		}
+		images = append(images, StoredImage{Name: e.Name(), Bytes: info.Size(), Modified: info.ModTime()})
+	}
+	return images, nil
+}
+
+func (s *localStorage) Remove(name string) error {
+	p, err := s.file("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (s *localStorage) Check() error {
+	f, err := os.CreateTemp(s.root, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// s3Storage uploads the images to an S3 compatible bucket. The object key is
+// the slash separated name, e.g. the CLI destination path without a leading /.
+type s3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+func (s *s3Storage) key(name string) string {
+	// cleaned as an absolute path, so that ".." can't escape the prefix
+	return path.Clean("/" + filepath.ToSlash(name))[1:]
+}
+
+func (s *s3Storage) Location(name string) string {
+	return "s3://" + s.bucket + "/" + s.key(name)
+}
+
+func (s *s3Storage) Save(name string, img *imageproc.ProcessedImage, options *imageproc.Options) (string, int64, error) {
+	var buf bytes.Buffer
+	contentType, err := imageproc.Encode(&buf, img, options)
+	if err != nil {
+		return "", 0, err
+	}
+	location, err := s.put(name, buf.Bytes(), contentType)
+	if err != nil {
+		return "", 0, err
+	}
+	return location, int64(buf.Len()), nil
+}
+
+func (s *s3Storage) Put(name string, data []byte) (string, error) {
+	return s.put(name, data, detectContentType(data))
+}
+
+func (s *s3Storage) put(name string, data []byte, contentType string) (string, error) {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(s.key(name)),
+		Body:          bytes.NewReader(data),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	if err != nil {
+		return "", s.pathError("put", name, err)
+	}
+	return s.Location(name), nil
+}
+
+// objectReader is the downloaded content of an object.
+type objectReader struct {
+	*bytes.Reader
+}
+
+func (objectReader) Close() error {
+	return nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, StoredImage, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, StoredImage{}, s.pathError("get", name, err)
+	}
+	defer out.Body.Close()
+	// buffered, ServeContent seeks for the content type and ranges
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, StoredImage{}, s.pathError("get", name, err)
+	}
+	info := StoredImage{Name: name, Bytes: int64(len(data))}
+	if out.LastModified != nil {
+		info.Modified = *out.LastModified
+	}
+	return objectReader{bytes.NewReader(data)}, info, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]StoredImage, error) {
+	var images []StoredImage
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.key(prefix)),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return nil, s.pathError("list", prefix, err)
+		}
+		for _, object := range page.Contents {
+			stored := StoredImage{Name: aws.ToString(object.Key), Bytes: aws.ToInt64(object.Size)}
+			if object.LastModified != nil {
+				stored.Modified = *object.LastModified
+			}
+			images = append(images, stored)
+		}
+	}
+	return images, nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	// DeleteObject succeeds for missing keys as well
+	_, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err == nil {
+		_, err = s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		})
+	}
+	if err != nil {
+		return s.pathError("delete", name, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Check() error {
+	_, err := s.client.HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		return s.pathError("head", "", err)
+	}
+	return nil
+}
+
+// pathError reports a failed request as a storage error, like the failures of
+// the local storage, matching fs.ErrNotExist for missing objects.
+func (s *s3Storage) pathError(op string, name string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		err = fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return &fs.PathError{Op: op, Path: s.Location(name), Err: err}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/borislav-rangelov/go-image-resize/pkg/imageproc"
+)
+
+// memStorage is an in-memory Storage.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// checkErr is returned by Check
+	checkErr error
+}
+
+func (s *memStorage) Location(name string) string {
+	return "mem://" + name
+}
+
+func (s *memStorage) Save(name string, img *imageproc.ProcessedImage, options *imageproc.Options) (string, int64, error) {
+	var buf bytes.Buffer
+	if _, err := imageproc.Encode(&buf, img, options); err != nil {
+		return "", 0, err
+	}
+	location, err := s.Put(name, buf.Bytes())
+	return location, int64(buf.Len()), err
+}
+
+func (s *memStorage) Put(name string, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = data
+	return s.Location(name), nil
+}
+
+func (s *memStorage) Open(name string) (io.ReadSeekCloser, StoredImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, StoredImage{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return objectReader{bytes.NewReader(data)}, StoredImage{Name: name, Bytes: int64(len(data)), Modified: time.Unix(1700000000, 0)}, nil
+}
+
+func (s *memStorage) List(prefix string) ([]StoredImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var images []StoredImage
+	for name, data := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			images = append(images, StoredImage{Name: name, Bytes: int64(len(data))})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memStorage) Check() error {
+	return s.checkErr
+}
+
+// useMemStorage replaces the storage with an empty memStorage for the test.
+func useMemStorage(t *testing.T) *memStorage {
+	t.Helper()
+	mem := &memStorage{objects: map[string][]byte{}}
+	previous := storage
+	storage = mem
+	t.Cleanup(func() { storage = previous })
+	return mem
+}
+
+// serve sends a request without a body to the routes of the Web API.
+func serve(t *testing.T, method string, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newRouter(&APIConfig{MaxUpload: 1 << 20}).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestAPIUsesTheStorage(t *testing.T) {
+	mem := useMemStorage(t)
+	useCache(t, 4)
+	data := testPNG(t, 40, 20)
+	options := imageproc.Options{SaveOriginal: true, Thumbnails: []imageproc.Thumb{{Suffix: "-small", Width: 10}}}
+
+	w := postJSON(t, handleFormatRequest(1<<20), "/format", "photo.png", data, options)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	formatted := strings.TrimPrefix(response.Formatted, "mem://")
+	if formatted == response.Formatted || !strings.HasSuffix(formatted, "-photo.png") {
+		t.Fatalf("formatted %q, want a location of the storage", response.Formatted)
+	}
+	original := strings.TrimPrefix(response.Original, "mem://")
+	if !bytes.Equal(mem.objects[original], data) {
+		t.Errorf("the original %q wasn't put as uploaded", response.Original)
+	}
+	if len(response.Thumbnails) != 1 || mem.objects[strings.TrimPrefix(response.Thumbnails[0], "mem://")] == nil {
+		t.Errorf("thumbnails %v weren't saved", response.Thumbnails)
+	}
+
+	w = serve(t, http.MethodGet, "/images")
+	var list ImageList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 3 {
+		t.Errorf("listed %d images, want 3: %+v", list.Total, list.Images)
+	}
+
+	w = serve(t, http.MethodGet, "/image/"+formatted)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("ETag") == "" {
+		t.Errorf("serving %s: status %d, headers %v", formatted, w.Code, w.Header())
+	}
+
+	w = serve(t, http.MethodDelete, "/image/"+formatted+"?thumbnails=true")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting %s: status %d: %s", formatted, w.Code, w.Body)
+	}
+	if len(mem.objects) != 0 {
+		t.Errorf("left %d objects after the delete", len(mem.objects))
+	}
+	if _, ok := cache.get(cacheKey("photo.png", data, &options)); ok {
+		t.Errorf("the cached response of the deleted images is still served")
+	}
+	if w = serve(t, http.MethodGet, "/image/"+formatted); w.Code != http.StatusNotFound {
+		t.Errorf("serving the deleted %s: status %d", formatted, w.Code)
+	}
+}
+
+func TestReadyChecksTheStorage(t *testing.T) {
+	mem := useMemStorage(t)
+	if w := serve(t, http.MethodGet, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", w.Code)
+	}
+	mem.checkErr = errors.New("bucket unreachable")
+	if w := serve(t, http.MethodGet, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with a failing storage, want 503", w.Code)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	local := &localStorage{root: root}
+	location, err := local.Put("photo.png", testPNG(t, 8, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != filepath.Join(root, "photo.png") {
+		t.Errorf("put at %s, want in the root", location)
+	}
+	if _, _, err := local.Save("photo-small.png", &imageproc.ProcessedImage{Name: "photo-small.png", Image: testImage(4, 4)}, &imageproc.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, info, err := local.Open("photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(data, testPNG(t, 8, 8)) || info.Bytes != int64(len(data)) || info.Modified.IsZero() {
+		t.Errorf("opened %d bytes, %+v", len(data), info)
+	}
+	if images, err := local.List("photo-"); err != nil || len(images) != 1 || images[0].Name != "photo-small.png" {
+		t.Errorf("listed %+v, %v, want photo-small.png", images, err)
+	}
+
+	if err := local.Remove("photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := local.Open("photo.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening the removed image: got %v, want fs.ErrNotExist", err)
+	}
+	if err := local.Remove("photo.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removing it again: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestLocalStorageStaysInTheRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"secret.png": testPNG(t, 8, 8), "root/photo.png": testPNG(t, 8, 8)})
+	local := &localStorage{root: filepath.Join(dir, "root")}
+	img := &imageproc.ProcessedImage{Name: "x.png", Image: testImage(4, 4)}
+
+	for _, name := range []string{"../secret.png", "a/../../secret.png", filepath.Join(dir, "secret.png")} {
+		if _, _, err := local.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %s: got %v, want fs.ErrNotExist", name, err)
+		}
+		if err := local.Remove(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("removing %s: got %v, want fs.ErrNotExist", name, err)
+		}
+		if _, err := local.Put(name, []byte("x")); !errors.Is(err, errOutsideRoot) {
+			t.Errorf("putting %s: got %v, want errOutsideRoot", name, err)
+		}
+		if _, _, err := local.Save(name, img, &imageproc.Options{}); !errors.Is(err, errOutsideRoot) {
+			t.Errorf("saving %s: got %v, want errOutsideRoot", name, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "secret.png")); err != nil || !bytes.Equal(data, testPNG(t, 8, 8)) {
+		t.Errorf("the file outside of the root changed: %v", err)
+	}
+	if f, _, err := local.Open("sub/../photo.png"); err != nil {
+		t.Errorf("opening a name cleaned to the root: %v", err)
+	} else {
+		f.Close()
+	}
+
+	// without a root, as for the CLI, any path is accepted
+	if _, _, err := (&localStorage{}).Save(filepath.Join(dir, "out.png"), img, &imageproc.Options{}); err != nil {
+		t.Errorf("saving an absolute path without a root: %v", err)
+	}
+}
+
+func TestS3Key(t *testing.T) {
+	s := &s3Storage{bucket: "images"}
+	for name, want := range map[string]string{
+		"photo.png":              "photo.png",
+		"out/photo.png":          "out/photo.png",
+		"/abs/photo.png":         "abs/photo.png",
+		"../../photo.png":        "photo.png",
+		"out/../../../photo.png": "photo.png",
+	} {
+		if got := s.key(name); got != want {
+			t.Errorf("key(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := s.Location("out/photo.png"); got != "s3://images/out/photo.png" {
+		t.Errorf("got the location %s", got)
+	}
+}